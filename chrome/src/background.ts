@@ -3,6 +3,7 @@ const INTERNAL_TESTALIVE_PORT = "EchoDaemon_Internal_alive_test";
 const nextSeconds = 25;
 const SECONDS = 1000;
 const DEBUG = false;
+const PLAYLIST_POLL_SECONDS = 5;
 
 var alivePort: chrome.runtime.Port | null = null;
 var isFirstStart = true;
@@ -13,12 +14,14 @@ var lastCall: number;
 var wakeup: NodeJS.Timeout | undefined = undefined;
 var wsTest = undefined;
 var wCounter = 0;
+var lastPlaylistTrack = "";
 
 const starter = `-------- >>> ${convertNoDate(Date.now())} UTC - Service Worker for EchoDaemon Keep-Alive is starting <<< --------`;
 
 console.log(starter);
 
 letsStart();
+setInterval(pollPlaylist, PLAYLIST_POLL_SECONDS * SECONDS);
 
 // Helper: should skip forwarding this URL?
 function shouldSkipForward(url: string): boolean {
@@ -184,6 +187,39 @@ chrome.webRequest.onBeforeRequest.addListener(
     ["requestBody"]
 );
 
+interface PlaylistStatus {
+    id: string;
+    track_id?: string;
+    status: string;
+    playlist_track_count?: number;
+    playlist_track_done?: number;
+}
+
+// Ask the Go server which playlist track it wants captured next and play it in a YouTube Music tab.
+async function pollPlaylist() {
+    let playlist: PlaylistStatus;
+    try {
+        const res = await fetch(`http://localhost:${goPort}/playlist`);
+        if (!res.ok) return;
+        playlist = await res.json();
+    } catch (err) {
+        if (DEBUG) console.log("Failed to poll playlist:", err);
+        return;
+    }
+    if (playlist.status !== "running" || !playlist.track_id || playlist.track_id === lastPlaylistTrack) {
+        return;
+    }
+    lastPlaylistTrack = playlist.track_id;
+    const url = `https://music.youtube.com/watch?v=${playlist.track_id}`;
+    console.log(`Playlist ${playlist.id}: playing track ${(playlist.playlist_track_done ?? 0) + 1}/${playlist.playlist_track_count ?? "?"} (${playlist.track_id})`);
+    const tabs = await chrome.tabs.query({ url: "*://music.youtube.com/*" });
+    if (tabs.length > 0 && tabs[0].id !== undefined) {
+        await chrome.tabs.update(tabs[0].id, { url });
+    } else {
+        await chrome.tabs.create({ url });
+    }
+}
+
 async function getCookies(url: string): Promise<string> {
     return new Promise((resolve) => {
         chrome.cookies.getAll({ url }, (cookies) => {
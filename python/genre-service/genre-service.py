@@ -1,61 +1,133 @@
 import os
 import argparse
-from musicnn.tagger import top_tags
 import json
+from http.server import BaseHTTPRequestHandler, HTTPServer
 
 os.environ['LIBROSA_CACHE_DIR'] = '/tmp/librosa_cache'
 os.environ['NUMBA_CACHE_DIR'] = '/tmp/numba_cache'
 
+import librosa
+import numpy as np
+import tensorflow as tf
+from musicnn import configuration as config
+from musicnn import extractor, models
+from musicnn.tagger import top_tags
+
+MODELS = ['MSD_musicnn', 'MSD_vgg', 'MTT_musicnn', 'MTT_vgg']
+TOPS = 5
+GENRES = ['classical', 'techno', 'strings', 'drums', 'electronic', 'rock', 'piano', 'ambient', 'violin', 'vocal', 'synth', 'indian', 'opera', 'harpsichord', 'flute', 'pop', 'sitar', 'classic', 'choir', 'new age', 'dance', 'harp', 'cello', 'country', 'metal', 'choral', 'alternative', 'indie', '00s', 'alternative rock', 'jazz', 'chillout', 'classic rock', 'soul', 'indie rock', 'Mellow', 'electronica', '80s', 'folk', '90s', 'chill', 'instrumental', 'punk', 'oldies', 'blues', 'hard rock', 'acoustic', 'experimental', 'Hip-Hop', '70s', 'party', 'easy listening', 'funk', 'electro', 'heavy metal', 'Progressive rock', '60s', 'rnb', 'indie pop', 'sad', 'House']
+
+
+def pick_genre(tags_by_model):
+    # Each model votes for its top tags, the first getting TOPS points; the best voted genre tag wins
+    votes = {}
+    for tags in tags_by_model:
+        w = TOPS
+        for l in tags:
+            votes[l] = votes.get(l, 0) + w
+            w = w - 1
+    ranked = sorted(votes.items(), key=lambda x: x[1], reverse=True)
+    for tag, _ in ranked:
+        if tag in GENRES:
+            return tag.title()
+    return ranked[0][0].title()
+
+
 def process_track(file_path):
-    tops = 5
-    t = top_tags(file_path, model='MSD_musicnn', topN=tops, print_tags=False)
-    v = top_tags(file_path, model='MSD_vgg', topN=tops, print_tags=False)
-    x = top_tags(file_path, model='MTT_musicnn', topN=tops, print_tags=False)
-    y = top_tags(file_path, model='MTT_vgg', topN=tops, print_tags=False)
-    z = {}
-    w = tops
-    for l in t:
-        z[l] = w
-        w=w-1
-    w=tops
-    for l in v:
-        if l in z: 
-            z[l] = z[l] +w
-        else:
-            z[l] = w
-        w=w-1
-    w=tops
-    for l in x:
-        if l in z: 
-            z[l] = z[l] +w
-        else:
-            z[l] = w
-        w=w-1
-    w=tops
-    for l in y:
-        if l in z: 
-            z[l] = z[l] +w
-        else:
-            z[l] = w
-        w=w-1
-    s = sorted(z.items(), key=lambda x:x[1], reverse=True)
-    z = dict(s)
-    g = ['classical', 'techno', 'strings', 'drums', 'electronic', 'rock', 'piano', 'ambient', 'violin', 'vocal', 'synth', 'indian', 'opera', 'harpsichord', 'flute', 'pop', 'sitar', 'classic', 'choir', 'new age', 'dance', 'harp', 'cello', 'country', 'metal', 'choral', 'alternative', 'indie', '00s', 'alternative rock', 'jazz', 'chillout', 'classic rock', 'soul', 'indie rock', 'Mellow', 'electronica', '80s', 'folk', '90s', 'chill', 'instrumental', 'punk', 'oldies', 'blues', 'hard rock', 'acoustic', 'experimental', 'Hip-Hop', '70s', 'party', 'easy listening', 'funk', 'electro', 'heavy metal', 'Progressive rock', '60s', 'rnb', 'indie pop', 'sad', 'House']
-    for k in z:
-        if k in g:
-            z = k
-            break
-    if z == dict(s):
-        z = list(z.keys())[0]
-
-    print(json.dumps({"genre": z.title()}))
+    tags = [top_tags(file_path, model=m, topN=TOPS, print_tags=False) for m in MODELS]
+    print(json.dumps({"genre": pick_genre(tags)}))
+
+
+class Tagger:
+    '''Keeps a model's graph and session loaded between tracks. Gives the same tags as musicnn.tagger.top_tags.'''
+
+    def __init__(self, model):
+        self.labels = config.MTT_LABELS if 'MTT' in model else config.MSD_LABELS
+        self.n_frames = librosa.time_to_frames(3, sr=config.SR, n_fft=config.FFT_SIZE, hop_length=config.FFT_HOP) + 1
+        self.graph = tf.Graph()
+        with self.graph.as_default():
+            with tf.name_scope('model'):
+                self.x = tf.compat.v1.placeholder(tf.float32, [None, self.n_frames, config.N_MELS])
+                self.is_training = tf.compat.v1.placeholder(tf.bool)
+                y = models.define_model(self.x, self.is_training, model, len(self.labels))[0]
+                self.y = tf.nn.sigmoid(y)
+            self.sess = tf.compat.v1.Session(graph=self.graph)
+            self.sess.run(tf.compat.v1.global_variables_initializer())
+            tf.compat.v1.train.Saver().restore(self.sess, os.path.dirname(extractor.__file__) + '/' + model + '/')
+
+    def scores(self, file_path):
+        batch, _ = extractor.batch_data(file_path, self.n_frames, self.n_frames)
+        taggram = self.sess.run(self.y, feed_dict={self.x: batch, self.is_training: False})
+        return np.mean(taggram, axis=0)
+
+    def top_tags(self, means, top_n):
+        return [self.labels[i] for i in means.argsort()[-top_n:][::-1]]
+
+
+def merge_scores(taggers, scores):
+    # Tags known to several models, like rock or pop, get the mean of their scores
+    merged = {}
+    for t, means in zip(taggers, scores):
+        for label, score in zip(t.labels, means):
+            merged.setdefault(label, []).append(float(score))
+    return {label: sum(s) / len(s) for label, s in merged.items()}
+
+
+def serve(host, port):
+    # The models are loaded before listening, so /health only answers once tracks can be classified
+    taggers = [Tagger(m) for m in MODELS]
+
+    class Handler(BaseHTTPRequestHandler):
+        def do_GET(self):
+            if self.path != '/health':
+                self.reply(404, {'error': 'not found'})
+                return
+            self.reply(200, {'status': 'ok'})
+
+        def do_POST(self):
+            if self.path != '/classify':
+                self.reply(404, {'error': 'not found'})
+                return
+            try:
+                req = json.loads(self.rfile.read(int(self.headers.get('Content-Length', 0))))
+                scores = [t.scores(req['path']) for t in taggers]
+            except Exception as e:
+                self.reply(500, {'error': str(e)})
+                return
+            tags = [t.top_tags(means, TOPS) for t, means in zip(taggers, scores)]
+            self.reply(200, {'genre': pick_genre(tags), 'tags': merge_scores(taggers, scores)})
+
+        def log_message(self, format, *args):
+            # Every track would otherwise log a request line to the daemon's log
+            pass
+
+        def reply(self, status, body):
+            data = json.dumps(body).encode()
+            self.send_response(status)
+            self.send_header('Content-Type', 'application/json')
+            self.send_header('Content-Length', str(len(data)))
+            self.end_headers()
+            self.wfile.write(data)
+
+    server = HTTPServer((host, port), Handler)
+    print('genre service listening on %s:%d' % (host, port), flush=True)
+    server.serve_forever()
+
 
 def main():
-    parser = argparse.ArgumentParser(description='Process a music track and send genre to an API.')
-    parser.add_argument('file_path', type=str, help='The path of the track to process')
+    parser = argparse.ArgumentParser(description='Detect the genre of a music track.')
+    parser.add_argument('file_path', type=str, nargs='?', help='The path of the track to process')
+    parser.add_argument('--serve', action='store_true', help='Keep the models loaded and classify tracks over HTTP instead')
+    parser.add_argument('--host', type=str, default='127.0.0.1', help='Address to listen on with --serve')
+    parser.add_argument('--port', type=int, default=50998, help='Port to listen on with --serve')
     args = parser.parse_args()
-    
-    process_track(args.file_path)
+
+    if args.serve:
+        serve(args.host, args.port)
+    elif args.file_path:
+        process_track(args.file_path)
+    else:
+        parser.error('a file path or --serve is required')
 
 if __name__ == "__main__":
-    main()
\ No newline at end of file
+    main()
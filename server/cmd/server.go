@@ -2,20 +2,25 @@ package main
 
 import (
 	"context"
-	"io/fs"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
-	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/gcottom/audiometa/v3"
 	"github.com/gcottom/echodaemon/config"
 	"github.com/gcottom/echodaemon/handlers"
 	"github.com/gcottom/echodaemon/logger"
+	"github.com/gcottom/echodaemon/services/classifier"
+	"github.com/gcottom/echodaemon/services/coverart"
 	"github.com/gcottom/echodaemon/services/downloader"
+	"github.com/gcottom/echodaemon/services/events"
+	"github.com/gcottom/echodaemon/services/library"
+	"github.com/gcottom/echodaemon/services/lyrics"
 	"github.com/gcottom/echodaemon/services/meta"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -44,24 +49,89 @@ func RunServer() error {
 		ClientID:     cfg.SpotifyClientID,
 		ClientSecret: cfg.SpotifyClientSecret,
 		TokenURL:     spotifyauth.TokenURL,
-	}}
+	}, MinScore: cfg.Metadata.MinScore, GenrePolicy: cfg.Metadata.GenrePolicy}
+	metaService.CoverArt = &coverart.Service{
+		CacheDir:    filepath.Join(cfg.TempDir, "covers"),
+		MaxSize:     cfg.CoverArt.MaxSize,
+		Format:      cfg.CoverArt.Format,
+		JPEGQuality: cfg.CoverArt.JPEGQuality,
+		HTTPClient:  &http.Client{Timeout: 15 * time.Second},
+	}
+	metaService.MusicBrainz = &meta.MusicBrainzClient{
+		BaseURL:     strings.TrimSuffix(cfg.MusicBrainz.BaseURL, "/"),
+		AcoustIDURL: strings.TrimSuffix(cfg.MusicBrainz.AcoustIDURL, "/"),
+		AcoustIDKey: cfg.MusicBrainz.AcoustIDKey,
+		UserAgent:   fmt.Sprintf("echo-daemon/1.0 ( %s )", cfg.MusicBrainz.Contact),
+		HTTPClient:  &http.Client{Timeout: 15 * time.Second},
+	}
+	genreClassifier := &classifier.Sidecar{
+		Command:        slices.Concat(cfg.Classifier.Command, []string{"--serve", "--port", strconv.Itoa(cfg.Classifier.Port)}),
+		Addr:           net.JoinHostPort("127.0.0.1", strconv.Itoa(cfg.Classifier.Port)),
+		Timeout:        time.Duration(cfg.Classifier.Timeout) * time.Second,
+		StartupTimeout: time.Duration(cfg.Classifier.StartupTimeout) * time.Second,
+		HTTPClient:     &http.Client{},
+	}
+	metaService.Classifier = genreClassifier
+	metaService.TagThreshold, metaService.MaxGenres = cfg.Classifier.Threshold, cfg.Classifier.MaxGenres
+	if cfg.Classifier.Taxonomy != "" {
+		if metaService.Taxonomy, err = classifier.LoadTaxonomy(cfg.Classifier.Taxonomy); err != nil {
+			logger.ErrorC(ctx, "failed to load genre taxonomy", slog.Any("error", err))
+			return err
+		}
+	}
+	// Additional MetadataProvider implementations can be added to this map to make them selectable in settings.yaml
+	providers := metaService.BuiltinProviders()
+	if err = metaService.UseProviders(cfg.Metadata.Providers, providers); err != nil {
+		logger.ErrorC(ctx, "failed to set up metadata providers", slog.Any("error", err))
+		return err
+	}
+	logger.InfoC(ctx, "metadata providers enabled", slog.Any("providers", cfg.Metadata.Providers))
+	if slices.Contains(cfg.Metadata.Providers, meta.ProviderClassifier) {
+		logger.InfoC(ctx, "starting genre classifier...")
+		go genreClassifier.Run(ctx)
+	}
+
+	logger.InfoC(ctx, "opening job store...")
+	jobStore, err := downloader.OpenJobStore(cfg.TempDir)
+	if err != nil {
+		logger.ErrorC(ctx, "failed to open job store", slog.Any("error", err))
+		return err
+	}
+	defer jobStore.Close()
+
+	logger.InfoC(ctx, "opening library index...")
+	libraryService, err := library.Open(cfg.TempDir)
+	if err != nil {
+		logger.ErrorC(ctx, "failed to open library index", slog.Any("error", err))
+		return err
+	}
+	defer libraryService.Close()
+	go libraryService.Scan(ctx, cfg.MusicDir)
+
+	eventsService := new(events.Service)
 
-	libMap := new(sync.Map)
-	initLibraryMap(ctx, libMap, cfg.MusicDir)
 	logger.InfoC(ctx, "creating downloader service...")
 	downloaderService := &downloader.Service{
 		MetaServiceClient: metaService,
 		CaptureChannel:    make(chan downloader.CaptureChanData, 100),
-		CurrentCapture:    new(downloader.CurrentCapture),
-		LibraryMap:        libMap,
+		Library:           libraryService,
+		Jobs:              jobStore,
+		Events:            eventsService,
+	}
+	if cfg.Lyrics.Enabled {
+		downloaderService.Lyrics = &lyrics.Service{
+			BaseURL:    strings.TrimSuffix(cfg.Lyrics.BaseURL, "/"),
+			UserAgent:  "echo-daemon/1.0 (https://github.com/gcottom/echo-daemon)",
+			HTTPClient: &http.Client{Timeout: 15 * time.Second},
+		}
 	}
 
 	logger.InfoC(ctx, "creating gin engine...")
 	gin.SetMode(gin.ReleaseMode)
 	ginws := gin.New()
 	ginws.Use(cors.New(cors.Config{
-		AllowAllOrigins:  true,
-		AllowMethods:     []string{"GET", "POST", "OPTIONS"},
+		AllowOriginFunc:  extensionOrigin(cfg.ExtensionID),
+		AllowMethods:     []string{"GET", "POST", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Accept"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
@@ -71,7 +141,7 @@ func RunServer() error {
 		gin.Recovery())
 
 	logger.InfoC(ctx, "setting up routes...")
-	handlers.SetupRoutes(ginws, downloaderService)
+	handlers.SetupRoutes(ginws, downloaderService, eventsService)
 
 	logger.InfoC(ctx, "starting capture processor...")
 	go downloaderService.CaptureProcessor(ctx)
@@ -81,39 +151,13 @@ func RunServer() error {
 	return http.ListenAndServe(":50999", ginws)
 }
 
-func initLibraryMap(ctx context.Context, libMap *sync.Map, musicDir string) {
-	logger.InfoC(ctx, "initializing library map...")
-	count := 0
-	if err := filepath.WalkDir(musicDir, func(path string, info fs.DirEntry, err error) error {
-		if err != nil {
-			logger.ErrorC(ctx, "error walking directory", slog.String("path", path), slog.Any("error", err))
-			return err
-		}
-		if info.IsDir() {
-			return nil // Skip directories
-		}
-
-		filename := filepath.Base(path)
-		f, err := os.Open(path)
-		if err != nil {
-			logger.ErrorC(ctx, "failed to open file", slog.String("file", filename),
-				slog.Any("error", err))
-			return nil
-		}
-		defer f.Close()
-		tag, err := audiometa.OpenTag(f)
-		if err != nil {
-			return nil // Skip files with no tags
-		}
-		if strings.TrimSpace(tag.GetTitle()) == "" || strings.TrimSpace(tag.GetArtist()) == "" {
-			return nil // Skip files with empty title or artist
+// extensionOrigin allows requests from the Chrome extension only, so other web pages can't drive the daemon. With no
+// extension ID configured any extension is allowed, since an unpacked extension's ID depends on where it's loaded from.
+func extensionOrigin(extensionID string) func(string) bool {
+	return func(origin string) bool {
+		if extensionID != "" {
+			return origin == "chrome-extension://"+extensionID
 		}
-		count++
-		libMap.Store(strings.TrimSpace(tag.GetTitle())+" - "+strings.TrimSpace(tag.GetArtist()), true)
-		return nil
-	}); err != nil {
-		logger.ErrorC(ctx, "failed to initialize library map, failed to walk music directory", slog.String("musicDir", musicDir), slog.Any("error", err))
-		return
+		return strings.HasPrefix(origin, "chrome-extension://")
 	}
-	logger.InfoC(ctx, "library map initialized", slog.Int("size", count))
 }
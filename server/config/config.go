@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 
 	"gopkg.in/yaml.v2"
@@ -21,6 +22,32 @@ func LoadConfigFromFile(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if config.DuplicateSimilarity == 0 {
+		config.DuplicateSimilarity = 0.8
+	}
+	if config.DuplicateSimilarity < 0 || config.DuplicateSimilarity > 1 {
+		return nil, fmt.Errorf("duplicate_similarity must be between 0 and 1, got %g", config.DuplicateSimilarity)
+	}
+	if err = config.Output.applyDefaults(); err != nil {
+		return nil, err
+	}
+	if err = config.Loudness.applyDefaults(); err != nil {
+		return nil, err
+	}
+	if err = config.Trim.applyDefaults(); err != nil {
+		return nil, err
+	}
+	config.MusicBrainz.applyDefaults()
+	config.Lyrics.applyDefaults()
+	if err = config.CoverArt.applyDefaults(); err != nil {
+		return nil, err
+	}
+	if err = config.Metadata.applyDefaults(); err != nil {
+		return nil, err
+	}
+	if err = config.Classifier.applyDefaults(); err != nil {
+		return nil, err
+	}
 	AppConfig = &config
 	return &config, nil
 }
@@ -31,6 +58,295 @@ type Config struct {
 	MusicDir            string `yaml:"music_dir"`
 	SpotifyClientID     string `yaml:"spotify_client_id"`
 	SpotifyClientSecret string `yaml:"spotify_client_secret"`
+	// ExtensionID is the ID of the Chrome extension allowed to call the API; empty allows any extension
+	ExtensionID string `yaml:"extension_id"`
+	// DownloadRateLimit caps media downloads in bytes per second; 0 leaves them unpaced
+	DownloadRateLimit int64 `yaml:"download_rate_limit"`
+	// DownloadRateJitter randomly varies the rate limit by up to this fraction (0-1)
+	DownloadRateJitter float64 `yaml:"download_rate_jitter"`
+	// DuplicateSimilarity is the fingerprint similarity (0-1) at which a download counts as already in the library
+	DuplicateSimilarity float64 `yaml:"duplicate_similarity"`
+	// Output selects the format converted tracks are saved in
+	Output OutputConfig `yaml:"output"`
+	// Loudness controls EBU R128 analysis of converted tracks
+	Loudness LoudnessConfig `yaml:"loudness"`
+	// Trim controls cutting leading and trailing silence from converted tracks
+	Trim TrimConfig `yaml:"trim"`
+	// MusicBrainz configures the musicbrainz metadata provider
+	MusicBrainz MusicBrainzConfig `yaml:"musicbrainz"`
+	// Metadata selects the metadata providers
+	Metadata MetadataConfig `yaml:"metadata"`
+	// Lyrics configures fetching and embedding lyrics
+	Lyrics LyricsConfig `yaml:"lyrics"`
+	// CoverArt configures how cover images are processed and embedded
+	CoverArt CoverArtConfig `yaml:"cover_art"`
+	// Classifier configures the genre classifier service used by the classifier metadata provider
+	Classifier ClassifierConfig `yaml:"classifier"`
+}
+
+// Output formats; each doubles as the saved file's extension
+const (
+	FormatMP3  = "mp3"
+	FormatOpus = "opus"
+	FormatOgg  = "ogg"
+	FormatFLAC = "flac"
+	FormatM4A  = "m4a"
+)
+
+const DefaultBitrate = "256k"
+
+// OutputConfig is the output profile for converted tracks. opus and ogg copy the captured Opus stream without
+// re-encoding, flac is lossless, and mp3 and m4a are encoded at Bitrate (mp3 uses VBRQuality instead when VBR is set).
+type OutputConfig struct {
+	Format     string `yaml:"format"`
+	Bitrate    string `yaml:"bitrate"`
+	VBR        bool   `yaml:"vbr"`
+	VBRQuality int    `yaml:"vbr_quality"`
+}
+
+// Remuxes reports whether the format keeps the captured Opus audio as is instead of re-encoding it
+func (o OutputConfig) Remuxes() bool {
+	return o.Format == FormatOpus || o.Format == FormatOgg
+}
+
+func (o *OutputConfig) applyDefaults() error {
+	if o.Format == "" {
+		o.Format = FormatMP3
+	}
+	switch o.Format {
+	case FormatMP3, FormatOpus, FormatOgg, FormatFLAC, FormatM4A:
+	default:
+		return fmt.Errorf("unsupported output format %q", o.Format)
+	}
+	if o.Bitrate == "" {
+		o.Bitrate = DefaultBitrate
+	}
+	if o.VBRQuality < 0 || o.VBRQuality > 9 {
+		return fmt.Errorf("vbr_quality must be between 0 and 9, got %d", o.VBRQuality)
+	}
+	return nil
 }
 
 var AppConfig *Config
+
+// Loudness modes
+const (
+	LoudnessOff       = "off"
+	LoudnessTags      = "tags"
+	LoudnessNormalize = "normalize"
+)
+
+// LoudnessConfig selects how EBU R128 measurements are used. "tags" writes ReplayGain gain tags relative to
+// TargetLUFS (R128 gain tags for Opus), while "normalize" re-encodes with a two-pass loudnorm to TargetLUFS. Opus
+// and Ogg output is never re-encoded, so "normalize" writes gain tags for them instead.
+type LoudnessConfig struct {
+	Mode       string  `yaml:"mode"`
+	TargetLUFS float64 `yaml:"target_lufs"`
+	TruePeak   float64 `yaml:"true_peak"`
+	LRA        float64 `yaml:"lra"`
+}
+
+func (l *LoudnessConfig) applyDefaults() error {
+	if l.Mode == "" {
+		l.Mode = LoudnessOff
+	}
+	switch l.Mode {
+	case LoudnessOff, LoudnessTags, LoudnessNormalize:
+	default:
+		return fmt.Errorf("unsupported loudness mode %q", l.Mode)
+	}
+	if l.TargetLUFS == 0 {
+		l.TargetLUFS = -18 // ReplayGain 2.0 reference level
+	}
+	if l.TruePeak == 0 {
+		l.TruePeak = -1
+	}
+	if l.LRA == 0 {
+		l.LRA = 11
+	}
+	return nil
+}
+
+// TrimConfig enables trimming silence from the start and end of converted tracks. Audio quieter than ThresholdDB
+// for at least MinSilence seconds counts as silence, and Padding seconds of it are kept on either side of the cut.
+type TrimConfig struct {
+	Enabled     bool    `yaml:"enabled"`
+	ThresholdDB float64 `yaml:"threshold_db"`
+	MinSilence  float64 `yaml:"min_silence"`
+	Padding     float64 `yaml:"padding"`
+}
+
+func (t *TrimConfig) applyDefaults() error {
+	if t.ThresholdDB == 0 {
+		t.ThresholdDB = -50
+	}
+	if t.ThresholdDB > 0 {
+		return fmt.Errorf("trim threshold_db must be negative, got %g", t.ThresholdDB)
+	}
+	if t.MinSilence == 0 {
+		t.MinSilence = 1
+	}
+	if t.MinSilence < 0 || t.Padding < 0 {
+		return fmt.Errorf("trim min_silence and padding can't be negative")
+	}
+	if t.Padding == 0 {
+		t.Padding = 0.25
+	}
+	return nil
+}
+
+// MusicBrainzConfig configures looking tracks up on MusicBrainz, by audio fingerprint through AcoustID when
+// AcoustIDKey is set and by title and artist otherwise. The base URLs can point at a mirror or a local stand-in.
+type MusicBrainzConfig struct {
+	BaseURL     string `yaml:"base_url"`
+	AcoustIDURL string `yaml:"acoustid_url"`
+	AcoustIDKey string `yaml:"acoustid_key"`
+	// Contact is added to the User-Agent, as MusicBrainz asks of API clients
+	Contact string `yaml:"contact"`
+}
+
+func (m *MusicBrainzConfig) applyDefaults() {
+	if m.BaseURL == "" {
+		m.BaseURL = "https://musicbrainz.org/ws/2"
+	}
+	if m.AcoustIDURL == "" {
+		m.AcoustIDURL = "https://api.acoustid.org/v2"
+	}
+}
+
+// Genre policies, choosing between the matched Spotify track's artist genres and the genres the classifier detects
+const (
+	GenrePolicyPreferSpotify = "prefer_spotify"
+	GenrePolicyPreferML      = "prefer_ml"
+	GenrePolicyUnion         = "union"
+	// GenrePolicyMLFallback only runs the classifier when Spotify has no genres for the track
+	GenrePolicyMLFallback = "ml_only_when_spotify_empty"
+)
+
+// MetadataConfig lists the enabled metadata providers in priority order. Each tag is taken from the first provider
+// that found a match carrying it, where a match is a candidate scoring at least MinScore (0-1) on title, artist and
+// duration similarity. The genre is the exception, chosen by GenrePolicy instead.
+type MetadataConfig struct {
+	Providers   []string `yaml:"providers"`
+	MinScore    float64  `yaml:"min_score"`
+	GenrePolicy string   `yaml:"genre_policy"`
+}
+
+func (m *MetadataConfig) applyDefaults() error {
+	if len(m.Providers) == 0 {
+		m.Providers = []string{"spotify", "classifier", "youtube"}
+	}
+	if m.MinScore == 0 {
+		m.MinScore = 0.85
+	}
+	if m.MinScore < 0 || m.MinScore > 1 {
+		return fmt.Errorf("metadata min_score must be between 0 and 1, got %g", m.MinScore)
+	}
+	if m.GenrePolicy == "" {
+		m.GenrePolicy = GenrePolicyPreferML
+	}
+	switch m.GenrePolicy {
+	case GenrePolicyPreferSpotify, GenrePolicyPreferML, GenrePolicyUnion, GenrePolicyMLFallback:
+	default:
+		return fmt.Errorf("unsupported metadata genre_policy %q", m.GenrePolicy)
+	}
+	return nil
+}
+
+// LyricsConfig configures looking up lyrics on an LRCLIB compatible API after a track's metadata is chosen. Synced
+// lyrics are embedded alongside the plain ones and, with Sidecar, also written to a .lrc file next to the track.
+type LyricsConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	BaseURL string `yaml:"base_url"`
+	Sidecar bool   `yaml:"sidecar"`
+}
+
+func (l *LyricsConfig) applyDefaults() {
+	if l.BaseURL == "" {
+		l.BaseURL = "https://lrclib.net/api"
+	}
+}
+
+// Cover art encodings
+const (
+	CoverFormatJPEG = "jpeg"
+	CoverFormatPNG  = "png"
+)
+
+// CoverArtConfig configures the embedded cover art. Covers are cropped square and scaled down to MaxSize pixels,
+// then encoded as Format. FolderImage also saves each cover as folder.jpg in the directory of the saved track
+// when it has none yet.
+type CoverArtConfig struct {
+	MaxSize     int    `yaml:"max_size"`
+	Format      string `yaml:"format"`
+	JPEGQuality int    `yaml:"jpeg_quality"`
+	FolderImage bool   `yaml:"folder_image"`
+}
+
+func (c *CoverArtConfig) applyDefaults() error {
+	if c.MaxSize == 0 {
+		c.MaxSize = 1000
+	}
+	if c.Format == "" {
+		c.Format = CoverFormatJPEG
+	}
+	if c.JPEGQuality == 0 {
+		c.JPEGQuality = 90
+	}
+	switch {
+	case c.MaxSize < 0:
+		return fmt.Errorf("cover_art max_size must not be negative, got %d", c.MaxSize)
+	case c.Format != CoverFormatJPEG && c.Format != CoverFormatPNG:
+		return fmt.Errorf("unsupported cover_art format %q", c.Format)
+	case c.JPEGQuality < 1 || c.JPEGQuality > 100:
+		return fmt.Errorf("cover_art jpeg_quality must be between 1 and 100, got %d", c.JPEGQuality)
+	}
+	return nil
+}
+
+// ClassifierConfig configures the genre classifier, which runs as a long-lived local service started with Command
+// and listening on Port. Timeout bounds each track's classification and StartupTimeout how long a track waits for
+// the service to load its models, both in seconds. The tags it detects are mapped to genres, moods and instruments
+// through the Taxonomy file, or a built-in taxonomy when it's empty, keeping those scoring at least Threshold (0-1)
+// and at most MaxGenres genres.
+type ClassifierConfig struct {
+	Command        []string `yaml:"command"`
+	Port           int      `yaml:"port"`
+	Timeout        int      `yaml:"timeout"`
+	StartupTimeout int      `yaml:"startup_timeout"`
+	Taxonomy       string   `yaml:"taxonomy"`
+	Threshold      float64  `yaml:"threshold"`
+	MaxGenres      int      `yaml:"max_genres"`
+}
+
+func (c *ClassifierConfig) applyDefaults() error {
+	if len(c.Command) == 0 {
+		c.Command = []string{"python", "./python/genre-service/genre-service.py"}
+	}
+	if c.Port == 0 {
+		c.Port = 50998
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 120
+	}
+	if c.StartupTimeout == 0 {
+		c.StartupTimeout = 300
+	}
+	if c.Threshold == 0 {
+		c.Threshold = 0.2
+	}
+	if c.MaxGenres == 0 {
+		c.MaxGenres = 3
+	}
+	switch {
+	case c.Port < 0 || c.Port > 65535:
+		return fmt.Errorf("classifier port must be between 1 and 65535, got %d", c.Port)
+	case c.Timeout < 0 || c.StartupTimeout < 0:
+		return fmt.Errorf("classifier timeouts must not be negative")
+	case c.Threshold < 0 || c.Threshold > 1:
+		return fmt.Errorf("classifier threshold must be between 0 and 1, got %g", c.Threshold)
+	case c.MaxGenres < 0:
+		return fmt.Errorf("classifier max_genres must not be negative, got %d", c.MaxGenres)
+	}
+	return nil
+}
@@ -3,20 +3,23 @@ module github.com/gcottom/echodaemon
 go 1.24.0
 
 require (
+	github.com/bogem/id3v2/v2 v2.1.4
 	github.com/gcottom/audiometa/v3 v3.0.4
 	github.com/gcottom/retry v0.1.1
 	github.com/gin-contrib/cors v1.7.6
 	github.com/gin-gonic/gin v1.11.0
 	github.com/zmb3/spotify/v2 v2.4.3
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/image v0.31.0
 	golang.org/x/oauth2 v0.31.0
 	golang.org/x/text v0.29.0
+	google.golang.org/protobuf v1.36.9
 	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
 	github.com/abema/go-mp4 v1.3.0 // indirect
 	github.com/aler9/writerseeker v1.1.0 // indirect
-	github.com/bogem/id3v2/v2 v2.1.4 // indirect
 	github.com/bytedance/sonic v1.14.0 // indirect
 	github.com/bytedance/sonic/loader v0.3.0 // indirect
 	github.com/cloudwego/base64x v0.1.6 // indirect
@@ -56,5 +59,4 @@ require (
 	golang.org/x/sync v0.17.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/tools v0.36.0 // indirect
-	google.golang.org/protobuf v1.36.9 // indirect
 )
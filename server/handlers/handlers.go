@@ -1,18 +1,31 @@
 package handlers
 
 import (
+	"errors"
+	"io"
+	"time"
+
 	"github.com/gcottom/echodaemon/services/downloader"
+	"github.com/gcottom/echodaemon/services/events"
 	"github.com/gin-gonic/gin"
 )
 
 type Handlers struct {
 	Downloader *downloader.Service
+	Events     *events.Service
 }
 
-func SetupRoutes(router *gin.Engine, downloaderService *downloader.Service) {
-	handler := &Handlers{Downloader: downloaderService}
+func SetupRoutes(router *gin.Engine, downloaderService *downloader.Service, eventsService *events.Service) {
+	handler := &Handlers{Downloader: downloaderService, Events: eventsService}
 	router.POST("/capturestart", handler.CaptureStart)
 	router.POST("capture", handler.Capture)
+	router.GET("/jobs", handler.ListJobs)
+	router.GET("/jobs/:id", handler.GetJob)
+	router.DELETE("/jobs/:id", handler.DeleteJob)
+	router.GET("/events", handler.StreamEvents)
+	router.POST("/playlist/:id", handler.StartPlaylist)
+	router.GET("/playlist", handler.GetPlaylist)
+	router.DELETE("/playlist", handler.CancelPlaylist)
 }
 
 func (h *Handlers) CaptureStart(ctx *gin.Context) {
@@ -30,3 +43,119 @@ func (h *Handlers) Capture(ctx *gin.Context) {
 	ResponseSuccess(ctx, StartDownloadResponse{State: "ACK"})
 
 }
+
+func (h *Handlers) ListJobs(ctx *gin.Context) {
+	jobs, err := h.Downloader.Jobs.List()
+	if err != nil {
+		ResponseInternalError(ctx, err)
+		return
+	}
+	run, err := h.Downloader.Jobs.LoadPlaylistRun()
+	if err != nil {
+		ResponseInternalError(ctx, err)
+		return
+	}
+	updates := make([]StatusUpdate, 0, len(jobs))
+	for _, job := range jobs {
+		updates = append(updates, NewStatusUpdate(job, run))
+	}
+	ResponseSuccess(ctx, updates)
+}
+
+func (h *Handlers) GetJob(ctx *gin.Context) {
+	job, err := h.Downloader.Jobs.Get(ctx.Param("id"))
+	if errors.Is(err, downloader.ErrJobNotFound) {
+		ResponseNotFound(ctx, err)
+		return
+	}
+	if err != nil {
+		ResponseInternalError(ctx, err)
+		return
+	}
+	run, err := h.Downloader.Jobs.LoadPlaylistRun()
+	if err != nil {
+		ResponseInternalError(ctx, err)
+		return
+	}
+	ResponseSuccess(ctx, NewStatusUpdate(job, run))
+}
+
+func (h *Handlers) DeleteJob(ctx *gin.Context) {
+	id := ctx.Param("id")
+	err := h.Downloader.CancelJob(ctx, id)
+	if errors.Is(err, downloader.ErrJobNotFound) {
+		ResponseNotFound(ctx, err)
+		return
+	}
+	if err != nil {
+		ResponseInternalError(ctx, err)
+		return
+	}
+	ResponseSuccess(ctx, StatusUpdate{ID: id, Status: "deleted"})
+}
+
+func (h *Handlers) StartPlaylist(ctx *gin.Context) {
+	run, err := h.Downloader.StartPlaylist(ctx, ctx.Param("id"))
+	if errors.Is(err, downloader.ErrPlaylistRunning) {
+		ResponseConflict(ctx, err)
+		return
+	}
+	if err != nil {
+		ResponseFailure(ctx, err)
+		return
+	}
+	ResponseSuccess(ctx, NewPlaylistStatusUpdate(run))
+}
+
+// GetPlaylist reports the running playlist. The extension polls it and plays track_id whenever it changes.
+func (h *Handlers) GetPlaylist(ctx *gin.Context) {
+	run, err := h.Downloader.Jobs.LoadPlaylistRun()
+	if err != nil {
+		ResponseInternalError(ctx, err)
+		return
+	}
+	if run == nil {
+		ResponseNotFound(ctx, downloader.ErrNoPlaylist)
+		return
+	}
+	ResponseSuccess(ctx, NewPlaylistStatusUpdate(run))
+}
+
+func (h *Handlers) CancelPlaylist(ctx *gin.Context) {
+	run, err := h.Downloader.CancelPlaylist(ctx)
+	if errors.Is(err, downloader.ErrNoPlaylist) {
+		ResponseNotFound(ctx, err)
+		return
+	}
+	if err != nil {
+		ResponseInternalError(ctx, err)
+		return
+	}
+	ResponseSuccess(ctx, NewPlaylistStatusUpdate(run))
+}
+
+// StreamEvents pushes capture progress events to the client as Server-Sent Events until it disconnects.
+func (h *Handlers) StreamEvents(ctx *gin.Context) {
+	eventCh, unsubscribe := h.Events.Subscribe()
+	defer unsubscribe()
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Request.Context().Done():
+			return false
+		case event, ok := <-eventCh:
+			if !ok {
+				return false
+			}
+			ctx.SSEvent(string(event.Type), event)
+			return true
+		case <-keepAlive.C:
+			ctx.SSEvent("ping", gin.H{"time": time.Now()})
+			return true
+		}
+	})
+}
@@ -1,6 +1,10 @@
 package handlers
 
-import "github.com/gin-gonic/gin"
+import (
+	"github.com/gcottom/echodaemon/internal"
+	"github.com/gcottom/echodaemon/services/downloader"
+	"github.com/gin-gonic/gin"
+)
 
 type Failure struct {
 	Error string `json:"error"`
@@ -12,15 +16,67 @@ type StartDownloadResponse struct {
 
 type StatusUpdate struct {
 	ID                 string `json:"id"`
+	TrackID            string `json:"track_id,omitempty"`
 	Status             string `json:"status"`
+	BytesReceived      int64  `json:"bytes_received,omitempty"`
+	BytesTotal         int64  `json:"bytes_total,omitempty"`
+	ETASeconds         int    `json:"eta_seconds,omitempty"`
+	SavePath           string `json:"save_path,omitempty"`
+	Error              string `json:"error,omitempty"`
 	PlaylistTrackCount int    `json:"playlist_track_count,omitempty"`
 	PlaylistTrackDone  int    `json:"playlist_track_done,omitempty"`
+	// Trim is the span of the converted audio that was kept when silence was trimmed
+	Trim *internal.Trim `json:"trim,omitempty"`
+	// Loudness is the track's EBU R128 measurement, used for its gain tags or to normalize it
+	Loudness *internal.Loudness `json:"loudness,omitempty"`
+	// MetaSources is the metadata provider each tag of the saved track came from
+	MetaSources map[string]string `json:"meta_sources,omitempty"`
+}
+
+// NewStatusUpdate reports a job. Playlist progress is included when the job belongs to run.
+func NewStatusUpdate(job *downloader.Job, run *downloader.PlaylistRun) StatusUpdate {
+	update := StatusUpdate{
+		ID:            job.ID,
+		TrackID:       job.TrackID,
+		Status:        string(job.State),
+		BytesReceived: job.BytesReceived,
+		BytesTotal:    job.BytesTotal,
+		ETASeconds:    job.ETASeconds,
+		SavePath:      job.SavePath,
+		Error:         job.Error,
+		Trim:          job.Trim,
+		Loudness:      job.Loudness,
+		MetaSources:   job.MetaSources,
+	}
+	if run != nil && job.PlaylistID != "" && job.PlaylistID == run.ID {
+		update.PlaylistTrackCount = len(run.Tracks)
+		update.PlaylistTrackDone = run.Done
+	}
+	return update
+}
+
+func NewPlaylistStatusUpdate(run *downloader.PlaylistRun) StatusUpdate {
+	return StatusUpdate{
+		ID:                 run.ID,
+		TrackID:            run.CurrentTrack(),
+		Status:             string(run.State),
+		PlaylistTrackCount: len(run.Tracks),
+		PlaylistTrackDone:  run.Done,
+	}
 }
 
 func ResponseFailure(ctx *gin.Context, err error) {
 	ctx.AbortWithError(400, err)
 }
 
+func ResponseNotFound(ctx *gin.Context, err error) {
+	ctx.AbortWithError(404, err)
+}
+
+func ResponseConflict(ctx *gin.Context, err error) {
+	ctx.AbortWithError(409, err)
+}
+
 func ResponseInternalError(ctx *gin.Context, err error) {
 	ctx.AbortWithError(500, err)
 }
@@ -0,0 +1,80 @@
+// Package customtags writes tag fields that audiometa's common Tag interface can't express, such as ReplayGain
+// values, into audio files audiometa has already tagged.
+package customtags
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported file type for custom tags")
+
+// Tags are the extra fields to write. Field names follow Vorbis comment conventions (e.g. REPLAYGAIN_TRACK_GAIN);
+// they are written as TXXX frames in ID3 tags and as iTunes freeform atoms in MP4 files, except for fields those
+// formats have a standard place for: DATE and ISRC go to the TDRC (TYER in ID3v2.3) and TSRC frames, and DATE to
+// the ©day atom.
+type Tags struct {
+	Fields map[string]string
+	// Lyrics are the plain lyrics and SyncedLyrics the time-synced ones. ID3 tags get USLT and SYLT frames; other
+	// formats get a LYRICS field (the ©lyr atom in MP4) holding the synced lyrics as LRC text when there are any.
+	Lyrics       string
+	SyncedLyrics []SyncedLyric
+	// Cover replaces any embedded pictures: an APIC frame in ID3, a PICTURE block in FLAC, a
+	// METADATA_BLOCK_PICTURE comment in Ogg and the covr atom in MP4
+	Cover *Picture
+}
+
+func (t *Tags) empty() bool {
+	return t == nil || (len(t.Fields) == 0 && t.Lyrics == "" && len(t.SyncedLyrics) == 0 && t.Cover == nil)
+}
+
+// withField returns a copy of tags with the field set
+func (t *Tags) withField(name, value string) *Tags {
+	c := *t
+	c.Fields = make(map[string]string, len(t.Fields)+1)
+	maps.Copy(c.Fields, t.Fields)
+	c.Fields[name] = value
+	return &c
+}
+
+// fieldNames returns the field names in a stable order
+func (t *Tags) fieldNames() []string {
+	names := make([]string, 0, len(t.Fields))
+	for name := range t.Fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// has reports whether name is one of the fields being written, ignoring case
+func (t *Tags) has(name string) bool {
+	for field := range t.Fields {
+		if strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write returns data with tags added. Existing fields with the same names are replaced and everything else in the
+// file is kept as is.
+func Write(data []byte, tags *Tags) ([]byte, error) {
+	if tags.empty() {
+		return data, nil
+	}
+	switch {
+	case len(data) >= 3 && string(data[:3]) == "ID3",
+		len(data) >= 2 && data[0] == 0xFF && data[1]&0xE0 == 0xE0: // MPEG audio frame sync of an untagged mp3
+		return writeID3(data, tags)
+	case len(data) >= 8 && string(data[4:8]) == "ftyp":
+		return writeMP4(data, tags.withLyricsField())
+	case len(data) >= 4 && string(data[:4]) == "fLaC":
+		return writeFLAC(data, tags.withLyricsField())
+	case len(data) >= 4 && string(data[:4]) == "OggS":
+		return writeOgg(data, tags.withLyricsField())
+	}
+	return nil, ErrUnsupportedFormat
+}
@@ -0,0 +1,50 @@
+package customtags
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testTags returns tags touching every kind of field: a plain field, the fields with a standard place in some
+// formats, synced lyrics and a cover
+func testTags() *Tags {
+	return &Tags{
+		Fields: map[string]string{
+			"REPLAYGAIN_TRACK_GAIN": "-6.50 dB",
+			"DATE":                  "2021-03-04",
+			"ISRC":                  "USRC17607839",
+		},
+		SyncedLyrics: []SyncedLyric{
+			{Time: 1500 * time.Millisecond, Text: "first line"},
+			{Time: 62*time.Second + 250*time.Millisecond, Text: "zweite Zeile ✓"},
+		},
+		Cover: &Picture{Data: bytes.Repeat([]byte{0xD8}, 300), MIME: "image/jpeg", Width: 600, Height: 600},
+	}
+}
+
+// testAudio returns n bytes standing in for encoded audio, varied so misplaced data shows up
+func testAudio(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + i>>8)
+	}
+	return b
+}
+
+func TestWriteEmpty(t *testing.T) {
+	data := []byte("not even audio")
+	for _, tags := range []*Tags{nil, {}} {
+		got, err := Write(data, tags)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Write(%v) = %q, %v; want the data unchanged", tags, got, err)
+		}
+	}
+}
+
+func TestWriteUnsupported(t *testing.T) {
+	if _, err := Write([]byte("RIFF\x00\x00\x00\x00WAVE"), testTags()); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("err = %v, want ErrUnsupportedFormat", err)
+	}
+}
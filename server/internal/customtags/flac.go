@@ -0,0 +1,77 @@
+package customtags
+
+import (
+	"bytes"
+	"errors"
+)
+
+const (
+	flacStreamInfo    = 0
+	flacVorbisComment = 4
+)
+
+type flacBlock struct {
+	blockType byte
+	body      []byte
+}
+
+func writeFLAC(data []byte, tags *Tags) ([]byte, error) {
+	var blocks []flacBlock
+	pos := 4
+	for last := false; !last; {
+		if pos+4 > len(data) {
+			return nil, errors.New("truncated flac metadata")
+		}
+		header := data[pos]
+		size := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		pos += 4
+		if pos+size > len(data) {
+			return nil, errors.New("truncated flac metadata block")
+		}
+		last = header&0x80 != 0
+		blocks = append(blocks, flacBlock{blockType: header & 0x7F, body: data[pos : pos+size]})
+		pos += size
+	}
+	if len(blocks) == 0 || blocks[0].blockType != flacStreamInfo {
+		return nil, errors.New("flac stream info block missing")
+	}
+
+	found := false
+	for i, block := range blocks {
+		if block.blockType != flacVorbisComment {
+			continue
+		}
+		vc, _, err := parseVorbisComments(block.body)
+		if err != nil {
+			return nil, err
+		}
+		vc.set(tags)
+		blocks[i].body = vc.marshal()
+		found = true
+		break
+	}
+	if !found {
+		vc := &vorbisComments{vendor: "echodaemon"}
+		vc.set(tags)
+		// The comment block goes right after the stream info block, which must stay first
+		blocks = append(blocks[:1], append([]flacBlock{{blockType: flacVorbisComment, body: vc.marshal()}}, blocks[1:]...)...)
+	}
+
+	blocks = setFLACCover(blocks, tags.Cover)
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)+1024))
+	out.WriteString("fLaC")
+	for i, block := range blocks {
+		if len(block.body) >= 1<<24 {
+			return nil, errors.New("flac metadata block too large")
+		}
+		header := block.blockType
+		if i == len(blocks)-1 {
+			header |= 0x80
+		}
+		out.Write([]byte{header, byte(len(block.body) >> 16), byte(len(block.body) >> 8), byte(len(block.body))})
+		out.Write(block.body)
+	}
+	out.Write(data[pos:])
+	return out.Bytes(), nil
+}
@@ -0,0 +1,160 @@
+package customtags
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+const (
+	flacPadding   = 1
+	flacSeekTable = 3
+)
+
+var (
+	flacStreamInfoBody = testAudio(34)
+	// flacFrames stands in for the audio frames, starting with a frame sync code
+	flacFrames = append([]byte{0xFF, 0xF8, 0x69, 0x08}, testAudio(5000)...)
+)
+
+// buildFLAC returns a FLAC file with the given metadata blocks after STREAMINFO, followed by flacFrames
+func buildFLAC(blocks ...flacBlock) []byte {
+	blocks = append([]flacBlock{{blockType: flacStreamInfo, body: flacStreamInfoBody}}, blocks...)
+	out := []byte("fLaC")
+	for i, block := range blocks {
+		header := block.blockType
+		if i == len(blocks)-1 {
+			header |= 0x80
+		}
+		out = append(out, header, byte(len(block.body)>>16), byte(len(block.body)>>8), byte(len(block.body)))
+		out = append(out, block.body...)
+	}
+	return append(out, flacFrames...)
+}
+
+// readFLAC returns the metadata blocks of a FLAC file and the audio after them
+func readFLAC(t *testing.T, data []byte) ([]flacBlock, []byte) {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("fLaC")) {
+		t.Fatal("no fLaC marker")
+	}
+	var blocks []flacBlock
+	pos := 4
+	for last := false; !last; {
+		if pos+4 > len(data) {
+			t.Fatal("truncated flac metadata")
+		}
+		size := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		last = data[pos]&0x80 != 0
+		blocks = append(blocks, flacBlock{blockType: data[pos] & 0x7F, body: data[pos+4 : pos+4+size]})
+		pos += 4 + size
+	}
+	return blocks, data[pos:]
+}
+
+func TestWriteFLAC(t *testing.T) {
+	comments := (&vorbisComments{vendor: "reference libFLAC", comments: []string{
+		"TITLE=Kept Title",
+		"replaygain_track_gain=+1.00 dB",
+	}}).marshal()
+	oldPicture := (&Picture{Data: []byte("old"), MIME: "image/png"}).flacBlock()
+	seekTable := testAudio(36)
+	padding := make([]byte, 100)
+	tests := []struct {
+		name   string
+		data   []byte
+		vendor string
+		kept   []string
+		// types are the block types expected after STREAMINFO
+		types []byte
+	}{
+		{"stream info only", buildFLAC(), "echodaemon", nil, []byte{flacVorbisComment, flacPicture}},
+		{
+			"existing tags",
+			buildFLAC(
+				flacBlock{blockType: flacSeekTable, body: seekTable},
+				flacBlock{blockType: flacVorbisComment, body: comments},
+				flacBlock{blockType: flacPicture, body: oldPicture},
+				flacBlock{blockType: flacPadding, body: padding},
+			),
+			"reference libFLAC",
+			[]string{"TITLE=Kept Title"},
+			[]byte{flacSeekTable, flacVorbisComment, flacPicture, flacPadding},
+		},
+		{
+			"no comment block",
+			buildFLAC(flacBlock{blockType: flacSeekTable, body: seekTable}, flacBlock{blockType: flacPadding, body: padding}),
+			"echodaemon",
+			nil,
+			[]byte{flacVorbisComment, flacPicture, flacSeekTable, flacPadding},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags := testTags()
+			out, err := Write(tt.data, tags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks, audio := readFLAC(t, out)
+			if !bytes.Equal(audio, flacFrames) {
+				t.Fatal("audio frames changed")
+			}
+			if blocks[0].blockType != flacStreamInfo || !bytes.Equal(blocks[0].body, flacStreamInfoBody) {
+				t.Error("stream info block isn't first and unchanged")
+			}
+			var types []byte
+			for _, block := range blocks[1:] {
+				types = append(types, block.blockType)
+				switch block.blockType {
+				case flacSeekTable:
+					if !bytes.Equal(block.body, seekTable) {
+						t.Error("seek table changed")
+					}
+				case flacPadding:
+					if !bytes.Equal(block.body, padding) {
+						t.Error("padding changed")
+					}
+				case flacPicture:
+					if !bytes.Equal(block.body, tags.Cover.flacBlock()) {
+						t.Error("picture isn't the cover")
+					}
+				case flacVorbisComment:
+					vc, rest, err := parseVorbisComments(block.body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					want := append(slices.Clone(tt.kept),
+						"DATE=2021-03-04",
+						"ISRC=USRC17607839",
+						"LYRICS="+FormatLRC(tags.SyncedLyrics),
+						"REPLAYGAIN_TRACK_GAIN=-6.50 dB",
+					)
+					if vc.vendor != tt.vendor || len(rest) != 0 || !slices.Equal(vc.comments, want) {
+						t.Errorf("vendor %q comments %q with %d bytes after, want %q and %q", vc.vendor, vc.comments, len(rest), tt.vendor, want)
+					}
+				}
+			}
+			if !bytes.Equal(types, tt.types) {
+				t.Errorf("block types %v, want %v", types, tt.types)
+			}
+		})
+	}
+}
+
+func TestWriteFLACErrors(t *testing.T) {
+	valid := buildFLAC()
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated header", []byte("fLaC\x00\x00")},
+		{"block past the end", valid[:20]},
+		{"stream info not first", append([]byte("fLaC\x84\x00\x00\x08"), make([]byte, 8)...)},
+	}
+	for _, tt := range tests {
+		if _, err := Write(tt.data, testTags()); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package customtags
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bogem/id3v2/v2"
+)
+
+// id3TextFrames are the standard text frames fields are written to instead of TXXX
+var id3TextFrames = map[string]string{
+	"DATE": "TDRC",
+	"ISRC": "TSRC",
+}
+
+func writeID3(data []byte, tags *Tags) ([]byte, error) {
+	size, err := id3Size(data)
+	if err != nil {
+		return nil, err
+	}
+	tag := id3v2.NewEmptyTag()
+	if size > 0 {
+		if tag, err = id3v2.ParseReader(bytes.NewReader(data[:size]), id3v2.Options{Parse: true}); err != nil {
+			return nil, fmt.Errorf("failed to parse id3 tag: %w", err)
+		}
+	}
+	// TXXX frames are keyed by description, so the ones being replaced are dropped before re-adding the rest
+	existing := tag.GetFrames("TXXX")
+	tag.DeleteFrames("TXXX")
+	for _, frame := range existing {
+		if udtf, ok := frame.(id3v2.UserDefinedTextFrame); ok && !tags.has(udtf.Description) {
+			tag.AddUserDefinedTextFrame(udtf)
+		}
+	}
+	for _, name := range tags.fieldNames() {
+		if id, ok := id3TextFrames[strings.ToUpper(name)]; ok {
+			value := tags.Fields[name]
+			// ID3v2.3 has no recording time frame, only the year
+			if id == "TDRC" && tag.Version() < 4 {
+				id, value = "TYER", value[:min(4, len(value))]
+			}
+			tag.AddTextFrame(id, textEncoding(tag), value)
+			continue
+		}
+		tag.AddUserDefinedTextFrame(id3v2.UserDefinedTextFrame{
+			Encoding:    textEncoding(tag),
+			Description: name,
+			Value:       tags.Fields[name],
+		})
+	}
+	setID3Lyrics(tag, tags)
+	setID3Cover(tag, tags.Cover)
+	out := new(bytes.Buffer)
+	if _, err = tag.WriteTo(out); err != nil {
+		return nil, fmt.Errorf("failed to write id3 tag: %w", err)
+	}
+	out.Write(data[size:])
+	return out.Bytes(), nil
+}
+
+// id3Size returns the length of the ID3v2 tag at the start of data, including its header and footer, or 0 when
+// data has no tag
+func id3Size(data []byte) (int, error) {
+	if !bytes.HasPrefix(data, []byte("ID3")) {
+		return 0, nil
+	}
+	if len(data) < 10 {
+		return 0, errors.New("truncated id3 header")
+	}
+	size := 0
+	for _, b := range data[6:10] {
+		size = size<<7 | int(b&0x7F)
+	}
+	size += 10
+	if data[5]&0x10 != 0 {
+		size += 10
+	}
+	if size > len(data) {
+		return 0, errors.New("id3 tag is larger than the file")
+	}
+	return size, nil
+}
+
+// textEncoding picks a Unicode encoding the tag's version supports
+func textEncoding(tag *id3v2.Tag) id3v2.Encoding {
+	if tag.Version() >= 4 {
+		return id3v2.EncodingUTF8
+	}
+	return id3v2.EncodingUTF16
+}
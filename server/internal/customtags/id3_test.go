@@ -0,0 +1,234 @@
+package customtags
+
+import (
+	"bytes"
+	"encoding/binary"
+	"maps"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/bogem/id3v2/v2"
+)
+
+// mpegAudio is an untagged mp3 stream: an MPEG-1 layer III frame header followed by the frame data
+func mpegAudio() []byte {
+	return append([]byte{0xFF, 0xFB, 0x90, 0x64}, testAudio(4000)...)
+}
+
+// decodeSYLT parses the body of a SYLT frame with millisecond timestamps
+func decodeSYLT(t *testing.T, body []byte) (id3v2.Encoding, []SyncedLyric) {
+	t.Helper()
+	if len(body) < 6 || string(body[1:4]) != lyricsLanguage || body[4] != 2 || body[5] != 1 {
+		t.Fatalf("SYLT header % x", body[:min(6, len(body))])
+	}
+	enc := id3v2.EncodingUTF8
+	if body[0] == id3v2.EncodingUTF16.Key {
+		enc = id3v2.EncodingUTF16
+	}
+	rest := body[6:]
+	readText := func() string {
+		if !enc.Equals(id3v2.EncodingUTF16) {
+			i := bytes.IndexByte(rest, 0)
+			if i < 0 {
+				t.Fatal("unterminated SYLT text")
+			}
+			s := string(rest[:i])
+			rest = rest[i+1:]
+			return s
+		}
+		if !bytes.HasPrefix(rest, []byte{0xFF, 0xFE}) {
+			t.Fatalf("SYLT text without a little endian BOM: % x", rest[:min(2, len(rest))])
+		}
+		var units []uint16
+		for i := 2; ; i += 2 {
+			if i+2 > len(rest) {
+				t.Fatal("unterminated SYLT text")
+			}
+			u := binary.LittleEndian.Uint16(rest[i:])
+			if u == 0 {
+				rest = rest[i+2:]
+				return string(utf16.Decode(units))
+			}
+			units = append(units, u)
+		}
+	}
+	if descriptor := readText(); descriptor != "" {
+		t.Errorf("SYLT descriptor %q", descriptor)
+	}
+	var lines []SyncedLyric
+	for len(rest) > 0 {
+		text := readText()
+		if len(rest) < 4 {
+			t.Fatal("SYLT line without a timestamp")
+		}
+		lines = append(lines, SyncedLyric{Time: time.Duration(binary.BigEndian.Uint32(rest)) * time.Millisecond, Text: text})
+		rest = rest[4:]
+	}
+	return enc, lines
+}
+
+// existingID3 returns an mp3 already tagged by an earlier save, with frames that should be replaced and frames
+// that should be kept
+func existingID3(t *testing.T, version byte) []byte {
+	t.Helper()
+	tag := id3v2.NewEmptyTag()
+	tag.SetVersion(version)
+	tag.SetTitle("Kept Title")
+	enc := textEncoding(tag)
+	tag.AddUserDefinedTextFrame(id3v2.UserDefinedTextFrame{Encoding: enc, Description: "replaygain_track_gain", Value: "+1.00 dB"})
+	tag.AddUserDefinedTextFrame(id3v2.UserDefinedTextFrame{Encoding: enc, Description: "MusicBrainz Album Id", Value: "kept"})
+	tag.AddUnsynchronisedLyricsFrame(id3v2.UnsynchronisedLyricsFrame{Encoding: enc, Language: "eng", Lyrics: "old lyrics"})
+	tag.AddAttachedPicture(id3v2.PictureFrame{Encoding: enc, MimeType: "image/png", PictureType: frontCover, Picture: []byte("old")})
+	var buf bytes.Buffer
+	if _, err := tag.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return append(buf.Bytes(), mpegAudio()...)
+}
+
+func TestWriteID3(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		dateID   string
+		date     string
+		encoding id3v2.Encoding
+		kept     bool
+	}{
+		{"untagged", mpegAudio(), "TDRC", "2021-03-04", id3v2.EncodingUTF8, false},
+		{"id3v2.4", existingID3(t, 4), "TDRC", "2021-03-04", id3v2.EncodingUTF8, true},
+		// ID3v2.3 only has a year frame and no UTF-8
+		{"id3v2.3", existingID3(t, 3), "TYER", "2021", id3v2.EncodingUTF16, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags := testTags()
+			out, err := Write(tt.data, tags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, err := id3Size(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out[size:], mpegAudio()) {
+				t.Fatal("audio after the tag changed")
+			}
+
+			tag, err := id3v2.ParseReader(bytes.NewReader(out), id3v2.Options{Parse: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tag.GetTextFrame(tt.dateID).Text; got != tt.date {
+				t.Errorf("%s = %q, want %q", tt.dateID, got, tt.date)
+			}
+			if got := tag.GetTextFrame("TSRC").Text; got != tags.Fields["ISRC"] {
+				t.Errorf("TSRC = %q", got)
+			}
+			txxx := make(map[string]string)
+			for _, frame := range tag.GetFrames("TXXX") {
+				udtf := frame.(id3v2.UserDefinedTextFrame)
+				if _, dup := txxx[udtf.Description]; dup {
+					t.Errorf("TXXX %q written twice", udtf.Description)
+				}
+				txxx[udtf.Description] = udtf.Value
+			}
+			want := map[string]string{"REPLAYGAIN_TRACK_GAIN": "-6.50 dB"}
+			if tt.kept {
+				want["MusicBrainz Album Id"] = "kept"
+				if got := tag.Title(); got != "Kept Title" {
+					t.Errorf("title = %q", got)
+				}
+			}
+			if len(txxx) != len(want) {
+				t.Errorf("TXXX frames %v, want %v", txxx, want)
+			}
+			for desc, value := range want {
+				if txxx[desc] != value {
+					t.Errorf("TXXX %q = %q, want %q", desc, txxx[desc], value)
+				}
+			}
+
+			uslt := tag.GetFrames("USLT")
+			if len(uslt) != 1 || uslt[0].(id3v2.UnsynchronisedLyricsFrame).Lyrics != "first line\nzweite Zeile ✓" {
+				t.Errorf("USLT frames %v", uslt)
+			}
+			sylt := tag.GetFrames("SYLT")
+			if len(sylt) != 1 {
+				t.Fatalf("%d SYLT frames", len(sylt))
+			}
+			enc, lines := decodeSYLT(t, sylt[0].(id3v2.UnknownFrame).Body)
+			if !enc.Equals(tt.encoding) {
+				t.Errorf("SYLT encoding %v, want %v", enc, tt.encoding)
+			}
+			if len(lines) != len(tags.SyncedLyrics) {
+				t.Fatalf("SYLT lines %v", lines)
+			}
+			for i, line := range lines {
+				if line != tags.SyncedLyrics[i] {
+					t.Errorf("SYLT line %d = %v, want %v", i, line, tags.SyncedLyrics[i])
+				}
+			}
+
+			apic := tag.GetFrames("APIC")
+			if len(apic) != 1 {
+				t.Fatalf("%d APIC frames", len(apic))
+			}
+			if pic := apic[0].(id3v2.PictureFrame); pic.MimeType != "image/jpeg" || pic.PictureType != frontCover || !bytes.Equal(pic.Picture, tags.Cover.Data) {
+				t.Errorf("APIC %s type %d with %d bytes", pic.MimeType, pic.PictureType, len(pic.Picture))
+			}
+		})
+	}
+}
+
+func TestWriteID3Twice(t *testing.T) {
+	// Saving again replaces the fields instead of piling up frames
+	once, err := Write(mpegAudio(), testTags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice, err := Write(once, testTags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// id3v2 writes frames in map order, so the tags are compared frame by frame rather than byte for byte
+	frames := func(data []byte) map[string]int {
+		tag, err := id3v2.ParseReader(bytes.NewReader(data), id3v2.Options{Parse: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[string]int)
+		for id, frames := range tag.AllFrames() {
+			counts[id] = len(frames)
+		}
+		return counts
+	}
+	if got, want := frames(twice), frames(once); !maps.Equal(got, want) {
+		t.Errorf("frames after writing twice %v, want %v", got, want)
+	}
+	if size, _ := id3Size(twice); !bytes.Equal(twice[size:], mpegAudio()) {
+		t.Error("audio after the tag changed")
+	}
+}
+
+func TestID3Size(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    int
+		wantErr bool
+	}{
+		{"no tag", mpegAudio(), 0, false},
+		{"tag", append([]byte("ID3\x04\x00\x00\x00\x00\x01\x00"), make([]byte, 200)...), 138, false},
+		{"footer", append([]byte("ID3\x04\x00\x10\x00\x00\x00\x05"), make([]byte, 20)...), 25, false},
+		{"truncated header", []byte("ID3\x04"), 0, true},
+		{"larger than file", []byte("ID3\x04\x00\x00\x00\x00\x01\x00"), 0, true},
+	}
+	for _, tt := range tests {
+		got, err := id3Size(tt.data)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: id3Size = %d, %v; want %d", tt.name, got, err, tt.want)
+		}
+	}
+}
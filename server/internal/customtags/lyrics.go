@@ -0,0 +1,114 @@
+package customtags
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/bogem/id3v2/v2"
+)
+
+// lyricsLanguage is the ID3 language code for lyrics in an unknown language
+const lyricsLanguage = "XXX"
+
+// SyncedLyric is one line of time-synced lyrics
+type SyncedLyric struct {
+	Time time.Duration `json:"time"`
+	Text string        `json:"text"`
+}
+
+// FormatLRC renders synced lyrics as LRC text, one [mm:ss.xx] timestamped line each.
+func FormatLRC(lines []SyncedLyric) string {
+	var b strings.Builder
+	for _, line := range lines {
+		cs := line.Time.Milliseconds() / 10
+		fmt.Fprintf(&b, "[%02d:%02d.%02d]%s\n", cs/6000, cs/100%60, cs%100, line.Text)
+	}
+	return b.String()
+}
+
+// plainLyrics returns the plain lyrics, or the synced lines without their timestamps when there are none
+func (t *Tags) plainLyrics() string {
+	if t.Lyrics != "" || len(t.SyncedLyrics) == 0 {
+		return t.Lyrics
+	}
+	lines := make([]string, 0, len(t.SyncedLyrics))
+	for _, line := range t.SyncedLyrics {
+		lines = append(lines, line.Text)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// withLyricsField returns tags with the lyrics moved into a LYRICS field, for formats with a single lyrics field.
+// Synced lyrics are stored as LRC text, which players that read the field generally understand.
+func (t *Tags) withLyricsField() *Tags {
+	text := t.Lyrics
+	if len(t.SyncedLyrics) > 0 {
+		text = FormatLRC(t.SyncedLyrics)
+	}
+	if text == "" {
+		return t
+	}
+	return t.withField("LYRICS", text)
+}
+
+// setID3Lyrics replaces the tag's lyrics frames with USLT and SYLT frames for tags' lyrics
+func setID3Lyrics(tag *id3v2.Tag, tags *Tags) {
+	plain := tags.plainLyrics()
+	if plain == "" {
+		return
+	}
+	tag.DeleteFrames("USLT")
+	tag.DeleteFrames("SYLT")
+	tag.AddUnsynchronisedLyricsFrame(id3v2.UnsynchronisedLyricsFrame{
+		Encoding: textEncoding(tag),
+		Language: lyricsLanguage,
+		Lyrics:   plain,
+	})
+	if len(tags.SyncedLyrics) > 0 {
+		tag.AddFrame("SYLT", syltFrame{encoding: textEncoding(tag), lines: tags.SyncedLyrics})
+	}
+}
+
+// syltFrame is an ID3 synchronised lyrics frame with millisecond timestamps, which id3v2 can't write itself
+type syltFrame struct {
+	encoding id3v2.Encoding
+	lines    []SyncedLyric
+}
+
+func (f syltFrame) body() []byte {
+	// Encoding, language, timestamp format 2 (milliseconds), content type 1 (lyrics) and an empty descriptor
+	b := []byte{f.encoding.Key}
+	b = append(b, lyricsLanguage...)
+	b = append(b, 2, 1)
+	b = append(b, encodeText("", f.encoding)...)
+	for _, line := range f.lines {
+		b = append(b, encodeText(line.Text, f.encoding)...)
+		b = binary.BigEndian.AppendUint32(b, uint32(max(0, line.Time.Milliseconds())))
+	}
+	return b
+}
+
+func (f syltFrame) Size() int { return len(f.body()) }
+
+func (f syltFrame) UniqueIdentifier() string { return "" }
+
+func (f syltFrame) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(f.body())
+	return int64(n), err
+}
+
+// encodeText encodes s followed by its terminator in one of the encodings textEncoding picks
+func encodeText(s string, enc id3v2.Encoding) []byte {
+	if !enc.Equals(id3v2.EncodingUTF16) {
+		return append([]byte(s), enc.TerminationBytes...)
+	}
+	b := []byte{0xFF, 0xFE}
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return append(b, enc.TerminationBytes...)
+}
@@ -0,0 +1,279 @@
+package customtags
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const itunesMean = "com.apple.iTunes"
+
+type mp4Box struct {
+	typ       string
+	offset    int
+	headerLen int
+	raw       []byte
+}
+
+func (b mp4Box) body() []byte {
+	return b.raw[b.headerLen:]
+}
+
+// parseMP4Boxes splits data into its sibling boxes; base is the offset of data within the file
+func parseMP4Boxes(data []byte, base int) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 8 {
+			return nil, errors.New("truncated mp4 box header")
+		}
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		headerLen := 8
+		switch size {
+		case 0:
+			size = len(data) - pos
+		case 1:
+			if len(data)-pos < 16 {
+				return nil, errors.New("truncated mp4 box header")
+			}
+			size = int(binary.BigEndian.Uint64(data[pos+8:]))
+			headerLen = 16
+		}
+		if size < headerLen || pos+size > len(data) {
+			return nil, fmt.Errorf("invalid mp4 box size %d", size)
+		}
+		boxes = append(boxes, mp4Box{typ: string(data[pos+4 : pos+8]), offset: base + pos, headerLen: headerLen, raw: data[pos : pos+size]})
+		pos += size
+	}
+	return boxes, nil
+}
+
+func makeMP4Box(typ string, body ...[]byte) []byte {
+	size := 8
+	for _, b := range body {
+		size += len(b)
+	}
+	out := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(out, uint32(size))
+	copy(out[4:], typ)
+	for _, b := range body {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func joinMP4Boxes(boxes []mp4Box) []byte {
+	var out []byte
+	for _, b := range boxes {
+		out = append(out, b.raw...)
+	}
+	return out
+}
+
+// writeMP4 stores the fields as iTunes freeform (----) atoms, or their standard atoms, in moov/udta/meta/ilst. When moov comes before the
+// media data the chunk offsets are shifted by however much moov grew.
+func writeMP4(data []byte, tags *Tags) ([]byte, error) {
+	top, err := parseMP4Boxes(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	moovIndex := -1
+	for i, b := range top {
+		if b.typ == "moov" {
+			moovIndex = i
+		}
+	}
+	if moovIndex < 0 {
+		return nil, errors.New("mp4 moov box missing")
+	}
+	moov := top[moovIndex]
+	children, err := parseMP4Boxes(moov.body(), 0)
+	if err != nil {
+		return nil, err
+	}
+	children, err = editChild(children, "udta", nil, func(body []byte) ([]byte, error) {
+		udtaChildren, err := parseMP4Boxes(body, 0)
+		if err != nil {
+			return nil, err
+		}
+		udtaChildren, err = editChild(udtaChildren, "meta", newMetaBody(), func(body []byte) ([]byte, error) {
+			// meta is a full box: version and flags precede its children
+			if len(body) < 4 {
+				return nil, errors.New("truncated mp4 meta box")
+			}
+			metaChildren, err := parseMP4Boxes(body[4:], 0)
+			if err != nil {
+				return nil, err
+			}
+			metaChildren, err = editChild(metaChildren, "ilst", nil, func(body []byte) ([]byte, error) {
+				return setFreeformAtoms(body, tags)
+			})
+			if err != nil {
+				return nil, err
+			}
+			return append(bytes.Clone(body[:4]), joinMP4Boxes(metaChildren)...), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return joinMP4Boxes(udtaChildren), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	newMoovBody := joinMP4Boxes(children)
+	delta := len(newMoovBody) + moov.headerLen - len(moov.raw)
+
+	mediaAfterMoov := false
+	for _, b := range top[moovIndex+1:] {
+		if b.typ == "mdat" {
+			mediaAfterMoov = true
+		}
+	}
+	if mediaAfterMoov && delta != 0 {
+		if err = shiftChunkOffsets(newMoovBody, int64(delta)); err != nil {
+			return nil, err
+		}
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)+delta))
+	out.Write(data[:moov.offset])
+	out.Write(makeMP4Box("moov", newMoovBody))
+	out.Write(data[moov.offset+len(moov.raw):])
+	return out.Bytes(), nil
+}
+
+// editChild replaces the body of the first child of the given type with fn's result, creating the child from
+// emptyBody when it doesn't exist.
+func editChild(children []mp4Box, typ string, emptyBody []byte, fn func([]byte) ([]byte, error)) ([]mp4Box, error) {
+	for i, child := range children {
+		if child.typ != typ {
+			continue
+		}
+		body, err := fn(child.body())
+		if err != nil {
+			return nil, err
+		}
+		children[i] = mp4Box{typ: typ, headerLen: 8, raw: makeMP4Box(typ, body)}
+		return children, nil
+	}
+	body, err := fn(emptyBody)
+	if err != nil {
+		return nil, err
+	}
+	return append(children, mp4Box{typ: typ, headerLen: 8, raw: makeMP4Box(typ, body)}), nil
+}
+
+// newMetaBody is an empty iTunes metadata box: version/flags and the mdir handler
+func newMetaBody() []byte {
+	hdlr := make([]byte, 25)
+	copy(hdlr[8:], "mdirappl")
+	return append(make([]byte, 4), makeMP4Box("hdlr", hdlr)...)
+}
+
+// mp4TextAtoms are the standard atoms fields are written to instead of freeform atoms
+var mp4TextAtoms = map[string]string{
+	"DATE":   "\xa9day",
+	"LYRICS": "\xa9lyr",
+}
+
+func setFreeformAtoms(ilst []byte, tags *Tags) ([]byte, error) {
+	items, err := parseMP4Boxes(ilst, 0)
+	if err != nil {
+		return nil, err
+	}
+	replaced := make(map[string]bool)
+	for name := range tags.Fields {
+		if typ, ok := mp4TextAtoms[strings.ToUpper(name)]; ok {
+			replaced[typ] = true
+		}
+	}
+	replaced["covr"] = tags.Cover != nil
+	var out []byte
+	for _, item := range items {
+		if item.typ == "----" {
+			if name, ok := freeformName(item.body()); ok && tags.has(name) {
+				continue
+			}
+		}
+		if replaced[item.typ] {
+			continue
+		}
+		out = append(out, item.raw...)
+	}
+	fullBox := make([]byte, 4)
+	for _, name := range tags.fieldNames() {
+		// Data type 1 is UTF-8 text, followed by a zero locale
+		data := []byte{0, 0, 0, 1, 0, 0, 0, 0}
+		if typ, ok := mp4TextAtoms[strings.ToUpper(name)]; ok {
+			out = append(out, makeMP4Box(typ, makeMP4Box("data", data, []byte(tags.Fields[name])))...)
+			continue
+		}
+		out = append(out, makeMP4Box("----",
+			makeMP4Box("mean", fullBox, []byte(itunesMean)),
+			makeMP4Box("name", fullBox, []byte(name)),
+			makeMP4Box("data", data, []byte(tags.Fields[name])),
+		)...)
+	}
+	if tags.Cover != nil {
+		covr, err := mp4CoverAtom(tags.Cover)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, covr...)
+	}
+	return out, nil
+}
+
+// freeformName returns the name of an iTunes freeform atom
+func freeformName(body []byte) (string, bool) {
+	children, err := parseMP4Boxes(body, 0)
+	if err != nil {
+		return "", false
+	}
+	for _, child := range children {
+		if child.typ == "name" && len(child.body()) >= 4 {
+			return strings.TrimSpace(string(child.body()[4:])), true
+		}
+	}
+	return "", false
+}
+
+// shiftChunkOffsets adds delta to every stco/co64 entry inside the moov body, in place
+func shiftChunkOffsets(moovBody []byte, delta int64) error {
+	boxes, err := parseMP4Boxes(moovBody, 0)
+	if err != nil {
+		return err
+	}
+	for _, b := range boxes {
+		body := b.body()
+		switch b.typ {
+		case "trak", "mdia", "minf", "stbl":
+			if err = shiftChunkOffsets(body, delta); err != nil {
+				return err
+			}
+		case "stco", "co64":
+			if len(body) < 8 {
+				return errors.New("truncated mp4 chunk offset box")
+			}
+			count := int(binary.BigEndian.Uint32(body[4:]))
+			width := 4
+			if b.typ == "co64" {
+				width = 8
+			}
+			if len(body)-8 < count*width {
+				return errors.New("truncated mp4 chunk offset table")
+			}
+			for i := range count {
+				entry := body[8+i*width:]
+				if width == 4 {
+					binary.BigEndian.PutUint32(entry, uint32(int64(binary.BigEndian.Uint32(entry))+delta))
+				} else {
+					binary.BigEndian.PutUint64(entry, uint64(int64(binary.BigEndian.Uint64(entry))+delta))
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package customtags
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// mp4Chunks are the audio chunks every test file carries in its mdat box
+var mp4Chunks = [][]byte{testAudio(1000), testAudio(3000)[1000:], testAudio(700)}
+
+// mp4Item returns an ilst item holding a single data atom
+func mp4Item(typ string, value []byte) []byte {
+	return makeMP4Box(typ, makeMP4Box("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, value))
+}
+
+func mp4Freeform(name, value string) []byte {
+	return makeMP4Box("----",
+		makeMP4Box("mean", make([]byte, 4), []byte(itunesMean)),
+		makeMP4Box("name", make([]byte, 4), []byte(name)),
+		makeMP4Box("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte(value)),
+	)
+}
+
+// buildMP4 returns an m4a file whose chunk offset table (stco, or co64 when wide is set) points at mp4Chunks. ilst
+// is the body of an existing ilst box; nil leaves the file without udta.
+func buildMP4(wide, moovFirst bool, ilst []byte) []byte {
+	ftyp := makeMP4Box("ftyp", []byte("M4A \x00\x00\x02\x00M4A isom"))
+	mdat := makeMP4Box("mdat", mp4Chunks...)
+	moov := func(offsets []int) []byte {
+		typ := "stco"
+		table := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(len(offsets)))
+		for _, off := range offsets {
+			if wide {
+				typ = "co64"
+				table = binary.BigEndian.AppendUint64(table, uint64(off))
+			} else {
+				table = binary.BigEndian.AppendUint32(table, uint32(off))
+			}
+		}
+		stbl := makeMP4Box("stbl", makeMP4Box("stsd", make([]byte, 8)), makeMP4Box(typ, table))
+		trak := makeMP4Box("trak",
+			makeMP4Box("tkhd", make([]byte, 84)),
+			makeMP4Box("mdia", makeMP4Box("mdhd", make([]byte, 24)), makeMP4Box("minf", stbl)),
+		)
+		children := [][]byte{makeMP4Box("mvhd", make([]byte, 100)), trak}
+		if ilst != nil {
+			meta := append(newMetaBody(), makeMP4Box("ilst", ilst)...)
+			children = append(children, makeMP4Box("udta", makeMP4Box("meta", meta)))
+		}
+		return makeMP4Box("moov", children...)
+	}
+	// The offset table's size doesn't depend on its values, so a placeholder moov gives the layout
+	offsets := make([]int, len(mp4Chunks))
+	pos := len(ftyp) + 8
+	if moovFirst {
+		pos += len(moov(offsets))
+	}
+	for i, chunk := range mp4Chunks {
+		offsets[i] = pos
+		pos += len(chunk)
+	}
+	if moovFirst {
+		return bytes.Join([][]byte{ftyp, moov(offsets), mdat}, nil)
+	}
+	return bytes.Join([][]byte{ftyp, mdat, moov(offsets)}, nil)
+}
+
+// mp4Child returns the first box of the given type in data, failing the test when there is none
+func mp4Child(t *testing.T, data []byte, base int, typ string) mp4Box {
+	t.Helper()
+	boxes, err := parseMP4Boxes(data, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b
+		}
+	}
+	t.Fatalf("no %s box", typ)
+	return mp4Box{}
+}
+
+// mp4Path walks down the box tree from the top level of the file
+func mp4Path(t *testing.T, file []byte, path ...string) mp4Box {
+	t.Helper()
+	box := mp4Box{raw: file}
+	for _, typ := range path {
+		body, base := box.body(), box.offset+box.headerLen
+		if box.typ == "meta" {
+			body, base = body[4:], base+4
+		}
+		box = mp4Child(t, body, base, typ)
+	}
+	return box
+}
+
+// readChunkOffsets returns the entries of the file's stco or co64 table
+func readChunkOffsets(t *testing.T, file []byte, wide bool) []int {
+	t.Helper()
+	typ, width := "stco", 4
+	if wide {
+		typ, width = "co64", 8
+	}
+	body := mp4Path(t, file, "moov", "trak", "mdia", "minf", "stbl", typ).body()
+	offsets := make([]int, binary.BigEndian.Uint32(body[4:]))
+	for i := range offsets {
+		entry := body[8+i*width:]
+		if wide {
+			offsets[i] = int(binary.BigEndian.Uint64(entry))
+		} else {
+			offsets[i] = int(binary.BigEndian.Uint32(entry))
+		}
+	}
+	return offsets
+}
+
+// readILST returns the values of the file's ilst items, keyed by atom type or "----:" and the freeform name
+func readILST(t *testing.T, file []byte) map[string][]string {
+	t.Helper()
+	ilst := mp4Path(t, file, "moov", "udta", "meta", "ilst")
+	items, err := parseMP4Boxes(ilst.body(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string][]string)
+	for _, item := range items {
+		key := item.typ
+		if key == "----" {
+			name, ok := freeformName(item.body())
+			if !ok {
+				t.Fatal("freeform atom without a name")
+			}
+			key += ":" + name
+		}
+		data := mp4Child(t, item.body(), 0, "data").body()
+		values[key] = append(values[key], string(data[8:]))
+	}
+	return values
+}
+
+func TestWriteMP4(t *testing.T) {
+	existing := bytes.Join([][]byte{
+		mp4Item("\xa9nam", []byte("Kept Title")),
+		mp4Freeform("replaygain_track_gain", "+1.00 dB"),
+		mp4Freeform("MusicBrainz Album Id", "kept"),
+		mp4Item("covr", []byte("old cover")),
+	}, nil)
+	tests := []struct {
+		name      string
+		wide      bool
+		moovFirst bool
+		ilst      []byte
+	}{
+		{"stco after moov", false, true, existing},
+		{"co64 after moov", true, true, existing},
+		{"no udta", false, true, nil},
+		// Chunks before moov don't move however much moov grows
+		{"moov at end", false, false, existing},
+		{"co64 moov at end", true, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := buildMP4(tt.wide, tt.moovFirst, tt.ilst)
+			tags := testTags()
+			out, err := Write(data, tags)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := mp4Path(t, out, "mdat").body(), mp4Path(t, data, "mdat").body(); !bytes.Equal(got, want) {
+				t.Fatal("mdat payload changed")
+			}
+			offsets := readChunkOffsets(t, out, tt.wide)
+			if len(offsets) != len(mp4Chunks) {
+				t.Fatalf("%d chunk offsets", len(offsets))
+			}
+			for i, off := range offsets {
+				if chunk := mp4Chunks[i]; off+len(chunk) > len(out) || !bytes.Equal(out[off:off+len(chunk)], chunk) {
+					t.Errorf("chunk %d offset %d doesn't point at its data", i, off)
+				}
+			}
+			if !tt.moovFirst {
+				if got, want := offsets, readChunkOffsets(t, data, tt.wide); !slices.Equal(got, want) {
+					t.Errorf("offsets %v changed from %v", got, want)
+				}
+			}
+
+			want := map[string]string{
+				"----:REPLAYGAIN_TRACK_GAIN": "-6.50 dB",
+				"----:ISRC":                  "USRC17607839",
+				"\xa9day":                    "2021-03-04",
+				"\xa9lyr":                    FormatLRC(tags.SyncedLyrics),
+				"covr":                       string(tags.Cover.Data),
+			}
+			if tt.ilst != nil {
+				want["\xa9nam"] = "Kept Title"
+				want["----:MusicBrainz Album Id"] = "kept"
+			}
+			items := readILST(t, out)
+			if len(items) != len(want) {
+				t.Errorf("ilst items %q", items)
+			}
+			for key, value := range want {
+				if got := items[key]; len(got) != 1 || got[0] != value {
+					t.Errorf("%q = %q, want %q", key, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteMP4Twice(t *testing.T) {
+	once, err := Write(buildMP4(false, true, nil), testTags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice, err := Write(once, testTags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(once, twice) {
+		t.Error("writing the same tags again changed the file")
+	}
+}
+
+func TestWriteMP4Errors(t *testing.T) {
+	ftyp := makeMP4Box("ftyp", []byte("M4A \x00\x00\x02\x00"))
+	webp := testTags()
+	webp.Cover.MIME = "image/webp"
+	tests := []struct {
+		name string
+		data []byte
+		tags *Tags
+	}{
+		{"no moov", append(ftyp, makeMP4Box("mdat", testAudio(10))...), testTags()},
+		{"box past the end", append(ftyp, 0, 0, 1, 0, 'm', 'o', 'o', 'v'), testTags()},
+		{"truncated box header", append(ftyp, 0, 0, 0), testTags()},
+		{"webp cover", buildMP4(false, true, nil), webp},
+	}
+	for _, tt := range tests {
+		if _, err := Write(tt.data, tt.tags); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package customtags
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gcottom/echodaemon/internal/ogg"
+)
+
+var (
+	opusTagsPrefix   = []byte("OpusTags")
+	vorbisTagsPrefix = []byte("\x03vorbis")
+)
+
+// writeOgg rewrites the comment header of an Ogg Opus or Vorbis stream. The header pages are repaginated and
+// the audio pages after them are copied with renumbered sequence numbers.
+func writeOgg(data []byte, tags *Tags) ([]byte, error) {
+	pr := ogg.NewPageReader(bytes.NewReader(data))
+	first, err := pr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ogg identification page: %w", err)
+	}
+	// Opus has an identification and a comment header; Vorbis adds a setup header after the comment header
+	var headers int
+	var prefix []byte
+	switch payload := first.Payload(); {
+	case bytes.HasPrefix(payload, []byte("OpusHead")):
+		headers, prefix = 2, opusTagsPrefix
+	case bytes.HasPrefix(payload, []byte("\x01vorbis")):
+		headers, prefix = 3, vorbisTagsPrefix
+	default:
+		return nil, fmt.Errorf("%w: unknown ogg codec", ErrUnsupportedFormat)
+	}
+
+	// Collect the packets after the identification header until the last header packet ends a page
+	var packets [][]byte
+	var packet []byte
+	for len(packets) < headers-1 {
+		page, err := pr.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ogg header pages: %w", err)
+		}
+		payload := page.Payload()
+		for _, l := range page.Lacing() {
+			packet = append(packet, payload[:l]...)
+			payload = payload[l:]
+			if l < 255 {
+				if len(packets) == headers-1 {
+					return nil, errors.New("ogg audio data shares a page with the headers")
+				}
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+	}
+	if len(packet) > 0 {
+		return nil, errors.New("ogg audio data shares a page with the headers")
+	}
+
+	comment := packets[0]
+	if !bytes.HasPrefix(comment, prefix) {
+		return nil, errors.New("ogg comment header missing")
+	}
+	vc, rest, err := parseVorbisComments(comment[len(prefix):])
+	if err != nil {
+		return nil, err
+	}
+	if tags.Cover != nil {
+		tags = tags.withField("METADATA_BLOCK_PICTURE", tags.Cover.vorbisField())
+	}
+	vc.set(tags)
+	comment = append(append(bytes.Clone(prefix), vc.marshal()...), rest...)
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)+1024))
+	out.Write(first.Raw)
+	w := &ogg.Writer{W: out, Serial: first.Serial(), Sequence: first.Sequence() + 1}
+	if err = w.AddPacket(comment, 0); err != nil {
+		return nil, err
+	}
+	for _, setup := range packets[1:] {
+		if err = w.AddPacket(setup, 0); err != nil {
+			return nil, err
+		}
+	}
+	if err = w.Flush(0, 0); err != nil {
+		return nil, err
+	}
+	for seq := w.Sequence; ; seq++ {
+		page, err := pr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ogg audio pages: %w", err)
+		}
+		page.SetSequence(seq)
+		out.Write(page.Raw)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,241 @@
+package customtags
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/gcottom/echodaemon/internal/ogg"
+)
+
+const oggSerial = 0x1234ABCD
+
+// oggCodec describes the header packets of a test stream
+type oggCodec struct {
+	id     []byte
+	prefix []byte
+	// rest follows the comment block in the comment header, the framing bit in Vorbis
+	rest  []byte
+	setup [][]byte
+}
+
+var (
+	opusCodec = oggCodec{
+		id:     append([]byte("OpusHead\x01\x02"), make([]byte, 9)...),
+		prefix: opusTagsPrefix,
+	}
+	vorbisCodec = oggCodec{
+		id:     append([]byte("\x01vorbis"), make([]byte, 23)...),
+		prefix: vorbisTagsPrefix,
+		rest:   []byte{1},
+		setup:  [][]byte{append([]byte("\x05vorbis"), testAudio(600)...)},
+	}
+)
+
+// oggAudio are the audio packets of every test stream, the middle one long enough to continue over a page
+var oggAudio = [][]byte{testAudio(500), testAudio(70000), testAudio(300)}
+
+// buildOgg returns a stream with the codec's headers, a comment header holding comments and oggAudio on pages of
+// their own, and how many pages the headers take. With shared set the first audio packet goes on the last header
+// page.
+func buildOgg(t *testing.T, codec oggCodec, comments []string, shared bool) ([]byte, int) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := &ogg.Writer{W: &buf, Serial: oggSerial}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(w.AddPacket(codec.id, 0))
+	must(w.Flush(0, ogg.BOS))
+	vc := &vorbisComments{vendor: "test encoder", comments: comments}
+	must(w.AddPacket(slices.Concat(codec.prefix, vc.marshal(), codec.rest), 0))
+	for _, setup := range codec.setup {
+		must(w.AddPacket(setup, 0))
+	}
+	if !shared {
+		must(w.Flush(0, 0))
+	}
+	headerPages := int(w.Sequence)
+	for i, packet := range oggAudio {
+		must(w.AddPacket(packet, int64(i)*960))
+		headerType := byte(0)
+		if i == len(oggAudio)-1 {
+			headerType = ogg.EOS
+		}
+		must(w.Flush(int64(i+1)*960, headerType))
+	}
+	return buf.Bytes(), headerPages
+}
+
+// readOggPages reads every page, checking each belongs to the stream, is numbered in order and has a valid checksum
+func readOggPages(t *testing.T, data []byte) []*ogg.Page {
+	t.Helper()
+	pr := ogg.NewPageReader(bytes.NewReader(data))
+	var pages []*ogg.Page
+	for {
+		page, err := pr.Next()
+		if errors.Is(err, io.EOF) {
+			return pages
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Serial() != oggSerial || page.Sequence() != uint32(len(pages)) {
+			t.Errorf("page %d: serial %x sequence %d", len(pages), page.Serial(), page.Sequence())
+		}
+		check := bytes.Clone(page.Raw)
+		ogg.SetChecksum(check)
+		if !bytes.Equal(check[22:26], page.Raw[22:26]) {
+			t.Errorf("page %d: checksum % x, want % x", len(pages), page.Raw[22:26], check[22:26])
+		}
+		pages = append(pages, page)
+	}
+}
+
+// oggPackets reassembles the packets carried by pages, failing the test when the last one is unfinished
+func oggPackets(t *testing.T, pages []*ogg.Page) [][]byte {
+	t.Helper()
+	var packets [][]byte
+	var packet []byte
+	for _, page := range pages {
+		payload := page.Payload()
+		for _, l := range page.Lacing() {
+			packet = append(packet, payload[:l]...)
+			payload = payload[l:]
+			if l < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+	}
+	if packet != nil {
+		t.Fatal("pages end in the middle of a packet")
+	}
+	return packets
+}
+
+func TestWriteOgg(t *testing.T) {
+	existing := []string{"TITLE=Kept Title", "replaygain_track_gain=+1.00 dB", "METADATA_BLOCK_PICTURE=old"}
+	bigCover := testTags()
+	// A cover this size spreads the comment header over several pages, pushing the audio pages back
+	bigCover.Cover.Data = testAudio(200000)
+	tests := []struct {
+		name     string
+		codec    oggCodec
+		comments []string
+		tags     *Tags
+	}{
+		{"opus", opusCodec, existing, testTags()},
+		{"opus large cover", opusCodec, nil, bigCover},
+		{"vorbis", vorbisCodec, existing, testTags()},
+		{"vorbis large cover", vorbisCodec, existing, bigCover},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, headerPages := buildOgg(t, tt.codec, tt.comments, false)
+			in := readOggPages(t, data)
+			out, err := Write(data, tt.tags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages := readOggPages(t, out)
+
+			if !bytes.Equal(pages[0].Raw, in[0].Raw) {
+				t.Error("identification page changed")
+			}
+			audio := in[headerPages:]
+			if len(pages) < len(audio)+2 {
+				t.Fatalf("%d pages", len(pages))
+			}
+			outHeaders, outAudio := pages[:len(pages)-len(audio)], pages[len(pages)-len(audio):]
+			for i, page := range outAudio {
+				want := audio[i]
+				if page.HeaderType() != want.HeaderType() || page.Granule() != want.Granule() ||
+					!bytes.Equal(page.Lacing(), want.Lacing()) || !bytes.Equal(page.Payload(), want.Payload()) {
+					t.Errorf("audio page %d differs", i)
+				}
+			}
+			if got := oggPackets(t, outAudio); len(got) != len(oggAudio) || !bytes.Equal(got[1], oggAudio[1]) {
+				t.Error("audio packets changed")
+			}
+
+			headers := oggPackets(t, outHeaders)
+			if len(headers) != 2+len(tt.codec.setup) {
+				t.Fatalf("%d header packets", len(headers))
+			}
+			for i, setup := range tt.codec.setup {
+				if !bytes.Equal(headers[2+i], setup) {
+					t.Errorf("setup header %d changed", i)
+				}
+			}
+			comment := headers[1]
+			if !bytes.HasPrefix(comment, tt.codec.prefix) {
+				t.Fatalf("comment header starts % x", comment[:min(8, len(comment))])
+			}
+			vc, rest, err := parseVorbisComments(comment[len(tt.codec.prefix):])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vc.vendor != "test encoder" || !bytes.Equal(rest, tt.codec.rest) {
+				t.Errorf("vendor %q and % x after the comments", vc.vendor, rest)
+			}
+			want := []string{
+				"DATE=2021-03-04",
+				"ISRC=USRC17607839",
+				"LYRICS=" + FormatLRC(tt.tags.SyncedLyrics),
+				"METADATA_BLOCK_PICTURE=" + tt.tags.Cover.vorbisField(),
+				"REPLAYGAIN_TRACK_GAIN=-6.50 dB",
+			}
+			if tt.comments != nil {
+				want = append([]string{"TITLE=Kept Title"}, want...)
+			}
+			if !slices.Equal(vc.comments, want) {
+				t.Errorf("comments %q, want %q", truncateAll(vc.comments), truncateAll(want))
+			}
+		})
+	}
+}
+
+// truncateAll shortens long comments so a failure doesn't print whole pictures
+func truncateAll(comments []string) []string {
+	out := make([]string, len(comments))
+	for i, c := range comments {
+		if len(c) > 60 {
+			c = c[:60] + "..."
+		}
+		out[i] = c
+	}
+	return out
+}
+
+func TestWriteOggErrors(t *testing.T) {
+	unknown := opusCodec
+	unknown.id = []byte("Speex   ")
+	noComment := opusCodec
+	noComment.prefix = []byte("OpusJunk")
+	build := func(codec oggCodec, shared bool) []byte {
+		data, _ := buildOgg(t, codec, nil, shared)
+		return data
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"audio on a header page", build(opusCodec, true), nil},
+		{"unknown codec", build(unknown, false), ErrUnsupportedFormat},
+		{"no comment header", build(noComment, false), nil},
+		{"truncated header page", build(vorbisCodec, false)[:200], nil},
+	}
+	for _, tt := range tests {
+		_, err := Write(tt.data, testTags())
+		if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package customtags
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/bogem/id3v2/v2"
+)
+
+const (
+	flacPicture = 6
+	// frontCover is the picture type of a front cover in ID3 APIC frames and FLAC PICTURE blocks
+	frontCover = 3
+)
+
+// MP4 data types of covr atoms
+const (
+	mp4JPEG = 13
+	mp4PNG  = 14
+)
+
+// Picture is a cover image to embed, already encoded as MIME (image/jpeg or image/png)
+type Picture struct {
+	Data   []byte
+	MIME   string
+	Width  int
+	Height int
+}
+
+// flacBlock encodes the picture as the body of a FLAC PICTURE block, which Vorbis comments also carry base64
+// encoded
+func (p *Picture) flacBlock() []byte {
+	b := binary.BigEndian.AppendUint32(nil, frontCover)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(p.MIME)))
+	b = append(b, p.MIME...)
+	b = binary.BigEndian.AppendUint32(b, 0) // no description
+	b = binary.BigEndian.AppendUint32(b, uint32(p.Width))
+	b = binary.BigEndian.AppendUint32(b, uint32(p.Height))
+	b = binary.BigEndian.AppendUint32(b, 24) // color depth
+	b = binary.BigEndian.AppendUint32(b, 0)  // not indexed
+	b = binary.BigEndian.AppendUint32(b, uint32(len(p.Data)))
+	return append(b, p.Data...)
+}
+
+// vorbisField returns the value of the METADATA_BLOCK_PICTURE Vorbis comment holding the picture
+func (p *Picture) vorbisField() string {
+	return base64.StdEncoding.EncodeToString(p.flacBlock())
+}
+
+// setID3Cover replaces the tag's pictures with the cover
+func setID3Cover(tag *id3v2.Tag, cover *Picture) {
+	if cover == nil {
+		return
+	}
+	tag.DeleteFrames("APIC")
+	tag.AddAttachedPicture(id3v2.PictureFrame{
+		Encoding:    textEncoding(tag),
+		MimeType:    cover.MIME,
+		PictureType: frontCover,
+		Description: "Front cover",
+		Picture:     cover.Data,
+	})
+}
+
+// setFLACCover replaces the stream's PICTURE blocks with the cover, placed after the Vorbis comment block
+func setFLACCover(blocks []flacBlock, cover *Picture) []flacBlock {
+	if cover == nil {
+		return blocks
+	}
+	kept := blocks[:0]
+	at := 1
+	for _, block := range blocks {
+		if block.blockType == flacPicture {
+			continue
+		}
+		kept = append(kept, block)
+		if block.blockType == flacVorbisComment {
+			at = len(kept)
+		}
+	}
+	picture := flacBlock{blockType: flacPicture, body: cover.flacBlock()}
+	return append(kept[:at:at], append([]flacBlock{picture}, kept[at:]...)...)
+}
+
+// mp4CoverAtom returns the covr item for the cover
+func mp4CoverAtom(cover *Picture) ([]byte, error) {
+	dataType := uint32(mp4JPEG)
+	switch {
+	case strings.EqualFold(cover.MIME, "image/png"):
+		dataType = mp4PNG
+	case !strings.EqualFold(cover.MIME, "image/jpeg"):
+		return nil, errors.New("mp4 cover art must be jpeg or png")
+	}
+	header := binary.BigEndian.AppendUint32(nil, dataType)
+	header = append(header, 0, 0, 0, 0) // locale
+	return makeMP4Box("covr", makeMP4Box("data", header, cover.Data)), nil
+}
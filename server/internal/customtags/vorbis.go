@@ -0,0 +1,71 @@
+package customtags
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// vorbisComments is a Vorbis comment block as used by Ogg and FLAC, without any codec prefix or framing bit
+type vorbisComments struct {
+	vendor   string
+	comments []string
+}
+
+// parseVorbisComments decodes a comment block and returns the bytes that follow it
+func parseVorbisComments(b []byte) (*vorbisComments, []byte, error) {
+	errTruncated := errors.New("truncated vorbis comment block")
+	readString := func() (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(b)
+		if uint64(len(b)-4) < uint64(n) {
+			return "", false
+		}
+		s := string(b[4 : 4+n])
+		b = b[4+n:]
+		return s, true
+	}
+	vendor, ok := readString()
+	if !ok || len(b) < 4 {
+		return nil, nil, errTruncated
+	}
+	count := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	vc := &vorbisComments{vendor: vendor}
+	for range count {
+		comment, ok := readString()
+		if !ok {
+			return nil, nil, errTruncated
+		}
+		vc.comments = append(vc.comments, comment)
+	}
+	return vc, b, nil
+}
+
+// set replaces the comments named in tags with their new values
+func (vc *vorbisComments) set(tags *Tags) {
+	kept := vc.comments[:0]
+	for _, comment := range vc.comments {
+		name, _, _ := strings.Cut(comment, "=")
+		if !tags.has(name) {
+			kept = append(kept, comment)
+		}
+	}
+	vc.comments = kept
+	for _, name := range tags.fieldNames() {
+		vc.comments = append(vc.comments, strings.ToUpper(name)+"="+tags.Fields[name])
+	}
+}
+
+func (vc *vorbisComments) marshal() []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(vc.vendor)))
+	b = append(b, vc.vendor...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(vc.comments)))
+	for _, comment := range vc.comments {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(comment)))
+		b = append(b, comment...)
+	}
+	return b
+}
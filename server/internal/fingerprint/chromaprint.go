@@ -0,0 +1,220 @@
+package fingerprint
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// Audio parameters of Chromaprint's default algorithm (TEST2)
+const (
+	SampleRate   = 11025
+	frameSize    = 4096
+	frameStep    = frameSize / 3
+	minFreq      = 28
+	maxFreq      = 3520
+	numBands     = 12
+	filterLength = 5
+	// algorithmID is the identifier of TEST2 in compressed fingerprints
+	algorithmID = 1
+)
+
+var chromaFilterCoefficients = [filterLength]float64{0.25, 0.75, 1.0, 0.75, 0.25}
+
+// classifier turns a Haar-like filter response over the chroma image into a 2-bit gray code
+type classifier struct {
+	kind, y, height, width int
+	thresholds             [3]float64
+}
+
+var classifiers = [16]classifier{
+	{0, 4, 3, 15, [3]float64{1.98215, 2.35817, 2.63523}},
+	{4, 4, 6, 15, [3]float64{-1.03809, -0.651211, -0.282167}},
+	{1, 0, 4, 16, [3]float64{-0.298702, 0.119262, 0.558497}},
+	{3, 8, 2, 12, [3]float64{-0.105439, 0.0153946, 0.135898}},
+	{3, 4, 4, 8, [3]float64{-0.142891, 0.0258736, 0.200632}},
+	{4, 0, 3, 5, [3]float64{-0.826319, -0.590612, -0.368214}},
+	{1, 2, 2, 9, [3]float64{-0.557409, -0.233035, 0.0534525}},
+	{2, 7, 3, 4, [3]float64{-0.0646826, 0.00620476, 0.0784847}},
+	{2, 6, 2, 16, [3]float64{-0.192387, -0.029699, 0.215855}},
+	{2, 1, 3, 2, [3]float64{-0.0397818, -0.00568076, 0.0292026}},
+	{5, 10, 1, 15, [3]float64{-0.53823, -0.369934, -0.190235}},
+	{3, 6, 2, 10, [3]float64{-0.124877, 0.0296483, 0.139239}},
+	{2, 1, 1, 14, [3]float64{-0.101475, 0.0225617, 0.231971}},
+	{3, 5, 6, 4, [3]float64{-0.0799915, -0.00729616, 0.063262}},
+	{1, 9, 2, 12, [3]float64{-0.272556, 0.019424, 0.302559}},
+	{3, 4, 2, 14, [3]float64{-0.164292, -0.0321188, 0.0846339}},
+}
+
+// maxFilterWidth is the number of chroma rows the widest classifier spans
+const maxFilterWidth = 16
+
+var grayCode = [4]uint32{0, 1, 3, 2}
+
+// Compute returns the Chromaprint sub-fingerprints of mono 16-bit PCM sampled at SampleRate.
+func Compute(samples []int16) []uint32 {
+	chroma := filterChroma(chromagram(samples))
+	if len(chroma) < maxFilterWidth {
+		return nil
+	}
+	image := newIntegralImage(chroma)
+	values := make([]uint32, 0, len(chroma)-maxFilterWidth+1)
+	for offset := 0; offset+maxFilterWidth <= len(chroma); offset++ {
+		var bits uint32
+		for _, c := range classifiers {
+			bits = bits<<2 | grayCode[c.quantize(c.apply(image, offset))]
+		}
+		values = append(values, bits)
+	}
+	return values
+}
+
+// chromagram folds the power spectrum of each Hamming-windowed frame into 12 pitch classes
+func chromagram(samples []int16) [][numBands]float64 {
+	window := make([]float64, frameSize)
+	for i := range window {
+		window[i] = (0.54 - 0.46*math.Cos(2*math.Pi*float64(i)/float64(frameSize-1))) / math.MaxInt16
+	}
+	minIndex := max(1, freqToIndex(minFreq))
+	maxIndex := min(frameSize/2, freqToIndex(maxFreq))
+	notes := make([]int, maxIndex)
+	for i := minIndex; i < maxIndex; i++ {
+		octave := math.Log2(float64(i) * SampleRate / frameSize / (440.0 / 16))
+		notes[i] = int(numBands * (octave - math.Floor(octave)))
+	}
+	var rows [][numBands]float64
+	buf := make([]complex128, frameSize)
+	for start := 0; start+frameSize <= len(samples); start += frameStep {
+		for i := range buf {
+			buf[i] = complex(float64(samples[start+i])*window[i], 0)
+		}
+		fft(buf)
+		var row [numBands]float64
+		for i := minIndex; i < maxIndex; i++ {
+			magnitude := cmplx.Abs(buf[i])
+			row[notes[i]] += magnitude * magnitude
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func freqToIndex(freq float64) int {
+	return int(math.Round(frameSize * freq / SampleRate))
+}
+
+// filterChroma smooths the chromagram over time and normalizes each row to unit length
+func filterChroma(rows [][numBands]float64) [][numBands]float64 {
+	if len(rows) < filterLength {
+		return nil
+	}
+	filtered := make([][numBands]float64, 0, len(rows)-filterLength+1)
+	for offset := 0; offset+filterLength <= len(rows); offset++ {
+		var row [numBands]float64
+		for j, coefficient := range chromaFilterCoefficients {
+			for i := range row {
+				row[i] += rows[offset+j][i] * coefficient
+			}
+		}
+		var norm float64
+		for _, v := range row {
+			norm += v * v
+		}
+		norm = math.Sqrt(norm)
+		for i := range row {
+			if norm < 0.01 {
+				row[i] = 0
+			} else {
+				row[i] /= norm
+			}
+		}
+		filtered = append(filtered, row)
+	}
+	return filtered
+}
+
+// fft is an in-place iterative radix-2 FFT; len(x) must be a power of two
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even, odd := x[start+k], x[start+k+size/2]*w
+				x[start+k], x[start+k+size/2] = even+odd, even-odd
+				w *= step
+			}
+		}
+	}
+}
+
+// integralImage answers sums over rectangles of the chroma image, with rows as time and columns as pitch class
+type integralImage struct {
+	sums [][numBands + 1]float64
+}
+
+func newIntegralImage(rows [][numBands]float64) *integralImage {
+	img := &integralImage{sums: make([][numBands + 1]float64, len(rows)+1)}
+	for r, row := range rows {
+		for c, v := range row {
+			img.sums[r+1][c+1] = v + img.sums[r][c+1] + img.sums[r+1][c] - img.sums[r][c]
+		}
+	}
+	return img
+}
+
+// area sums rows [r1, r2) and columns [c1, c2)
+func (img *integralImage) area(r1, c1, r2, c2 int) float64 {
+	return img.sums[r2][c2] - img.sums[r1][c2] - img.sums[r2][c1] + img.sums[r1][c1]
+}
+
+// apply evaluates the classifier's filter at the given row, comparing the two halves of the filter by log ratio
+func (c classifier) apply(img *integralImage, x int) float64 {
+	y, w, h := c.y, c.width, c.height
+	var a, b float64
+	switch c.kind {
+	case 0:
+		a = img.area(x, y, x+w, y+h)
+	case 1:
+		a = img.area(x, y+h/2, x+w, y+h)
+		b = img.area(x, y, x+w, y+h/2)
+	case 2:
+		a = img.area(x+w/2, y, x+w, y+h)
+		b = img.area(x, y, x+w/2, y+h)
+	case 3:
+		a = img.area(x, y+h/2, x+w/2, y+h) + img.area(x+w/2, y, x+w, y+h/2)
+		b = img.area(x, y, x+w/2, y+h/2) + img.area(x+w/2, y+h/2, x+w, y+h)
+	case 4:
+		h3 := h / 3
+		a = img.area(x, y+h3, x+w, y+2*h3)
+		b = img.area(x, y, x+w, y+h3) + img.area(x, y+2*h3, x+w, y+h)
+	case 5:
+		w3 := w / 3
+		a = img.area(x+w3, y, x+2*w3, y+h)
+		b = img.area(x, y, x+w3, y+h) + img.area(x+2*w3, y, x+w, y+h)
+	}
+	return math.Log(1+a) - math.Log(1+b)
+}
+
+func (c classifier) quantize(v float64) int {
+	switch {
+	case v < c.thresholds[0]:
+		return 0
+	case v < c.thresholds[1]:
+		return 1
+	case v < c.thresholds[2]:
+		return 2
+	default:
+		return 3
+	}
+}
@@ -0,0 +1,131 @@
+package fingerprint
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os/exec"
+	"strconv"
+
+	"github.com/gcottom/echodaemon/internal"
+)
+
+// MaxLength is how many seconds from the start of a track are fingerprinted, matching fpcalc's default
+const MaxLength = 120
+
+// Alignment limits used when comparing fingerprints; one sub-fingerprint covers about 0.12s of audio
+const (
+	maxAlignOffset = 80
+	minOverlap     = 40
+)
+
+var ErrTooShort = errors.New("audio is too short to fingerprint")
+
+// Fingerprint is the Chromaprint fingerprint of the first MaxLength seconds of a track
+type Fingerprint struct {
+	Values []uint32 `json:"values"`
+	// Duration is the length of the whole track in seconds
+	Duration float64 `json:"duration"`
+}
+
+// FromFile decodes the media file at path to PCM with ffmpeg and fingerprints it.
+func FromFile(ctx context.Context, path string) (*Fingerprint, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-hide_banner", "-loglevel", "error",
+		"-i", path,
+		"-vn", "-sn",
+		"-t", strconv.Itoa(MaxLength),
+		"-ac", "1", "-ar", strconv.Itoa(SampleRate),
+		"-f", "s16le", "-",
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg decode failed: %w; stderr: %s", err, stderr.String())
+	}
+	samples := make([]int16, stdout.Len()/2)
+	if err := binary.Read(&stdout, binary.LittleEndian, samples); err != nil {
+		return nil, fmt.Errorf("failed to read decoded audio: %w", err)
+	}
+	values := Compute(samples)
+	if len(values) == 0 {
+		return nil, ErrTooShort
+	}
+	duration, err := internal.ProbeDuration(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &Fingerprint{Values: values, Duration: duration.Seconds()}, nil
+}
+
+// Similarity returns the fraction of matching bits between two fingerprints at their best alignment, allowing
+// for one track starting up to about ten seconds later than the other. Unrelated audio scores around 0.5.
+func (f *Fingerprint) Similarity(other *Fingerprint) float64 {
+	best := 0.0
+	for offset := -maxAlignOffset; offset <= maxAlignOffset; offset++ {
+		start := max(0, -offset)
+		end := min(len(f.Values), len(other.Values)-offset)
+		if end-start < minOverlap {
+			continue
+		}
+		errs := 0
+		for i := start; i < end; i++ {
+			errs += bits.OnesCount32(f.Values[i] ^ other.Values[i+offset])
+		}
+		best = max(best, 1-float64(errs)/float64(32*(end-start)))
+	}
+	return best
+}
+
+// Encode returns the compressed, base64 encoded form of the fingerprint used by fpcalc and the AcoustID API.
+func (f *Fingerprint) Encode() string {
+	// Each sub-fingerprint is XORed with the previous one and stored as the gaps between its set bits
+	var deltas []byte
+	var last uint32
+	for _, v := range f.Values {
+		x := v ^ last
+		last = v
+		bit, lastBit := byte(1), byte(0)
+		for ; x != 0; x >>= 1 {
+			if x&1 != 0 {
+				deltas = append(deltas, bit-lastBit)
+				lastBit = bit
+			}
+			bit++
+		}
+		deltas = append(deltas, 0)
+	}
+	n := len(f.Values)
+	out := []byte{algorithmID, byte(n >> 16), byte(n >> 8), byte(n)}
+	var normal, exceptional bitWriter
+	for _, d := range deltas {
+		normal.write(min(d, 7), 3)
+		if d >= 7 {
+			exceptional.write(d-7, 5)
+		}
+	}
+	out = append(out, normal.buf...)
+	out = append(out, exceptional.buf...)
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+// bitWriter packs small values least significant bit first
+type bitWriter struct {
+	buf  []byte
+	used uint
+}
+
+func (w *bitWriter) write(v byte, width uint) {
+	for i := uint(0); i < width; i++ {
+		if w.used%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[len(w.buf)-1] |= (v >> i & 1) << (w.used % 8)
+		w.used++
+	}
+}
@@ -0,0 +1,167 @@
+package fingerprint
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"testing"
+)
+
+// chords synthesizes seconds of a C, Am, F, G progression, each chord held for 0.625s, at SampleRate
+func chords(seconds float64) []int16 {
+	progression := [][]float64{{261.63, 329.63, 392.00}, {220.00, 261.63, 329.63}, {174.61, 220.00, 261.63}, {196.00, 246.94, 293.66}}
+	samples := make([]int16, int(seconds*SampleRate))
+	for i := range samples {
+		t := float64(i) / SampleRate
+		chord := progression[int(t/0.625)%len(progression)]
+		var v float64
+		for _, f := range chord {
+			v += math.Sin(2*math.Pi*f*t) + 0.5*math.Sin(4*math.Pi*f*t) + 0.25*math.Sin(6*math.Pi*f*t)
+		}
+		samples[i] = int16(v / 5.25 * math.Exp(-3*math.Mod(t, 0.625)) * 20000)
+	}
+	return samples
+}
+
+func readPCM(t *testing.T, path string) []int16 {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := make([]int16, len(data)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(data[2*i:]))
+	}
+	return samples
+}
+
+func TestComputeSilence(t *testing.T) {
+	// Chromaprint's own test feeds 130 blocks of 1024 zero samples at 44.1kHz, a quarter as many at SampleRate
+	fp := &Fingerprint{Values: Compute(make([]int16, 130*1024/4))}
+	if want := []uint32{627964279, 627964279, 627964279}; !slices.Equal(fp.Values, want) {
+		t.Errorf("values = %v, want %v", fp.Values, want)
+	}
+	if got, want := fp.Encode(), "AQAAA0mUaEkSRZEGAA"; got != want {
+		t.Errorf("Encode() = %q, want %q", got, want)
+	}
+}
+
+func TestComputeKnownVector(t *testing.T) {
+	// testdata/chords.s16le is five seconds of chords(5) as mono 16-bit PCM at SampleRate. The expected fingerprint
+	// was recorded from this implementation; check it with:
+	//   fpcalc -raw -format s16le -rate 11025 -channels 1 testdata/chords.s16le
+	samples := readPCM(t, "testdata/chords.s16le")
+	if !slices.Equal(samples, chords(5)) {
+		t.Fatal("testdata/chords.s16le doesn't match chords(5)")
+	}
+	fp := &Fingerprint{Values: Compute(samples)}
+	if got, want := fp.Encode(), "AQAAE0qk5kqEfjqmPHGC63ikBF_w50gaI8f5FO1y4foCnzn6qbiiHruQnDPi6Ph3AEMMIo4gYJgkBiACAEDGCAEAAA"; got != want {
+		t.Errorf("Encode() = %q, want %q", got, want)
+	}
+}
+
+func TestComputeTooShort(t *testing.T) {
+	// 20 frames give 16 chroma rows after smoothing, exactly one classifier window
+	frames := maxFilterWidth + filterLength - 1
+	if got := Compute(chords(3)[:frameSize+(frames-2)*frameStep]); got != nil {
+		t.Errorf("one frame short: %d values", len(got))
+	}
+	if got := Compute(chords(3)[:frameSize+(frames-1)*frameStep]); len(got) != 1 {
+		t.Errorf("%d values, want 1", len(got))
+	}
+}
+
+func TestEncode(t *testing.T) {
+	// The cases of Chromaprint's fingerprint compressor tests
+	tests := []struct {
+		values []uint32
+		want   []byte
+	}{
+		{[]uint32{1}, []byte{algorithmID, 0, 0, 1, 1}},
+		{[]uint32{7}, []byte{algorithmID, 0, 0, 1, 73, 0}},
+		{[]uint32{1 << 6}, []byte{algorithmID, 0, 0, 1, 7, 0}},
+		{[]uint32{1 << 8}, []byte{algorithmID, 0, 0, 1, 7, 2}},
+		{[]uint32{1, 0}, []byte{algorithmID, 0, 0, 2, 65, 0}},
+		{[]uint32{1, 1}, []byte{algorithmID, 0, 0, 2, 1, 0}},
+	}
+	for _, tt := range tests {
+		got, err := base64.RawURLEncoding.DecodeString((&Fingerprint{Values: tt.values}).Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Encode(%v) = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := func(n int) []uint32 {
+		values := make([]uint32, n)
+		for i := range values {
+			values[i] = rng.Uint32()
+		}
+		return values
+	}
+	base := random(200)
+	noisy := slices.Clone(base[20:])
+	for i := range noisy {
+		// Flipping 4 of 32 bits in every value leaves 7/8 of them matching
+		noisy[i] ^= 0x01010101
+	}
+	tests := []struct {
+		name     string
+		a, b     []uint32
+		min, max float64
+	}{
+		{"identical", base, base, 1, 1},
+		{"starts later", base, base[25:], 1, 1},
+		{"starts earlier", base[25:], base, 1, 1},
+		{"last offset", base, base[maxAlignOffset:], 1, 1},
+		{"noisy", base, noisy, 0.875, 0.875},
+		{"unrelated", base, random(200), 0.45, 0.55},
+		{"beyond the offset limit", base, base[maxAlignOffset+1:], 0.45, 0.55},
+		{"overlap too short", base, base[len(base)-minOverlap+1:], 0, 0},
+	}
+	for _, tt := range tests {
+		a, b := &Fingerprint{Values: tt.a}, &Fingerprint{Values: tt.b}
+		got := a.Similarity(b)
+		if got < tt.min || got > tt.max {
+			t.Errorf("%s: Similarity = %.3f, want [%.3f, %.3f]", tt.name, got, tt.min, tt.max)
+		}
+		if back := b.Similarity(a); back != got {
+			t.Errorf("%s: Similarity isn't symmetric: %.3f and %.3f", tt.name, got, back)
+		}
+	}
+}
+
+func TestSimilarityAlignsAudio(t *testing.T) {
+	audio := chords(12)
+	rng := rand.New(rand.NewPCG(3, 4))
+	noise := make([]int16, len(audio))
+	for i := range noise {
+		noise[i] = int16(rng.IntN(20000) - 10000)
+	}
+	tests := []struct {
+		name     string
+		other    []int16
+		min, max float64
+	}{
+		// Skipping whole frames only drops whole sub-fingerprints
+		{"frame aligned", audio[10*frameStep:], 1, 1},
+		{"between frames", audio[10*frameStep+frameStep/2:], 0.85, 1},
+		{"noise", noise, 0, 0.7},
+	}
+	full := &Fingerprint{Values: Compute(audio)}
+	for _, tt := range tests {
+		got := full.Similarity(&Fingerprint{Values: Compute(tt.other)})
+		if got < tt.min || got > tt.max {
+			t.Errorf("%s: Similarity = %.3f, want [%.3f, %.3f]", tt.name, got, tt.min, tt.max)
+		}
+	}
+}
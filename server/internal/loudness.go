@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+
+	"github.com/gcottom/echodaemon/config"
+)
+
+// opusReferenceLUFS is the fixed level R128 gain tags are relative to (RFC 7845 5.2.1)
+const opusReferenceLUFS = -23
+
+// Loudness is an EBU R128 measurement taken by ffmpeg's loudnorm filter
+type Loudness struct {
+	IntegratedLUFS float64 `json:"integrated_lufs"`
+	TruePeakDBTP   float64 `json:"true_peak_dbtp"`
+	RangeLU        float64 `json:"range_lu"`
+	ThresholdLUFS  float64 `json:"threshold_lufs"`
+	TargetOffset   float64 `json:"target_offset"`
+	// Normalized is set when the measurement was used to normalize the track rather than to tag it
+	Normalized bool `json:"normalized"`
+}
+
+// AnalyzeLoudness runs the measurement pass of loudnorm over the media file at path.
+func AnalyzeLoudness(ctx context.Context, path string, target config.LoudnessConfig) (*Loudness, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-hide_banner", "-nostats",
+		"-i", path,
+		"-vn", "-sn",
+		"-af", fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g:print_format=json", target.TargetLUFS, target.TruePeak, target.LRA),
+		"-f", "null", "-",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg loudness analysis failed: %w; stderr: %s", err, stderr.String())
+	}
+	// loudnorm prints its measurement as the last JSON object on stderr
+	out := stderr.Bytes()
+	start := bytes.LastIndex(out, []byte("{"))
+	if start < 0 {
+		return nil, errors.New("no loudness measurement in ffmpeg output")
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(out[start:bytes.LastIndex(out, []byte("}"))+1], &raw); err != nil {
+		return nil, fmt.Errorf("invalid loudness measurement: %w", err)
+	}
+	var l Loudness
+	for key, field := range map[string]*float64{
+		"input_i":       &l.IntegratedLUFS,
+		"input_tp":      &l.TruePeakDBTP,
+		"input_lra":     &l.RangeLU,
+		"input_thresh":  &l.ThresholdLUFS,
+		"target_offset": &l.TargetOffset,
+	} {
+		v, err := strconv.ParseFloat(raw[key], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid loudness value %s=%q: %w", key, raw[key], err)
+		}
+		// Silent audio measures as -inf, which can't be turned into a gain
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, fmt.Errorf("track is too quiet to measure (%s=%s)", key, raw[key])
+		}
+		*field = v
+	}
+	return &l, nil
+}
+
+// LoudnormFilter returns the second-pass loudnorm filter that normalizes audio with the given measurement to the
+// target using linear gain.
+func LoudnormFilter(target config.LoudnessConfig, measured *Loudness) string {
+	return fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g:measured_I=%g:measured_TP=%g:measured_LRA=%g:measured_thresh=%g:offset=%g:linear=true",
+		target.TargetLUFS, target.TruePeak, target.LRA,
+		measured.IntegratedLUFS, measured.TruePeakDBTP, measured.RangeLU, measured.ThresholdLUFS, measured.TargetOffset)
+}
+
+// GainFields returns the tag fields that carry the measurement for a file in the output format. Opus files
+// get R128_TRACK_GAIN relative to -23 LUFS, everything else ReplayGain 2.0 fields relative to referenceLUFS.
+func (l *Loudness) GainFields(output config.OutputConfig, referenceLUFS float64) map[string]string {
+	if output.Remuxes() {
+		// Q7.8 fixed point dB
+		gain := math.Round((opusReferenceLUFS - l.IntegratedLUFS) * 256)
+		gain = max(min(gain, math.MaxInt16), math.MinInt16)
+		return map[string]string{"R128_TRACK_GAIN": strconv.Itoa(int(gain))}
+	}
+	return map[string]string{
+		"REPLAYGAIN_TRACK_GAIN": fmt.Sprintf("%.2f dB", referenceLUFS-l.IntegratedLUFS),
+		"REPLAYGAIN_TRACK_PEAK": fmt.Sprintf("%.6f", math.Pow(10, l.TruePeakDBTP/20)),
+	}
+}
@@ -0,0 +1,84 @@
+package ogg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Page is one raw Ogg page
+type Page struct {
+	Raw []byte
+}
+
+func (p *Page) HeaderType() byte {
+	return p.Raw[5]
+}
+
+func (p *Page) Granule() int64 {
+	return int64(binary.LittleEndian.Uint64(p.Raw[6:]))
+}
+
+func (p *Page) Serial() uint32 {
+	return binary.LittleEndian.Uint32(p.Raw[14:])
+}
+
+func (p *Page) Sequence() uint32 {
+	return binary.LittleEndian.Uint32(p.Raw[18:])
+}
+
+// SetSequence renumbers the page and refreshes its checksum.
+func (p *Page) SetSequence(seq uint32) {
+	binary.LittleEndian.PutUint32(p.Raw[18:], seq)
+	SetChecksum(p.Raw)
+}
+
+// Lacing returns the page's segment table
+func (p *Page) Lacing() []byte {
+	return p.Raw[27 : 27+int(p.Raw[26])]
+}
+
+// Payload returns the packet data carried by the page
+func (p *Page) Payload() []byte {
+	return p.Raw[27+int(p.Raw[26]):]
+}
+
+// PageReader reads Ogg pages one at a time
+type PageReader struct {
+	r *bufio.Reader
+}
+
+func NewPageReader(r io.Reader) *PageReader {
+	return &PageReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next page, or io.EOF at the end of the stream.
+func (pr *PageReader) Next() (*Page, error) {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(pr.r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errors.New("truncated ogg page header")
+		}
+		return nil, err
+	}
+	if string(header[:4]) != "OggS" {
+		return nil, errors.New("missing ogg page capture pattern")
+	}
+	lacing := make([]byte, header[26])
+	if _, err := io.ReadFull(pr.r, lacing); err != nil {
+		return nil, errors.New("truncated ogg segment table")
+	}
+	size := 0
+	for _, l := range lacing {
+		size += int(l)
+	}
+	raw := make([]byte, 0, 27+len(lacing)+size)
+	raw = append(raw, header...)
+	raw = append(raw, lacing...)
+	raw = raw[:27+len(lacing)+size]
+	if _, err := io.ReadFull(pr.r, raw[27+len(lacing):]); err != nil {
+		return nil, errors.New("truncated ogg page")
+	}
+	return &Page{Raw: raw}, nil
+}
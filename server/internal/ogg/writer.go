@@ -0,0 +1,114 @@
+package ogg
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Page header types
+const (
+	Continued = 0x01
+	BOS       = 0x02
+	EOS       = 0x04
+)
+
+// TargetPageSize is the payload size after which callers usually write an audio page out
+const TargetPageSize = 4096
+
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// Writer packs packets of a single logical bitstream into Ogg pages, continuing packets that don't fit on the
+// current page onto the next one.
+type Writer struct {
+	W        io.Writer
+	Serial   uint32
+	Sequence uint32
+
+	lacing    []byte
+	data      []byte
+	continued bool
+}
+
+// Buffered returns the payload size of the page being built.
+func (o *Writer) Buffered() int {
+	return len(o.data)
+}
+
+// AddPacket appends p to the current page. granule is the position after the last packet already on the page and
+// is used when the page has to be written out before p fits.
+func (o *Writer) AddPacket(p []byte, granule int64) error {
+	if len(o.lacing) > 0 && len(o.lacing)+len(p)/255+1 > 255 {
+		if err := o.Flush(granule, 0); err != nil {
+			return err
+		}
+	}
+	for {
+		free := 255 - len(o.lacing)
+		if len(p)/255 < free {
+			for range len(p) / 255 {
+				o.lacing = append(o.lacing, 255)
+			}
+			o.lacing = append(o.lacing, byte(len(p)%255))
+			o.data = append(o.data, p...)
+			return nil
+		}
+		// Fill the page and carry the rest of the packet over; no packet ends on this page
+		n := free * 255
+		for range free {
+			o.lacing = append(o.lacing, 255)
+		}
+		o.data = append(o.data, p[:n]...)
+		p = p[n:]
+		if err := o.Flush(-1, 0); err != nil {
+			return err
+		}
+		o.continued = true
+	}
+}
+
+// Flush writes the buffered packets as one page. granule is the position after the last packet on the page.
+func (o *Writer) Flush(granule int64, headerType byte) error {
+	if o.continued {
+		headerType |= Continued
+		o.continued = false
+	}
+	page := make([]byte, 27, 27+len(o.lacing)+len(o.data))
+	copy(page, "OggS")
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:], o.Serial)
+	binary.LittleEndian.PutUint32(page[18:], o.Sequence)
+	page[26] = byte(len(o.lacing))
+	page = append(page, o.lacing...)
+	page = append(page, o.data...)
+	SetChecksum(page)
+	o.Sequence++
+	o.lacing = o.lacing[:0]
+	o.data = o.data[:0]
+	_, err := o.W.Write(page)
+	return err
+}
+
+// SetChecksum recomputes the CRC of a complete page in place.
+func SetChecksum(page []byte) {
+	binary.LittleEndian.PutUint32(page[22:], 0)
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(page[22:], crc)
+}
@@ -0,0 +1,165 @@
+package ogg
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"testing"
+)
+
+// refChecksum is a bitwise CRC-32 over the page with its checksum field zeroed, as specified for Ogg: polynomial
+// 0x04C11DB7, no reflection, zero initial value and no final xor
+func refChecksum(page []byte) uint32 {
+	var crc uint32
+	for i, b := range page {
+		if i >= 22 && i < 26 {
+			b = 0
+		}
+		crc ^= uint32(b) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func TestRefChecksum(t *testing.T) {
+	// The reference matches the published check value for this CRC; the input is too short to have a checksum field
+	if got, want := refChecksum([]byte("123456789")), uint32(0x89A1897F); got != want {
+		t.Fatalf("check value = %08x, want %08x", got, want)
+	}
+	page := append(make([]byte, 27), "123456789"...)
+	SetChecksum(page)
+	if got := page[22:26]; !bytes.Equal(got, le32(refChecksum(page))) {
+		t.Fatalf("SetChecksum wrote % x, want % x", got, le32(refChecksum(page)))
+	}
+}
+
+func le32(v uint32) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+}
+
+func readPages(t *testing.T, r io.Reader) []*Page {
+	t.Helper()
+	pr := NewPageReader(r)
+	var pages []*Page
+	for {
+		page, err := pr.Next()
+		if err == io.EOF {
+			return pages
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := page.Raw[22:26], le32(refChecksum(page.Raw)); !bytes.Equal(got, want) {
+			t.Errorf("page %d checksum % x, want % x", len(pages), got, want)
+		}
+		pages = append(pages, page)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &Writer{W: &buf, Serial: 0xCAFEBABE}
+	short := bytes.Repeat([]byte{1}, 10)
+	exact := bytes.Repeat([]byte{2}, 255)
+	if err := w.AddPacket(short, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddPacket(exact, 0); err != nil {
+		t.Fatal(err)
+	}
+	if w.Buffered() != len(short)+len(exact) {
+		t.Errorf("buffered %d bytes", w.Buffered())
+	}
+	if err := w.Flush(0, BOS); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddPacket(short, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(960, EOS); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := readPages(t, &buf)
+	if len(pages) != 2 {
+		t.Fatalf("got %d pages, want 2", len(pages))
+	}
+	tests := []struct {
+		headerType byte
+		granule    int64
+		lacing     []byte
+		payload    []byte
+	}{
+		// A packet that's a multiple of 255 bytes ends with a zero lacing value
+		{BOS, 0, []byte{10, 255, 0}, append(slices.Clone(short), exact...)},
+		{EOS, 960, []byte{10}, short},
+	}
+	for i, tt := range tests {
+		p := pages[i]
+		if p.HeaderType() != tt.headerType || p.Granule() != tt.granule {
+			t.Errorf("page %d: header type %d granule %d, want %d and %d", i, p.HeaderType(), p.Granule(), tt.headerType, tt.granule)
+		}
+		if p.Serial() != 0xCAFEBABE || p.Sequence() != uint32(i) {
+			t.Errorf("page %d: serial %x sequence %d", i, p.Serial(), p.Sequence())
+		}
+		if !bytes.Equal(p.Lacing(), tt.lacing) || !bytes.Equal(p.Payload(), tt.payload) {
+			t.Errorf("page %d: lacing %v payload of %d bytes", i, p.Lacing(), len(p.Payload()))
+		}
+	}
+}
+
+func TestWriterContinuedPacket(t *testing.T) {
+	var buf bytes.Buffer
+	w := &Writer{W: &buf}
+	packet := make([]byte, 255*255+100)
+	for i := range packet {
+		packet[i] = byte(i)
+	}
+	if err := w.AddPacket(packet, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(960, EOS); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := readPages(t, &buf)
+	if len(pages) != 2 {
+		t.Fatalf("got %d pages, want 2", len(pages))
+	}
+	first, second := pages[0], pages[1]
+	// No packet ends on the first page, so it has no granule position
+	if first.HeaderType() != 0 || first.Granule() != -1 || len(first.Lacing()) != 255 || first.Lacing()[254] != 255 {
+		t.Errorf("first page: header type %d granule %d with %d lacing values", first.HeaderType(), first.Granule(), len(first.Lacing()))
+	}
+	if second.HeaderType() != Continued|EOS || second.Granule() != 960 || !bytes.Equal(second.Lacing(), []byte{100}) {
+		t.Errorf("second page: header type %d granule %d lacing %v", second.HeaderType(), second.Granule(), second.Lacing())
+	}
+	if got := append(slices.Clone(first.Payload()), second.Payload()...); !bytes.Equal(got, packet) {
+		t.Error("packet doesn't survive being split across pages")
+	}
+}
+
+func TestSetSequence(t *testing.T) {
+	var buf bytes.Buffer
+	w := &Writer{W: &buf}
+	if err := w.AddPacket([]byte("packet"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	page := readPages(t, &buf)[0]
+	page.SetSequence(7)
+	if page.Sequence() != 7 {
+		t.Errorf("sequence = %d", page.Sequence())
+	}
+	if got, want := page.Raw[22:26], le32(refChecksum(page.Raw)); !bytes.Equal(got, want) {
+		t.Errorf("checksum % x after renumbering, want % x", got, want)
+	}
+}
@@ -0,0 +1,119 @@
+package remux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+
+	"github.com/gcottom/echodaemon/internal/ogg"
+)
+
+// ErrUnsupported is returned when the input isn't WebM with an Opus track this package can remux
+var ErrUnsupported = errors.New("unsupported input for remux")
+
+// opusVendor is written into the OpusTags header; tags themselves are added later by the tagger
+const opusVendor = "echodaemon"
+
+// WebMOpusToOgg rewraps the Opus track of a WebM stream into an Ogg Opus stream (RFC 7845) without decoding the
+// audio. The WebM codec delay becomes the Ogg pre-skip and the final block's discard padding trims the end.
+func WebMOpusToOgg(r io.Reader, w io.Writer) error {
+	out := &ogg.Writer{W: w, Serial: rand.Uint32()}
+	var granule int64
+	onTrack := func(track *opusTrack) error {
+		head, err := opusHead(track)
+		if err != nil {
+			return err
+		}
+		if err = out.AddPacket(head, 0); err != nil {
+			return err
+		}
+		if err = out.Flush(0, ogg.BOS); err != nil {
+			return err
+		}
+		if err = out.AddPacket(opusTags(), 0); err != nil {
+			return err
+		}
+		return out.Flush(0, 0)
+	}
+	onBlock := func(block opusBlock, last bool) error {
+		samples, err := opusPacketSamples(block.packet)
+		if err != nil {
+			return err
+		}
+		if err = out.AddPacket(block.packet, granule); err != nil {
+			return err
+		}
+		granule += samples
+		if last {
+			end := granule - nsToSamples(block.discardPaddingNs)
+			return out.Flush(max(end, 0), ogg.EOS)
+		}
+		if out.Buffered() >= ogg.TargetPageSize {
+			return out.Flush(granule, 0)
+		}
+		return nil
+	}
+	return readWebMOpus(r, onTrack, onBlock)
+}
+
+// opusHead returns the identification header for the track. WebM stores it verbatim as CodecPrivate; when it's
+// missing one is built from the track's audio settings.
+func opusHead(track *opusTrack) ([]byte, error) {
+	if len(track.codecPrivate) >= 19 && string(track.codecPrivate[:8]) == "OpusHead" {
+		return track.codecPrivate, nil
+	}
+	if track.channels == 0 || track.channels > 2 {
+		return nil, fmt.Errorf("%w: can't build an opus header for %d channels", ErrUnsupported, track.channels)
+	}
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = byte(track.channels)
+	binary.LittleEndian.PutUint16(head[10:], uint16(nsToSamples(int64(track.codecDelayNs))))
+	binary.LittleEndian.PutUint32(head[12:], uint32(track.sampleRate))
+	return head, nil
+}
+
+// opusTags returns a comment header holding only the vendor string
+func opusTags() []byte {
+	tags := make([]byte, 0, 16+len(opusVendor))
+	tags = append(tags, "OpusTags"...)
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(opusVendor)))
+	tags = append(tags, opusVendor...)
+	return binary.LittleEndian.AppendUint32(tags, 0)
+}
+
+// opusPacketSamples returns the duration of an Opus packet in 48 kHz samples, read from its TOC byte (RFC 6716 3.1).
+func opusPacketSamples(p []byte) (int64, error) {
+	if len(p) == 0 {
+		return 0, errors.New("empty opus packet")
+	}
+	config := p[0] >> 3
+	var frameSize int64
+	switch {
+	case config < 12: // SILK: 10, 20, 40 or 60 ms
+		frameSize = [...]int64{480, 960, 1920, 2880}[config&3]
+	case config < 16: // Hybrid: 10 or 20 ms
+		frameSize = [...]int64{480, 960}[config&1]
+	default: // CELT: 2.5, 5, 10 or 20 ms
+		frameSize = [...]int64{120, 240, 480, 960}[config&3]
+	}
+	switch p[0] & 0x03 {
+	case 0:
+		return frameSize, nil
+	case 1, 2:
+		return 2 * frameSize, nil
+	default:
+		if len(p) < 2 {
+			return 0, errors.New("opus packet is missing its frame count")
+		}
+		return int64(p[1]&0x3F) * frameSize, nil
+	}
+}
+
+// nsToSamples converts a duration in nanoseconds to 48 kHz samples
+func nsToSamples(ns int64) int64 {
+	return ns * 48000 / 1e9
+}
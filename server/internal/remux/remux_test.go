@@ -0,0 +1,245 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/gcottom/echodaemon/internal/ogg"
+)
+
+// element encodes an EBML element with an 8 byte size, which every reader must accept
+func element(id uint32, children ...[]byte) []byte {
+	var b []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if c := byte(id >> shift); c != 0 || len(b) > 0 {
+			b = append(b, c)
+		}
+	}
+	payload := bytes.Join(children, nil)
+	b = append(b, 0x01)
+	b = append(b, binary.BigEndian.AppendUint64(nil, uint64(len(payload)))[1:]...)
+	return append(b, payload...)
+}
+
+func uintElement(id uint32, v uint64) []byte {
+	return element(id, binary.BigEndian.AppendUint64(nil, v))
+}
+
+func floatElement(id uint32, v float64) []byte {
+	return element(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func stringElement(id uint32, s string) []byte {
+	return element(id, []byte(s))
+}
+
+// block is a SimpleBlock or Block body for a single frame on a track below 127
+func block(track byte, packet []byte) []byte {
+	return append([]byte{0x80 | track, 0, 0, 0x80}, packet...)
+}
+
+// opusPacket is a 20 ms CELT packet (config 31, one frame) padded to size bytes
+func opusPacket(size int, fill byte) []byte {
+	p := bytes.Repeat([]byte{fill}, size)
+	p[0] = 0xF8
+	return p
+}
+
+// testOpusHead is an OpusHead for stereo audio with 312 samples of pre-skip
+func testOpusHead() []byte {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8], head[9] = 1, 2
+	binary.LittleEndian.PutUint16(head[10:], 312)
+	binary.LittleEndian.PutUint32(head[12:], 48000)
+	return head
+}
+
+// testWebM builds a WebM stream with a video track numbered 1 and the Opus track numbered 2. The final packet is in
+// a BlockGroup with discardPaddingNs of padding.
+func testWebM(opusTrack []byte, packets [][]byte, discardPaddingNs uint64) []byte {
+	cluster := [][]byte{uintElement(0xE7, 0)}
+	for i, p := range packets {
+		if i == len(packets)-1 {
+			cluster = append(cluster, element(idBlockGroup,
+				element(idBlock, block(2, p)),
+				uintElement(idDiscardPadding, discardPaddingNs)))
+			break
+		}
+		cluster = append(cluster, element(idSimpleBlock, block(2, p)))
+		if i%2 == 0 {
+			cluster = append(cluster, element(idSimpleBlock, block(1, []byte{0xFF, 0xFF, 0xFF})))
+		}
+	}
+	video := element(idTrackEntry,
+		uintElement(idTrackNumber, 1),
+		uintElement(idTrackType, 1),
+		stringElement(idCodecID, "V_VP9"))
+	return slices.Concat(
+		element(idEBML, stringElement(0x4282, "webm")),
+		element(idSegment,
+			element(idTracks, video, opusTrack),
+			element(idCluster, cluster...)),
+	)
+}
+
+func remuxPages(t *testing.T, webm []byte) []*ogg.Page {
+	t.Helper()
+	var out bytes.Buffer
+	if err := WebMOpusToOgg(bytes.NewReader(webm), &out); err != nil {
+		t.Fatal(err)
+	}
+	pr := ogg.NewPageReader(&out)
+	var pages []*ogg.Page
+	for {
+		page, err := pr.Next()
+		if err == io.EOF {
+			return pages
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The checksum has to match one computed over the page as read
+		check := slices.Clone(page.Raw)
+		ogg.SetChecksum(check)
+		if !bytes.Equal(check, page.Raw) {
+			t.Errorf("page %d has checksum % x, want % x", len(pages), page.Raw[22:26], check[22:26])
+		}
+		pages = append(pages, page)
+	}
+}
+
+// packetsOf splits the packets out of a page, which mustn't end in a continued packet
+func packetsOf(page *ogg.Page) [][]byte {
+	var packets [][]byte
+	payload, size := page.Payload(), 0
+	for _, l := range page.Lacing() {
+		size += int(l)
+		if l < 255 {
+			packets = append(packets, payload[:size])
+			payload, size = payload[size:], 0
+		}
+	}
+	return packets
+}
+
+func TestWebMOpusToOgg(t *testing.T) {
+	var packets [][]byte
+	for i := range 10 {
+		packets = append(packets, opusPacket(1000, byte(i)))
+	}
+	track := element(idTrackEntry,
+		uintElement(idTrackNumber, 2),
+		uintElement(idTrackType, trackTypeAudio),
+		stringElement(idCodecID, "A_OPUS"),
+		element(idCodecPrivate, testOpusHead()),
+		uintElement(idCodecDelay, 6500000),
+		element(idAudio, uintElement(idChannels, 2), floatElement(idSamplingFrequency, 48000)))
+	// 10 ms of padding is 480 samples
+	pages := remuxPages(t, testWebM(track, packets, 10000000))
+
+	if len(pages) != 4 {
+		t.Fatalf("got %d pages, want the two headers and two audio pages", len(pages))
+	}
+	tests := []struct {
+		headerType byte
+		granule    int64
+		packets    [][]byte
+	}{
+		{ogg.BOS, 0, [][]byte{testOpusHead()}},
+		{0, 0, [][]byte{opusTags()}},
+		// Audio pages are written out once they pass the target size, here after five 1000 byte packets
+		{0, 5 * 960, packets[:5]},
+		{ogg.EOS, 10*960 - 480, packets[5:]},
+	}
+	for i, tt := range tests {
+		p := pages[i]
+		if p.HeaderType() != tt.headerType || p.Granule() != tt.granule {
+			t.Errorf("page %d: header type %d granule %d, want %d and %d", i, p.HeaderType(), p.Granule(), tt.headerType, tt.granule)
+		}
+		if p.Sequence() != uint32(i) || p.Serial() != pages[0].Serial() {
+			t.Errorf("page %d: sequence %d serial %x", i, p.Sequence(), p.Serial())
+		}
+		if got := packetsOf(p); !slices.EqualFunc(got, tt.packets, bytes.Equal) {
+			t.Errorf("page %d: got %d packets, want %d unchanged", i, len(got), len(tt.packets))
+		}
+	}
+	if preSkip := binary.LittleEndian.Uint16(pages[0].Payload()[10:]); preSkip != 312 {
+		t.Errorf("pre-skip = %d, want 312", preSkip)
+	}
+}
+
+func TestWebMOpusToOggBuildsHead(t *testing.T) {
+	track := element(idTrackEntry,
+		uintElement(idTrackNumber, 2),
+		stringElement(idCodecID, "A_OPUS"),
+		uintElement(idCodecDelay, 6500000),
+		element(idAudio, uintElement(idChannels, 2), floatElement(idSamplingFrequency, 48000)))
+	pages := remuxPages(t, testWebM(track, [][]byte{opusPacket(10, 0), opusPacket(10, 1)}, 0))
+
+	if len(pages) != 3 {
+		t.Fatalf("got %d pages, want 3", len(pages))
+	}
+	head := pages[0].Payload()
+	if string(head[:8]) != "OpusHead" || head[8] != 1 || head[9] != 2 {
+		t.Fatalf("head % x", head)
+	}
+	if preSkip := binary.LittleEndian.Uint16(head[10:]); preSkip != 312 {
+		t.Errorf("pre-skip = %d, want the codec delay of 312 samples", preSkip)
+	}
+	if rate := binary.LittleEndian.Uint32(head[12:]); rate != 48000 {
+		t.Errorf("sample rate = %d", rate)
+	}
+	if last := pages[2]; last.HeaderType() != ogg.EOS || last.Granule() != 2*960 {
+		t.Errorf("last page: header type %d granule %d, want EOS at %d", last.HeaderType(), last.Granule(), 2*960)
+	}
+}
+
+func TestWebMOpusToOggUnsupported(t *testing.T) {
+	vorbis := element(idTrackEntry,
+		uintElement(idTrackNumber, 2),
+		stringElement(idCodecID, "A_VORBIS"))
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"not webm", []byte("OggS\x00\x02 not a matroska stream")},
+		{"no opus track", testWebM(vorbis, [][]byte{opusPacket(10, 0)}, 0)},
+	}
+	for _, tt := range tests {
+		if err := WebMOpusToOgg(bytes.NewReader(tt.in), io.Discard); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%s: err = %v, want ErrUnsupported", tt.name, err)
+		}
+	}
+}
+
+func TestOpusPacketSamples(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  []byte
+		want    int64
+		wantErr bool
+	}{
+		{"silk 10 ms", []byte{0 << 3}, 480, false},
+		{"silk 60 ms", []byte{3 << 3}, 2880, false},
+		{"hybrid 10 ms", []byte{12 << 3}, 480, false},
+		{"hybrid 20 ms", []byte{13 << 3}, 960, false},
+		{"celt 2.5 ms", []byte{16 << 3}, 120, false},
+		{"two frames", []byte{31<<3 | 1}, 1920, false},
+		{"two frames of different sizes", []byte{31<<3 | 2}, 1920, false},
+		{"frame count", []byte{31<<3 | 3, 3}, 2880, false},
+		{"missing frame count", []byte{31<<3 | 3}, 0, true},
+		{"empty", nil, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := opusPacketSamples(tt.packet)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: got %d, %v, want %d", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package remux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Matroska element IDs read while demuxing WebM
+const (
+	idEBML              = 0x1A45DFA3
+	idSegment           = 0x18538067
+	idTracks            = 0x1654AE6B
+	idTrackEntry        = 0xAE
+	idTrackNumber       = 0xD7
+	idTrackType         = 0x83
+	idCodecID           = 0x86
+	idCodecPrivate      = 0x63A2
+	idCodecDelay        = 0x56AA
+	idAudio             = 0xE1
+	idSamplingFrequency = 0xB5
+	idChannels          = 0x9F
+	idCluster           = 0x1F43B675
+	idSimpleBlock       = 0xA3
+	idBlockGroup        = 0xA0
+	idBlock             = 0xA1
+	idDiscardPadding    = 0x75A2
+)
+
+const trackTypeAudio = 2
+
+// unknownSize marks a master element whose size isn't known up front, as written by live muxers
+const unknownSize = -1
+
+// maxElementSize bounds the leaf elements that are read into memory
+const maxElementSize = 16 << 20
+
+// masterElements are descended into rather than skipped. Their children are read as a flat sequence, which works
+// because every element of interest has an ID that is unique across these masters.
+var masterElements = map[uint32]bool{
+	idSegment:    true,
+	idTracks:     true,
+	idTrackEntry: true,
+	idAudio:      true,
+	idCluster:    true,
+	idBlockGroup: true,
+}
+
+// opusTrack is the WebM track carrying the Opus audio
+type opusTrack struct {
+	number       uint64
+	trackType    uint64
+	codecID      string
+	codecPrivate []byte
+	codecDelayNs uint64
+	sampleRate   float64
+	channels     uint64
+}
+
+// opusBlock is one Opus packet and the trailing audio the encoder asked to discard from it, in nanoseconds
+type opusBlock struct {
+	packet           []byte
+	discardPaddingNs int64
+}
+
+type webmReader struct {
+	r *bufio.Reader
+}
+
+// readVint reads an EBML variable length integer of at most maxLen bytes. The length marker is kept for element IDs
+// and removed for sizes; a size with every value bit set is returned as unknownSize.
+func (e *webmReader) readVint(maxLen int, keepMarker bool) (int64, error) {
+	first, err := e.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	length := 1
+	for mask := byte(0x80); length <= maxLen && first&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > maxLen {
+		return 0, fmt.Errorf("invalid vint starting with 0x%02x", first)
+	}
+	value := int64(first)
+	if !keepMarker {
+		value &= int64(0xFF >> length)
+	}
+	allOnes := value == int64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		b, err := e.r.ReadByte()
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		allOnes = allOnes && b == 0xFF
+		value = value<<8 | int64(b)
+	}
+	if !keepMarker && allOnes {
+		return unknownSize, nil
+	}
+	return value, nil
+}
+
+func (e *webmReader) readElementHeader() (uint32, int64, error) {
+	id, err := e.readVint(4, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := e.readVint(8, false)
+	if err != nil {
+		return 0, 0, noEOF(err)
+	}
+	return uint32(id), size, nil
+}
+
+func (e *webmReader) readBytes(size int64) ([]byte, error) {
+	if size < 0 || size > maxElementSize {
+		return nil, fmt.Errorf("element size %d out of range", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(e.r, b); err != nil {
+		return nil, noEOF(err)
+	}
+	return b, nil
+}
+
+func (e *webmReader) readUint(size int64) (uint64, error) {
+	if size > 8 {
+		return 0, fmt.Errorf("integer element of %d bytes", size)
+	}
+	b, err := e.readBytes(size)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (e *webmReader) readInt(size int64) (int64, error) {
+	v, err := e.readUint(size)
+	if err != nil || size == 0 {
+		return 0, err
+	}
+	// Sign extend from the element's width
+	shift := 64 - 8*size
+	return int64(v<<shift) >> shift, nil
+}
+
+func (e *webmReader) readFloat(size int64) (float64, error) {
+	b, err := e.readBytes(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	}
+	return 0, fmt.Errorf("float element of %d bytes", size)
+}
+
+func (e *webmReader) skip(size int64) error {
+	if _, err := e.r.Discard(int(size)); err != nil {
+		return noEOF(err)
+	}
+	return nil
+}
+
+// readWebMOpus demuxes the Opus track of a WebM stream. onTrack is called once before the first packet, and onBlock
+// is called for every packet of the track with last set on the final one.
+func readWebMOpus(r io.Reader, onTrack func(*opusTrack) error, onBlock func(block opusBlock, last bool) error) error {
+	e := &webmReader{r: bufio.NewReader(r)}
+	var (
+		tracks  []*opusTrack
+		track   *opusTrack
+		pending *opusBlock
+	)
+	selectTrack := func() error {
+		if track != nil {
+			return nil
+		}
+		for _, t := range tracks {
+			if t.codecID == "A_OPUS" && (t.trackType == 0 || t.trackType == trackTypeAudio) {
+				track = t
+				return onTrack(track)
+			}
+		}
+		return fmt.Errorf("%w: no opus track", ErrUnsupported)
+	}
+	current := func() (*opusTrack, error) {
+		if len(tracks) == 0 {
+			return nil, errors.New("track field outside of a track entry")
+		}
+		return tracks[len(tracks)-1], nil
+	}
+
+	for first := true; ; first = false {
+		id, size, err := e.readElementHeader()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if first && id != idEBML {
+			return fmt.Errorf("%w: not a webm stream", ErrUnsupported)
+		}
+		if masterElements[id] {
+			switch id {
+			case idTrackEntry:
+				tracks = append(tracks, new(opusTrack))
+			case idCluster:
+				if err = selectTrack(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if size == unknownSize {
+			return fmt.Errorf("element 0x%x has unknown size", id)
+		}
+		switch id {
+		case idTrackNumber, idTrackType, idCodecDelay, idChannels:
+			t, err := current()
+			if err != nil {
+				return err
+			}
+			v, err := e.readUint(size)
+			if err != nil {
+				return err
+			}
+			switch id {
+			case idTrackNumber:
+				t.number = v
+			case idTrackType:
+				t.trackType = v
+			case idCodecDelay:
+				t.codecDelayNs = v
+			case idChannels:
+				t.channels = v
+			}
+		case idCodecID, idCodecPrivate:
+			t, err := current()
+			if err != nil {
+				return err
+			}
+			b, err := e.readBytes(size)
+			if err != nil {
+				return err
+			}
+			if id == idCodecID {
+				t.codecID = string(b)
+			} else {
+				t.codecPrivate = b
+			}
+		case idSamplingFrequency:
+			t, err := current()
+			if err != nil {
+				return err
+			}
+			if t.sampleRate, err = e.readFloat(size); err != nil {
+				return err
+			}
+		case idSimpleBlock, idBlock:
+			if err = selectTrack(); err != nil {
+				return err
+			}
+			b, err := e.readBytes(size)
+			if err != nil {
+				return err
+			}
+			number, packet, err := parseBlock(b)
+			if err != nil {
+				return err
+			}
+			if number != track.number {
+				continue
+			}
+			if pending != nil {
+				if err = onBlock(*pending, false); err != nil {
+					return err
+				}
+			}
+			pending = &opusBlock{packet: packet}
+		case idDiscardPadding:
+			v, err := e.readInt(size)
+			if err != nil {
+				return err
+			}
+			if pending != nil {
+				pending.discardPaddingNs = v
+			}
+		default:
+			if err = e.skip(size); err != nil {
+				return err
+			}
+		}
+	}
+	if pending == nil {
+		return errors.New("webm stream has no opus packets")
+	}
+	return onBlock(*pending, true)
+}
+
+// parseBlock splits a Block or SimpleBlock into its track number and frame. Laced blocks aren't produced for Opus
+// audio by YouTube and aren't supported.
+func parseBlock(b []byte) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, errors.New("empty block")
+	}
+	n := 1
+	for mask := byte(0x80); n <= 8 && b[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	// Relative timecode (2 bytes) and flags (1 byte) follow the track number
+	if n > 8 || len(b) < n+3 {
+		return 0, nil, errors.New("invalid block header")
+	}
+	number := uint64(b[0] & (0xFF >> n))
+	for _, c := range b[1:n] {
+		number = number<<8 | uint64(c)
+	}
+	if lacing := (b[n+2] >> 1) & 0x03; lacing != 0 {
+		return 0, nil, fmt.Errorf("%w: laced blocks", ErrUnsupported)
+	}
+	return number, b[n+3:], nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
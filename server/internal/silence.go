@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+
+	"github.com/gcottom/echodaemon/config"
+)
+
+// silenceEdge is how close to either end of the track a silent stretch has to reach to count as leading or trailing
+const silenceEdge = 0.05
+
+var (
+	silenceStartPattern = regexp.MustCompile(`silence_start: (-?[0-9.]+)`)
+	silenceEndPattern   = regexp.MustCompile(`silence_end: (-?[0-9.]+)`)
+)
+
+// ErrSilent is returned when a track is silent from start to end, leaving nothing to keep after trimming.
+var ErrSilent = errors.New("track is entirely silent")
+
+// Trim is the part of a track kept after cutting leading and trailing silence, in seconds of the original track
+type Trim struct {
+	Start    float64 `json:"start_seconds"`
+	End      float64 `json:"end_seconds"`
+	Original float64 `json:"original_seconds"`
+}
+
+// silence is a stretch of audio below the threshold; End is the track length when it runs to the end
+type silence struct {
+	Start, End float64
+}
+
+// DetectTrim finds leading and trailing silence in the media file at path with ffmpeg's silencedetect filter and
+// returns the span to keep, or nil when there's no silence at either end.
+func DetectTrim(ctx context.Context, path string, cfg config.TrimConfig) (*Trim, error) {
+	length, err := ProbeDuration(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	silences, err := detectSilence(ctx, path, cfg, length.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	trim := &Trim{End: length.Seconds(), Original: length.Seconds()}
+	if len(silences) > 0 && silences[0].Start <= silenceEdge {
+		trim.Start = max(silences[0].End-cfg.Padding, 0)
+	}
+	if n := len(silences); n > 0 && silences[n-1].End >= trim.Original-silenceEdge {
+		trim.End = min(silences[n-1].Start+cfg.Padding, trim.Original)
+	}
+	if trim.Start == 0 && trim.End == trim.Original {
+		return nil, nil
+	}
+	if trim.End-trim.Start <= 2*cfg.Padding {
+		return nil, ErrSilent
+	}
+	return trim, nil
+}
+
+// detectSilence lists the silent stretches silencedetect reports, in order
+func detectSilence(ctx context.Context, path string, cfg config.TrimConfig, length float64) ([]silence, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-hide_banner", "-nostats",
+		"-i", path,
+		"-vn", "-sn",
+		"-af", fmt.Sprintf("silencedetect=noise=%gdB:d=%g", cfg.ThresholdDB, cfg.MinSilence),
+		"-f", "null", "-",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg silence detection failed: %w; stderr: %s", err, stderr.String())
+	}
+	var silences []silence
+	open := false
+	scanner := bufio.NewScanner(&stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := silenceStartPattern.FindStringSubmatch(line); m != nil {
+			start, err := strconv.ParseFloat(m[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid silence_start %q: %w", m[1], err)
+			}
+			silences = append(silences, silence{Start: max(start, 0), End: length})
+			open = true
+		}
+		if m := silenceEndPattern.FindStringSubmatch(line); m != nil && open {
+			end, err := strconv.ParseFloat(m[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid silence_end %q: %w", m[1], err)
+			}
+			silences[len(silences)-1].End = min(end, length)
+			open = false
+		}
+	}
+	return silences, scanner.Err()
+}
+
+// TrimFile cuts the media file at path down to the trimmed span in place. The audio is stream copied, so the
+// cut lands on the nearest frame boundary and lossy formats aren't encoded a second time.
+func TrimFile(ctx context.Context, path string, trim *Trim, output config.OutputConfig) error {
+	trimmedPath := path + ".trim"
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-hide_banner", "-loglevel", "error",
+		"-i", path,
+		"-ss", strconv.FormatFloat(trim.Start, 'f', 3, 64),
+		"-to", strconv.FormatFloat(trim.End, 'f', 3, 64),
+		"-map", "0:a:0",
+		"-c:a", "copy",
+		"-f", muxer(output.Format),
+		"-y", trimmedPath,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		_ = os.Remove(trimmedPath)
+		return fmt.Errorf("ffmpeg trim failed: %w; stderr: %s", err, stderr.String())
+	}
+	if err := os.Rename(trimmedPath, path); err != nil {
+		_ = os.Remove(trimmedPath)
+		return fmt.Errorf("failed to replace trimmed file: %w", err)
+	}
+	return nil
+}
@@ -1,3 +1,11 @@
 package internal
 
-const FILEFORMAT = "mp3"
+// audioExtensions are the file types audiometa can read tags from
+var audioExtensions = map[string]bool{
+	".mp3":  true,
+	".m4a":  true,
+	".mp4":  true,
+	".flac": true,
+	".ogg":  true,
+	".opus": true,
+}
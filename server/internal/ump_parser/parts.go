@@ -0,0 +1,229 @@
+package ump_parser
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// UMP part types (per protos: UMPPartId)
+const (
+	PartTypeMediaHeader            = 20
+	PartTypeMedia                  = 21
+	PartTypeMediaEnd               = 22
+	PartTypeSabrRedirect           = 43
+	PartTypeSabrError              = 44
+	PartTypeStreamProtectionStatus = 58
+)
+
+// Stream protection statuses reported by STREAM_PROTECTION_STATUS parts
+const (
+	StreamProtectionOK                  = 1
+	StreamProtectionAttestationPending  = 2
+	StreamProtectionAttestationRequired = 3
+)
+
+// audioItags are the audio-only formats YouTube serves (AAC, Vorbis, Opus and their surround/premium variants)
+var audioItags = map[int32]bool{
+	139: true, 140: true, 141: true, 171: true, 172: true,
+	249: true, 250: true, 251: true, 256: true, 258: true,
+	325: true, 327: true, 328: true, 338: true, 380: true,
+	599: true, 600: true, 773: true, 774: true,
+}
+
+// IsAudioItag reports whether itag is a known audio-only format
+func IsAudioItag(itag int32) bool {
+	return audioItags[itag]
+}
+
+var ErrAttestationRequired = errors.New("stream protection: attestation required")
+
+// MediaHeader describes the media segments that follow it with the same HeaderID
+type MediaHeader struct {
+	HeaderID       uint32
+	VideoID        string
+	Itag           int32
+	LastModified   uint64
+	XTags          string
+	StartRange     int64
+	IsInitSegment  bool
+	SequenceNumber int64
+	StartMs        int64
+	DurationMs     int64
+	ContentLength  int64
+	TimeRange      TimeRange
+}
+
+type TimeRange struct {
+	StartTicks    int64
+	DurationTicks int64
+	Timescale     int32
+}
+
+// MediaSegment is the payload of a MEDIA part with its header ID prefix removed
+type MediaSegment struct {
+	HeaderID uint32
+	Data     []byte
+}
+
+// MediaEnd marks the end of the stream announced by the MediaHeader with the same HeaderID
+type MediaEnd struct {
+	HeaderID uint32
+}
+
+type SabrRedirect struct {
+	URL string
+}
+
+type SabrError struct {
+	Type string
+	Code int32
+}
+
+func (e *SabrError) Error() string {
+	return fmt.Sprintf("sabr error: %s (code %d)", e.Type, e.Code)
+}
+
+type StreamProtectionStatus struct {
+	Status     int32
+	MaxRetries int32
+}
+
+// Decode returns the typed form of the part: *MediaHeader, *MediaSegment, *MediaEnd, *SabrRedirect, *SabrError
+// or *StreamProtectionStatus. Part types without a typed form decode to nil.
+func (p *UMPPart) Decode() (any, error) {
+	switch p.Type {
+	case PartTypeMediaHeader:
+		return decodeMediaHeader(p.Data)
+	case PartTypeMedia:
+		headerID, n := protowire.ConsumeVarint(p.Data)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid media header id: %w", protowire.ParseError(n))
+		}
+		return &MediaSegment{HeaderID: uint32(headerID), Data: p.Data[n:]}, nil
+	case PartTypeMediaEnd:
+		headerID, n := protowire.ConsumeVarint(p.Data)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid media end header id: %w", protowire.ParseError(n))
+		}
+		return &MediaEnd{HeaderID: uint32(headerID)}, nil
+	case PartTypeSabrRedirect:
+		redirect := new(SabrRedirect)
+		err := forEachField(p.Data, func(num protowire.Number, v uint64, b []byte) {
+			if num == 1 {
+				redirect.URL = string(b)
+			}
+		})
+		return redirect, err
+	case PartTypeSabrError:
+		sabrErr := new(SabrError)
+		err := forEachField(p.Data, func(num protowire.Number, v uint64, b []byte) {
+			switch num {
+			case 1:
+				sabrErr.Type = string(b)
+			case 2:
+				sabrErr.Code = int32(v)
+			}
+		})
+		return sabrErr, err
+	case PartTypeStreamProtectionStatus:
+		status := new(StreamProtectionStatus)
+		err := forEachField(p.Data, func(num protowire.Number, v uint64, b []byte) {
+			switch num {
+			case 1:
+				status.Status = int32(v)
+			case 2:
+				status.MaxRetries = int32(v)
+			}
+		})
+		return status, err
+	}
+	return nil, nil
+}
+
+func decodeMediaHeader(data []byte) (*MediaHeader, error) {
+	header := new(MediaHeader)
+	var nestedErr error
+	err := forEachField(data, func(num protowire.Number, v uint64, b []byte) {
+		switch num {
+		case 1:
+			header.HeaderID = uint32(v)
+		case 2:
+			header.VideoID = string(b)
+		case 3:
+			header.Itag = int32(v)
+		case 4:
+			header.LastModified = v
+		case 5:
+			header.XTags = string(b)
+		case 6:
+			header.StartRange = int64(v)
+		case 8:
+			header.IsInitSegment = v != 0
+		case 9:
+			header.SequenceNumber = int64(v)
+		case 11:
+			header.StartMs = int64(v)
+		case 12:
+			header.DurationMs = int64(v)
+		case 13:
+			// FormatId carries the itag for newer responses that omit field 3
+			nestedErr = errors.Join(nestedErr, forEachField(b, func(num protowire.Number, v uint64, _ []byte) {
+				if num == 1 && header.Itag == 0 {
+					header.Itag = int32(v)
+				}
+			}))
+		case 14:
+			header.ContentLength = int64(v)
+		case 15:
+			nestedErr = errors.Join(nestedErr, forEachField(b, func(num protowire.Number, v uint64, _ []byte) {
+				switch num {
+				case 1:
+					header.TimeRange.StartTicks = int64(v)
+				case 2:
+					header.TimeRange.DurationTicks = int64(v)
+				case 3:
+					header.TimeRange.Timescale = int32(v)
+				}
+			}))
+		}
+	})
+	if err = errors.Join(err, nestedErr); err != nil {
+		return nil, fmt.Errorf("invalid media header: %w", err)
+	}
+	return header, nil
+}
+
+// forEachField walks a protobuf message, passing varint/fixed values as v and length-delimited values as b
+func forEachField(data []byte, fn func(num protowire.Number, v uint64, b []byte)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		var v uint64
+		var b []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(data)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(data)
+		case protowire.BytesType:
+			b, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		fn(num, v, b)
+	}
+	return nil
+}
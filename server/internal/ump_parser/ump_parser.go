@@ -1,98 +1,279 @@
 package ump_parser
 
-import "io"
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
 
-// UMP part type for media payload (per protos: UMPPartId.MEDIA = 21)
-const umpPartTypeMedia = 21
-
-// UMPReader parses UMP-encoded data
 type UMPPart struct {
 	Type int
 	Size int
 	Data []byte
 }
 
+// MaxPartSize bounds the size of a single part. Media parts carry well under a megabyte, so a larger size means the
+// response is corrupt, and allocating what its varint claims could exhaust memory.
+const MaxPartSize = 16 << 20
+
+var ErrPartTooLarge = errors.New("ump part exceeds the maximum part size")
+
+// MaxPendingSize bounds the media held back while no stream is selected. A stream that outgrows it without an
+// audio stream being announced can't be told apart from the video of a response whose audio comes later.
+const MaxPendingSize = MaxPartSize
+
+var ErrNoStreamSelected = errors.New("no audio stream selected")
+
+// UMPReader parses UMP-encoded data incrementally from an io.Reader, yielding one part at a time
 type UMPReader struct {
-	Buf []byte
-	Pos int
+	r *bufio.Reader
 }
 
+func NewUMPReader(r io.Reader) *UMPReader {
+	return &UMPReader{r: bufio.NewReader(r)}
+}
+
+// readVarInt returns io.EOF when the stream ends cleanly before the varint and io.ErrUnexpectedEOF when it ends inside it.
 func (r *UMPReader) readVarInt() (int, error) {
-	if r.Pos >= len(r.Buf) {
-		return -1, io.EOF
+	first, err := r.r.ReadByte()
+	if err != nil {
+		return -1, err
 	}
-	first := r.Buf[r.Pos]
-	var value int
 	var length int
-	if first < 128 {
-		value = int(first)
+	switch {
+	case first < 128:
 		length = 1
-	} else if first < 192 {
-		if r.Pos+1 >= len(r.Buf) {
-			return -1, io.EOF
-		}
-		value = int(first&0x3f) + 64*int(r.Buf[r.Pos+1])
+	case first < 192:
 		length = 2
-	} else if first < 224 {
-		if r.Pos+2 >= len(r.Buf) {
-			return -1, io.EOF
-		}
-		value = int(first&0x1f) + 32*(int(r.Buf[r.Pos+1])+256*int(r.Buf[r.Pos+2]))
+	case first < 224:
 		length = 3
-	} else if first < 240 {
-		if r.Pos+3 >= len(r.Buf) {
-			return -1, io.EOF
-		}
-		value = int(first&0x0f) + 16*(int(r.Buf[r.Pos+1])+256*(int(r.Buf[r.Pos+2])+256*int(r.Buf[r.Pos+3])))
+	case first < 240:
 		length = 4
-	} else {
-		if r.Pos+4 >= len(r.Buf) {
-			return -1, io.EOF
-		}
-		value = int(first&0x07) + 8*(int(r.Buf[r.Pos+1])+256*(int(r.Buf[r.Pos+2])+256*(int(r.Buf[r.Pos+3])+256*int(r.Buf[r.Pos+4]))))
+	default:
 		length = 5
 	}
-	r.Pos += length
+	var rest [4]byte
+	if _, err = io.ReadFull(r.r, rest[:length-1]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return -1, err
+	}
+	var value int
+	switch length {
+	case 1:
+		value = int(first)
+	case 2:
+		value = int(first&0x3f) + 64*int(rest[0])
+	case 3:
+		value = int(first&0x1f) + 32*(int(rest[0])+256*int(rest[1]))
+	case 4:
+		value = int(first&0x0f) + 16*(int(rest[0])+256*(int(rest[1])+256*int(rest[2])))
+	default:
+		value = int(first&0x07) + 8*(int(rest[0])+256*(int(rest[1])+256*(int(rest[2])+256*int(rest[3]))))
+	}
 	return value, nil
 }
 
+// NextPart reads the next part from the stream. It returns io.EOF at a clean end of stream,
+// io.ErrUnexpectedEOF when the stream ends partway through a part and ErrPartTooLarge for a part above MaxPartSize.
 func (r *UMPReader) NextPart() (*UMPPart, error) {
-	if r.Pos >= len(r.Buf) {
-		return nil, io.EOF
-	}
 	typeVal, err := r.readVarInt()
 	if err != nil {
 		return nil, err
 	}
 	sizeVal, err := r.readVarInt()
 	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
-	if r.Pos+sizeVal > len(r.Buf) {
-		return nil, io.EOF
+	if sizeVal > MaxPartSize {
+		return nil, fmt.Errorf("%w: part of type %d claims %d bytes", ErrPartTooLarge, typeVal, sizeVal)
+	}
+	data := make([]byte, sizeVal)
+	if _, err = io.ReadFull(r.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
 	}
-	data := r.Buf[r.Pos : r.Pos+sizeVal]
-	r.Pos += sizeVal
 	return &UMPPart{Type: typeVal, Size: sizeVal, Data: data}, nil
 }
 
-func DecodeUMPFile(input []byte) ([]byte, error) {
-	reader := &UMPReader{Buf: input}
-	var mediaData []byte
+// StreamResult summarises a decoded UMP response. MediaBytes and Headers cover the selected stream only; media of
+// every other stream is dropped, with Discarded counting its bytes by itag.
+type StreamResult struct {
+	MediaBytes       int64
+	SelectedItag     int32
+	Headers          []*MediaHeader
+	Discarded        map[int32]int64
+	Redirect         *SabrRedirect
+	ProtectionStatus *StreamProtectionStatus
+
+	incomplete  error
+	open        map[uint32]*openSegment
+	headerItags map[uint32]int32
+	// pending holds the media of the first stream while no stream is selected, in case it's the only one
+	pending     *bytes.Buffer
+	pendingItag int32
+}
+
+type openSegment struct {
+	header   *MediaHeader
+	received int64
+}
+
+// Incomplete explains why the media announced by the response was not fully received, or returns nil when
+// every segment arrived whole and was closed by a MEDIA_END part.
+func (r *StreamResult) Incomplete() error {
+	if r.incomplete != nil {
+		return r.incomplete
+	}
+	for _, seg := range r.open {
+		return fmt.Errorf("segment %d of itag %d never ended (%d bytes received)", seg.header.SequenceNumber, seg.header.Itag, seg.received)
+	}
+	return nil
+}
+
+func (r *StreamResult) markIncomplete(err error) {
+	if r.incomplete == nil {
+		r.incomplete = err
+	}
+}
+
+// Decode reads UMP parts from r as they arrive and demultiplexes media by header ID. Media of the stream with
+// the given itag is written to w; when itag is 0 the first audio stream announced by a MEDIA_HEADER is
+// selected instead. Media belonging to other streams is discarded rather than mixed into w. Until a stream is
+// selected the media of the first announced stream is held back, up to MaxPendingSize, in case it's the only one.
+// A SABR_ERROR part or a protection status requiring attestation stops decoding with an error.
+func Decode(r io.Reader, w io.Writer, itag int32) (*StreamResult, error) {
+	reader := NewUMPReader(r)
+	res := &StreamResult{
+		SelectedItag: itag,
+		Discarded:    make(map[int32]int64),
+		open:         make(map[uint32]*openSegment),
+		headerItags:  make(map[uint32]int32),
+	}
 	for {
 		part, err := reader.NextPart()
-		if err == io.EOF {
-			break
+		if errors.Is(err, io.EOF) {
+			return res, res.flushUnselected(w)
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			res.markIncomplete(errors.New("response ended partway through a part"))
+			return res, res.flushUnselected(w)
 		}
 		if err != nil {
-			return nil, err
+			return res, err
 		}
-		if part.Type == umpPartTypeMedia {
-			if part.Data[0] == 0x00 {
-				part.Data = part.Data[1:]
+		typed, err := part.Decode()
+		if err != nil {
+			return res, err
+		}
+		switch p := typed.(type) {
+		case *MediaHeader:
+			res.headerItags[p.HeaderID] = p.Itag
+			if res.SelectedItag == 0 && IsAudioItag(p.Itag) {
+				res.SelectedItag = p.Itag
+				res.dropPending()
+			}
+			if p.Itag != res.SelectedItag {
+				continue
+			}
+			if seg, ok := res.open[p.HeaderID]; ok {
+				res.markIncomplete(fmt.Errorf("segment %d of itag %d was replaced before it ended", seg.header.SequenceNumber, seg.header.Itag))
+			}
+			res.Headers = append(res.Headers, p)
+			res.open[p.HeaderID] = &openSegment{header: p}
+		case *MediaSegment:
+			if len(p.Data) == 0 {
+				continue
+			}
+			segItag, announced := res.headerItags[p.HeaderID]
+			// Responses without media headers carry a single stream, so their media is always kept
+			if announced && segItag != res.SelectedItag {
+				if res.SelectedItag == 0 && len(res.Discarded) == 0 && (res.pending == nil || res.pendingItag == segItag) {
+					if res.pending == nil {
+						res.pending, res.pendingItag = new(bytes.Buffer), segItag
+					}
+					if res.pending.Len()+len(p.Data) > MaxPendingSize {
+						res.dropPending()
+						return res, fmt.Errorf("%w: itag %d sent more than %d bytes before an audio stream was announced", ErrNoStreamSelected, segItag, MaxPendingSize)
+					}
+					res.pending.Write(p.Data)
+					continue
+				}
+				// A second stream means the pending one wasn't the only stream after all
+				res.dropPending()
+				res.Discarded[segItag] += int64(len(p.Data))
+				continue
+			}
+			n, err := w.Write(p.Data)
+			res.MediaBytes += int64(n)
+			if seg, ok := res.open[p.HeaderID]; ok {
+				seg.received += int64(n)
+			}
+			if err != nil {
+				return res, err
+			}
+		case *MediaEnd:
+			seg, ok := res.open[p.HeaderID]
+			if !ok {
+				continue
+			}
+			delete(res.open, p.HeaderID)
+			if seg.header.ContentLength > 0 && seg.received < seg.header.ContentLength {
+				res.markIncomplete(fmt.Errorf("segment %d of itag %d is short: %d of %d bytes", seg.header.SequenceNumber, seg.header.Itag, seg.received, seg.header.ContentLength))
+			}
+		case *SabrRedirect:
+			res.Redirect = p
+		case *SabrError:
+			return res, p
+		case *StreamProtectionStatus:
+			res.ProtectionStatus = p
+			if p.Status == StreamProtectionAttestationRequired {
+				return res, ErrAttestationRequired
 			}
-			mediaData = append(mediaData, part.Data...)
 		}
 	}
-	return mediaData, nil
+}
+
+// dropPending discards the media held back while no stream was selected
+func (r *StreamResult) dropPending() {
+	if r.pending != nil {
+		r.Discarded[r.pendingItag] += int64(r.pending.Len())
+		r.pending = nil
+	}
+}
+
+// flushUnselected falls back to the pending stream when no stream was ever selected, which happens when the
+// response carries a single stream whose itag is not a known audio format.
+func (r *StreamResult) flushUnselected(w io.Writer) error {
+	if r.SelectedItag != 0 || r.pending == nil {
+		return nil
+	}
+	r.SelectedItag = r.pendingItag
+	n, err := r.pending.WriteTo(w)
+	r.MediaBytes += n
+	r.pending = nil
+	return err
+}
+
+// DecodeUMPStream copies the media payload of the first audio stream in r to w as it arrives and returns the
+// number of media bytes written. A truncated trailing part is dropped, matching DecodeUMPFile.
+func DecodeUMPStream(r io.Reader, w io.Writer) (int64, error) {
+	res, err := Decode(r, w, 0)
+	return res.MediaBytes, err
+}
+
+func DecodeUMPFile(input []byte) ([]byte, error) {
+	var mediaData bytes.Buffer
+	if _, err := DecodeUMPStream(bytes.NewReader(input), &mediaData); err != nil {
+		return nil, err
+	}
+	return mediaData.Bytes(), nil
 }
@@ -0,0 +1,396 @@
+package ump_parser
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"maps"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// umpVarint encodes v in the UMP varint form read by readVarInt
+func umpVarint(v int) []byte {
+	switch {
+	case v < 1<<7:
+		return []byte{byte(v)}
+	case v < 1<<14:
+		return []byte{0x80 | byte(v&0x3f), byte(v >> 6)}
+	case v < 1<<21:
+		return []byte{0xc0 | byte(v&0x1f), byte(v >> 5), byte(v >> 13)}
+	case v < 1<<28:
+		return []byte{0xe0 | byte(v&0x0f), byte(v >> 4), byte(v >> 12), byte(v >> 20)}
+	}
+	return []byte{0xf0 | byte(v&0x07), byte(v >> 3), byte(v >> 11), byte(v >> 19), byte(v >> 27)}
+}
+
+func part(typ int, data []byte) []byte {
+	b := append(umpVarint(typ), umpVarint(len(data))...)
+	return append(b, data...)
+}
+
+func mediaHeader(headerID uint32, itag int32, contentLength int64) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(headerID))
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(itag))
+	b = protowire.AppendTag(b, 9, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(headerID))
+	if contentLength > 0 {
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(contentLength))
+	}
+	return part(PartTypeMediaHeader, b)
+}
+
+func media(headerID uint32, data string) []byte {
+	return part(PartTypeMedia, append(protowire.AppendVarint(nil, uint64(headerID)), data...))
+}
+
+func mediaEnd(headerID uint32) []byte {
+	return part(PartTypeMediaEnd, protowire.AppendVarint(nil, uint64(headerID)))
+}
+
+func protectionStatus(status int32) []byte {
+	return part(PartTypeStreamProtectionStatus, protectionStatusMessage(status))
+}
+
+func protectionStatusMessage(status int32) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(status))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	return protowire.AppendVarint(b, 3)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestReadVarInt(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want int
+	}{
+		{[]byte{0x00}, 0},
+		{[]byte{0x7f}, 127},
+		{[]byte{0x80, 0x02}, 128},
+		{[]byte{0xbf, 0xff}, 1<<14 - 1},
+		{[]byte{0xc0, 0x00, 0x02}, 1 << 14},
+		{[]byte{0xef, 0xff, 0xff, 0xff}, 1<<28 - 1},
+		{[]byte{0xf0, 0x00, 0x00, 0x00, 0x02}, 1 << 28},
+	}
+	for _, tt := range tests {
+		got, err := NewUMPReader(bytes.NewReader(tt.in)).readVarInt()
+		if err != nil || got != tt.want {
+			t.Errorf("readVarInt(% x) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+		if enc := umpVarint(tt.want); !bytes.Equal(enc, tt.in) {
+			t.Errorf("umpVarint(%d) = % x, want % x", tt.want, enc, tt.in)
+		}
+	}
+}
+
+func TestNextPart(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       []byte
+		wantType int
+		wantData string
+		wantErr  error
+	}{
+		{name: "part", in: part(PartTypeMedia, []byte("abc")), wantType: PartTypeMedia, wantData: "abc"},
+		{name: "multi-byte size", in: part(PartTypeMedia, bytes.Repeat([]byte("x"), 300)), wantType: PartTypeMedia, wantData: strings.Repeat("x", 300)},
+		{name: "empty stream", in: nil, wantErr: io.EOF},
+		{name: "missing size", in: []byte{PartTypeMedia}, wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated size", in: []byte{PartTypeMedia, 0x80}, wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated payload", in: part(PartTypeMedia, []byte("abcdef"))[:5], wantErr: io.ErrUnexpectedEOF},
+		// Only the header is present; the size alone must be rejected before anything is allocated
+		{name: "oversized", in: concat(umpVarint(PartTypeMedia), umpVarint(MaxPartSize+1)), wantErr: ErrPartTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewUMPReader(bytes.NewReader(tt.in)).NextPart()
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Type != tt.wantType || p.Size != len(tt.wantData) || string(p.Data) != tt.wantData {
+				t.Errorf("got type %d size %d data %q", p.Type, p.Size, p.Data)
+			}
+		})
+	}
+}
+
+func TestPartDecode(t *testing.T) {
+	var header []byte
+	header = protowire.AppendTag(header, 1, protowire.VarintType)
+	header = protowire.AppendVarint(header, 2)
+	header = protowire.AppendTag(header, 2, protowire.BytesType)
+	header = protowire.AppendString(header, "video-id")
+	header = protowire.AppendTag(header, 8, protowire.VarintType)
+	header = protowire.AppendVarint(header, 1)
+	header = protowire.AppendTag(header, 9, protowire.VarintType)
+	header = protowire.AppendVarint(header, 7)
+	header = protowire.AppendTag(header, 12, protowire.VarintType)
+	header = protowire.AppendVarint(header, 5000)
+	// Newer responses carry the itag only in the nested FormatId
+	header = protowire.AppendTag(header, 13, protowire.BytesType)
+	header = protowire.AppendBytes(header, protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 251))
+	header = protowire.AppendTag(header, 14, protowire.VarintType)
+	header = protowire.AppendVarint(header, 1234)
+	header = protowire.AppendTag(header, 15, protowire.BytesType)
+	timeRange := protowire.AppendVarint(protowire.AppendTag(nil, 2, protowire.VarintType), 240000)
+	timeRange = protowire.AppendVarint(protowire.AppendTag(timeRange, 3, protowire.VarintType), 48000)
+	header = protowire.AppendBytes(header, timeRange)
+	// Unknown fields are skipped
+	header = protowire.AppendTag(header, 99, protowire.Fixed32Type)
+	header = protowire.AppendFixed32(header, 1)
+
+	var redirect, sabrErr []byte
+	redirect = protowire.AppendTag(redirect, 1, protowire.BytesType)
+	redirect = protowire.AppendString(redirect, "https://example.com/videoplayback")
+	sabrErr = protowire.AppendTag(sabrErr, 1, protowire.BytesType)
+	sabrErr = protowire.AppendString(sabrErr, "sabr.malformed_config")
+	sabrErr = protowire.AppendTag(sabrErr, 2, protowire.VarintType)
+	sabrErr = protowire.AppendVarint(sabrErr, 3)
+
+	tests := []struct {
+		name    string
+		part    *UMPPart
+		want    any
+		wantErr bool
+	}{
+		{
+			name: "media header",
+			part: &UMPPart{Type: PartTypeMediaHeader, Data: header},
+			want: &MediaHeader{HeaderID: 2, VideoID: "video-id", Itag: 251, IsInitSegment: true, SequenceNumber: 7, DurationMs: 5000,
+				ContentLength: 1234, TimeRange: TimeRange{DurationTicks: 240000, Timescale: 48000}},
+		},
+		{name: "truncated media header", part: &UMPPart{Type: PartTypeMediaHeader, Data: header[:len(header)-1]}, wantErr: true},
+		{name: "media", part: &UMPPart{Type: PartTypeMedia, Data: []byte{0x02, 'a', 'b'}}, want: &MediaSegment{HeaderID: 2, Data: []byte("ab")}},
+		{name: "media without header id", part: &UMPPart{Type: PartTypeMedia}, wantErr: true},
+		{name: "media end", part: &UMPPart{Type: PartTypeMediaEnd, Data: []byte{0x02}}, want: &MediaEnd{HeaderID: 2}},
+		{name: "sabr redirect", part: &UMPPart{Type: PartTypeSabrRedirect, Data: redirect}, want: &SabrRedirect{URL: "https://example.com/videoplayback"}},
+		{name: "sabr error", part: &UMPPart{Type: PartTypeSabrError, Data: sabrErr}, want: &SabrError{Type: "sabr.malformed_config", Code: 3}},
+		{
+			name: "stream protection status",
+			part: &UMPPart{Type: PartTypeStreamProtectionStatus, Data: protectionStatusMessage(StreamProtectionAttestationRequired)},
+			want: &StreamProtectionStatus{Status: StreamProtectionAttestationRequired, MaxRetries: 3},
+		},
+		{name: "untyped part", part: &UMPPart{Type: 35, Data: []byte{0xff}}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.part.Decode()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalParts(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func equalParts(a, b any) bool {
+	switch a := a.(type) {
+	case *MediaHeader:
+		b, ok := b.(*MediaHeader)
+		return ok && *a == *b
+	case *MediaSegment:
+		b, ok := b.(*MediaSegment)
+		return ok && a.HeaderID == b.HeaderID && bytes.Equal(a.Data, b.Data)
+	case *MediaEnd:
+		b, ok := b.(*MediaEnd)
+		return ok && *a == *b
+	case *SabrRedirect:
+		b, ok := b.(*SabrRedirect)
+		return ok && *a == *b
+	case *SabrError:
+		b, ok := b.(*SabrError)
+		return ok && *a == *b
+	case *StreamProtectionStatus:
+		b, ok := b.(*StreamProtectionStatus)
+		return ok && *a == *b
+	}
+	return a == nil && b == nil
+}
+
+func TestDecode(t *testing.T) {
+	const audio, video, otherAudio = 251, 248, 140
+	tests := []struct {
+		name           string
+		in             []byte
+		itag           int32
+		wantMedia      string
+		wantItag       int32
+		wantDiscarded  map[int32]int64
+		wantIncomplete string
+		wantErr        error
+	}{
+		{
+			name: "interleaved audio and video",
+			in: concat(
+				mediaHeader(1, video, 6), mediaHeader(2, audio, 6),
+				media(1, "VVV"), media(2, "aaa"), media(1, "VVV"), media(2, "bbb"),
+				mediaEnd(1), mediaEnd(2)),
+			wantMedia: "aaabbb", wantItag: audio, wantDiscarded: map[int32]int64{video: 6},
+		},
+		{
+			name: "requested itag",
+			in: concat(
+				mediaHeader(1, otherAudio, 0), mediaHeader(2, audio, 0),
+				media(1, "xx"), media(2, "aa"), mediaEnd(1), mediaEnd(2)),
+			itag: audio, wantMedia: "aa", wantItag: audio, wantDiscarded: map[int32]int64{otherAudio: 2},
+		},
+		{
+			name: "audio announced after video media",
+			in: concat(
+				mediaHeader(1, video, 0), media(1, "VVVV"),
+				mediaHeader(2, audio, 0), media(2, "aa"), media(1, "VV"),
+				mediaEnd(1), mediaEnd(2)),
+			wantMedia: "aa", wantItag: audio, wantDiscarded: map[int32]int64{video: 6},
+		},
+		{
+			name:      "single stream of an unknown itag",
+			in:        concat(mediaHeader(1, 9999, 0), media(1, "ab"), media(1, "cd"), mediaEnd(1)),
+			wantMedia: "abcd", wantItag: 9999, wantDiscarded: map[int32]int64{},
+		},
+		{
+			name:      "media without headers",
+			in:        concat(media(0, "ab"), media(0, "cd")),
+			wantMedia: "abcd", wantDiscarded: map[int32]int64{},
+		},
+		{
+			name:      "later segments of the stream",
+			in:        concat(mediaHeader(1, audio, 2), media(1, "ab"), mediaEnd(1), mediaHeader(2, audio, 2), media(2, "cd"), mediaEnd(2)),
+			wantMedia: "abcd", wantItag: audio, wantDiscarded: map[int32]int64{},
+		},
+		{
+			name:      "truncated part",
+			in:        concat(mediaHeader(1, audio, 0), media(1, "ab"), media(1, "cdef")[:4]),
+			wantMedia: "ab", wantItag: audio, wantDiscarded: map[int32]int64{},
+			wantIncomplete: "partway through a part",
+		},
+		{
+			name:      "short segment",
+			in:        concat(mediaHeader(1, audio, 10), media(1, "ab"), mediaEnd(1)),
+			wantMedia: "ab", wantItag: audio, wantDiscarded: map[int32]int64{},
+			wantIncomplete: "short: 2 of 10 bytes",
+		},
+		{
+			name:      "missing media end",
+			in:        concat(mediaHeader(1, audio, 0), media(1, "ab")),
+			wantMedia: "ab", wantItag: audio, wantDiscarded: map[int32]int64{},
+			wantIncomplete: "never ended",
+		},
+		{
+			name:      "segment replaced before it ended",
+			in:        concat(mediaHeader(1, audio, 0), media(1, "ab"), mediaHeader(1, audio, 0), media(1, "cd"), mediaEnd(1)),
+			wantMedia: "abcd", wantItag: audio, wantDiscarded: map[int32]int64{},
+			wantIncomplete: "replaced before it ended",
+		},
+		{
+			name:    "attestation required",
+			in:      concat(protectionStatus(StreamProtectionAttestationRequired), mediaHeader(1, audio, 0), media(1, "ab")),
+			wantErr: ErrAttestationRequired,
+		},
+		{
+			name:    "oversized part",
+			in:      concat(mediaHeader(1, audio, 0), media(1, "ab"), umpVarint(PartTypeMedia), umpVarint(MaxPartSize+1)),
+			wantErr: ErrPartTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			res, err := Decode(bytes.NewReader(tt.in), &out, tt.itag)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.wantMedia || res.MediaBytes != int64(len(tt.wantMedia)) {
+				t.Errorf("media %q (%d bytes), want %q", out.String(), res.MediaBytes, tt.wantMedia)
+			}
+			if res.SelectedItag != tt.wantItag {
+				t.Errorf("selected itag %d, want %d", res.SelectedItag, tt.wantItag)
+			}
+			if !maps.Equal(res.Discarded, tt.wantDiscarded) {
+				t.Errorf("discarded %v, want %v", res.Discarded, tt.wantDiscarded)
+			}
+			incomplete := res.Incomplete()
+			if tt.wantIncomplete == "" && incomplete != nil {
+				t.Errorf("unexpected incomplete stream: %v", incomplete)
+			}
+			if tt.wantIncomplete != "" && (incomplete == nil || !strings.Contains(incomplete.Error(), tt.wantIncomplete)) {
+				t.Errorf("incomplete = %v, want one containing %q", incomplete, tt.wantIncomplete)
+			}
+		})
+	}
+}
+
+func TestDecodeAttestationStatus(t *testing.T) {
+	res, err := Decode(bytes.NewReader(protectionStatus(StreamProtectionAttestationRequired)), io.Discard, 0)
+	if !errors.Is(err, ErrAttestationRequired) {
+		t.Fatalf("err = %v, want ErrAttestationRequired", err)
+	}
+	if res.ProtectionStatus == nil || res.ProtectionStatus.MaxRetries != 3 {
+		t.Errorf("protection status %+v", res.ProtectionStatus)
+	}
+	if _, err = Decode(bytes.NewReader(protectionStatus(StreamProtectionAttestationPending)), io.Discard, 0); err != nil {
+		t.Errorf("pending attestation stopped decoding: %v", err)
+	}
+}
+
+func TestDecodeSabrParts(t *testing.T) {
+	var redirect, sabrErr []byte
+	redirect = protowire.AppendTag(redirect, 1, protowire.BytesType)
+	redirect = protowire.AppendString(redirect, "https://example.com/next")
+	sabrErr = protowire.AppendTag(sabrErr, 1, protowire.BytesType)
+	sabrErr = protowire.AppendString(sabrErr, "sabr.expired")
+
+	res, err := Decode(bytes.NewReader(part(PartTypeSabrRedirect, redirect)), io.Discard, 0)
+	if err != nil || res.Redirect == nil || res.Redirect.URL != "https://example.com/next" {
+		t.Errorf("redirect %+v, %v", res.Redirect, err)
+	}
+	var sabr *SabrError
+	if _, err = Decode(bytes.NewReader(part(PartTypeSabrError, sabrErr)), io.Discard, 0); !errors.As(err, &sabr) || sabr.Type != "sabr.expired" {
+		t.Errorf("err = %v, want the sabr error", err)
+	}
+}
+
+func TestDecodePendingLimit(t *testing.T) {
+	chunk := strings.Repeat("v", 1<<20)
+	in := [][]byte{mediaHeader(1, 9999, 0)}
+	for range MaxPendingSize/len(chunk) + 1 {
+		in = append(in, media(1, chunk))
+	}
+	var out bytes.Buffer
+	res, err := Decode(bytes.NewReader(concat(in...)), &out, 0)
+	if !errors.Is(err, ErrNoStreamSelected) {
+		t.Fatalf("err = %v, want ErrNoStreamSelected", err)
+	}
+	if out.Len() != 0 || res.pending != nil || res.Discarded[9999] != MaxPendingSize {
+		t.Errorf("wrote %d bytes, discarded %d, pending %v", out.Len(), res.Discarded[9999], res.pending != nil)
+	}
+}
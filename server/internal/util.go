@@ -4,17 +4,23 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/gcottom/echodaemon/config"
 	"github.com/gcottom/echodaemon/logger"
 )
 
-func ConvertFile(ctx context.Context, b []byte) ([]byte, error) {
-	// Decode and transcode while regenerating linear audio timestamps to avoid gaps at joins.
+// ConvertStream transcodes the media read from r into the output format and writes the result to outPath. The
+// input is streamed into ffmpeg's stdin, so it can be fed straight from a download without buffering it in memory.
+// filters are applied ahead of resampling when the output is re-encoded.
+func ConvertStream(ctx context.Context, r io.Reader, outPath string, output config.OutputConfig, filters ...string) error {
 	var args = []string{
 		"-hide_banner", "-loglevel", "error",
 		"-fflags", "+genpts+igndts", // ignore/don't trust DTS, generate PTS
@@ -22,28 +28,89 @@ func ConvertFile(ctx context.Context, b []byte) ([]byte, error) {
 		"-vn", "-sn", // drop video/subtitles
 		"-avoid_negative_ts", "make_zero", // normalize timestamps at splice points
 		"-map", "0:a:0?", // select first audio stream if present
-		"-af", "aresample=async=1:first_pts=0", // linearize PTS by sample index; minor resync only
-		"-c:a", "libmp3lame", "-b:a", "256k",
-		"-f", "mp3", "-", // output MP3 to stdout (pipe)
 	}
+	args = append(args, outputArgs(output, filters)...)
+	args = append(args, "-y", outPath)
 	// Use CommandContext so cancellation/timeouts propagate to ffmpeg
 	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdin = r
 
-	// Pipe input via an in-memory reader to avoid manual StdinPipe writes (prevents EPIPE on early-exit)
-	cmd.Stdin = bytes.NewReader(b)
-
-	var stdout bytes.Buffer
 	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
 	if err := cmd.Run(); err != nil {
 		// Include stderr to help diagnose codec/container issues instead of surfacing generic EPIPE
 		errWrap := fmt.Errorf("ffmpeg failed: %w; stderr: %s", err, stderr.String())
 		logger.ErrorC(ctx, "conversion error", slog.Any("error", errWrap))
-		return nil, errWrap
+		return errWrap
+	}
+	return nil
+}
+
+// ProbeDuration returns the playable duration of the media file at path as reported by ffprobe.
+func ProbeDuration(ctx context.Context, path string) (time.Duration, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("ffprobe failed: %w; stderr: %s", err, stderr.String())
 	}
-	return stdout.Bytes(), nil
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(stdout.String()), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration from ffprobe: %w", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// outputArgs returns the ffmpeg filter, codec and muxer arguments for the output profile
+func outputArgs(output config.OutputConfig, filters []string) []string {
+	if output.Remuxes() {
+		// The captured stream is already Opus, so it only needs moving into an Ogg container
+		return []string{"-c:a", "copy", "-f", muxer(output.Format)}
+	}
+	// Decode and transcode while regenerating linear audio timestamps to avoid gaps at joins.
+	chain := append(append([]string{}, filters...), "aresample=async=1:first_pts=0") // linearize PTS by sample index; minor resync only
+	args := []string{"-af", strings.Join(chain, ",")}
+	if len(filters) > 0 {
+		// loudnorm upsamples internally, so pin the output back to the source rate
+		args = append(args, "-ar", "48000")
+	}
+	switch output.Format {
+	case config.FormatFLAC:
+		return append(args, "-c:a", "flac", "-f", muxer(output.Format))
+	case config.FormatM4A:
+		return append(args, "-c:a", "aac", "-b:a", output.Bitrate, "-f", muxer(output.Format))
+	default:
+		if output.VBR {
+			return append(args, "-c:a", "libmp3lame", "-q:a", strconv.Itoa(output.VBRQuality), "-f", muxer(output.Format))
+		}
+		return append(args, "-c:a", "libmp3lame", "-b:a", output.Bitrate, "-f", muxer(output.Format))
+	}
+}
+
+// muxer returns the ffmpeg muxer that writes the output format's container
+func muxer(format string) string {
+	switch format {
+	case config.FormatOpus, config.FormatOgg:
+		return "ogg"
+	case config.FormatFLAC:
+		return "flac"
+	case config.FormatM4A:
+		return "ipod"
+	default:
+		return "mp3"
+	}
+}
+
+// IsAudioFile reports whether path has the extension of an audio format that can be tagged
+func IsAudioFile(path string) bool {
+	return audioExtensions[strings.ToLower(filepath.Ext(path))]
 }
 
 func OSExecuteFindJSONStart(ctx context.Context, command string, args ...string) ([]byte, error) {
@@ -75,6 +142,7 @@ func SanitizePath(path string) string {
 		components[i] = safeComponent
 	}
 	sanitizedPath := filepath.Join(components...)
-	sanitizedPath = strings.Replace(sanitizedPath, fmt.Sprintf(" .%s", FILEFORMAT), fmt.Sprintf(".%s", FILEFORMAT), -1)
+	ext := filepath.Ext(sanitizedPath)
+	sanitizedPath = strings.TrimRight(strings.TrimSuffix(sanitizedPath, ext), " ") + ext
 	return sanitizedPath
 }
@@ -0,0 +1,217 @@
+package classifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/gcottom/echodaemon/logger"
+)
+
+// Supervision timing: how often a starting service is health checked, and how long to wait before restarting
+// one that exited. The restart delay doubles with each crash and resets once the service stays up for stableRun.
+const (
+	healthInterval  = time.Second
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+	stableRun       = time.Minute
+)
+
+var ErrNotReady = errors.New("genre classifier is not ready")
+
+// Run starts the service and keeps it running until ctx is done, restarting it whenever it exits.
+func (s *Sidecar) Run(ctx context.Context) {
+	delay := minRestartDelay
+	for {
+		started := time.Now()
+		err := s.runOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > stableRun {
+			delay = minRestartDelay
+		}
+		logger.ErrorC(ctx, "genre classifier exited, restarting", slog.Any("error", err), slog.Duration("delay", delay))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRestartDelay)
+	}
+}
+
+// runOnce runs the service process until it exits
+func (s *Sidecar) runOnce(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	output := &lineLogger{ctx: ctx}
+	cmd.Stdout, cmd.Stderr = output, output
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start genre classifier: %w", err)
+	}
+	logger.InfoC(ctx, "genre classifier started", slog.Int("pid", cmd.Process.Pid), slog.String("addr", s.Addr))
+	exited := make(chan struct{})
+	go s.awaitHealthy(ctx, exited)
+	err := cmd.Wait()
+	close(exited)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Classifications wait for the next process once this one had been ready
+	select {
+	case <-s.readyChan():
+		s.ready = make(chan struct{})
+	default:
+	}
+	return err
+}
+
+// awaitHealthy polls the service until it answers its health check, then lets classifications through
+func (s *Sidecar) awaitHealthy(ctx context.Context, exited chan struct{}) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+		if err := s.Health(ctx); err != nil {
+			continue
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-exited:
+		default:
+			logger.InfoC(ctx, "genre classifier ready", slog.String("addr", s.Addr))
+			close(s.readyChan())
+		}
+		return
+	}
+}
+
+// readyChan returns the channel closed while the service is ready. Callers must hold s.mu.
+func (s *Sidecar) readyChan() chan struct{} {
+	if s.ready == nil {
+		s.ready = make(chan struct{})
+	}
+	return s.ready
+}
+
+// Health checks that the service is up and has its models loaded.
+func (s *Sidecar) Health(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthInterval)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+s.Addr+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Classify detects the genre of the track at audioPath, waiting up to StartupTimeout for the service to be ready.
+func (s *Sidecar) Classify(ctx context.Context, audioPath string) (*Result, error) {
+	s.mu.Lock()
+	ready := s.readyChan()
+	s.mu.Unlock()
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(s.StartupTimeout):
+		return nil, ErrNotReady
+	}
+
+	path, err := filepath.Abs(audioPath)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]string{"path": path})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+s.Addr+"/classify", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("genre classifier request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var res struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&res)
+		return nil, fmt.Errorf("genre classifier failed with status %s: %s", resp.Status, res.Error)
+	}
+	var res Result
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("failed to decode genre classifier response: %w", err)
+	}
+	return &res, nil
+}
+
+func (s *Sidecar) client() *http.Client {
+	if s.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return s.HTTPClient
+}
+
+// lineLogger logs the service's output line by line
+type lineLogger struct {
+	ctx context.Context
+	buf []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if line := bytes.TrimSpace(l.buf[:i]); len(line) > 0 {
+			logger.InfoC(l.ctx, "genre classifier output", slog.String("line", string(line)))
+		}
+		l.buf = l.buf[i+1:]
+	}
+}
+
+// Classify returns the fake's result.
+func (f *Fake) Classify(ctx context.Context, audioPath string) (*Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, audioPath)
+	return f.Result, f.Err
+}
+
+// Calls returns the paths the fake was asked to classify, in order.
+func (f *Fake) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.calls)
+}
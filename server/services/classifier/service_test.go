@@ -0,0 +1,213 @@
+package classifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestHelperProcess stands in for the Python service process. It reports its start to the test server, then either
+// exits at once, simulating a crash, or stays up until it's killed.
+func TestHelperProcess(t *testing.T) {
+	server := os.Getenv("CLASSIFIER_HELPER_URL")
+	if server == "" {
+		return
+	}
+	if resp, err := http.Post(server+"/started", "text/plain", nil); err == nil {
+		resp.Body.Close()
+	}
+	if os.Getenv("CLASSIFIER_HELPER_MODE") == "crash" {
+		os.Exit(1)
+	}
+	time.Sleep(time.Minute)
+	os.Exit(0)
+}
+
+// testService serves the classifier API; the Sidecar's process is the helper process, which only reports its starts
+type testService struct {
+	*httptest.Server
+	healthy  atomic.Bool
+	starts   atomic.Int32
+	classify http.HandlerFunc
+}
+
+func newTestService(t *testing.T, mode string) *testService {
+	t.Helper()
+	svc := &testService{}
+	svc.healthy.Store(true)
+	svc.classify = func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Result{Genre: "Rock", Tags: map[string]float64{"rock": 0.8}})
+	}
+	svc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/started":
+			svc.starts.Add(1)
+		case "/health":
+			if !svc.healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		case "/classify":
+			svc.classify(w, r)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(svc.Close)
+	t.Setenv("CLASSIFIER_HELPER_URL", svc.URL)
+	t.Setenv("CLASSIFIER_HELPER_MODE", mode)
+	return svc
+}
+
+func (svc *testService) sidecar() *Sidecar {
+	return &Sidecar{
+		Command:        []string{os.Args[0], "-test.run=^TestHelperProcess$"},
+		Addr:           strings.TrimPrefix(svc.URL, "http://"),
+		Timeout:        5 * time.Second,
+		StartupTimeout: 5 * time.Second,
+		HTTPClient:     svc.Client(),
+	}
+}
+
+func TestSidecarHealth(t *testing.T) {
+	svc := newTestService(t, "serve")
+	s := svc.sidecar()
+	if err := s.Health(context.Background()); err != nil {
+		t.Fatalf("healthy service: %v", err)
+	}
+	svc.healthy.Store(false)
+	if err := s.Health(context.Background()); err == nil {
+		t.Fatal("unhealthy service passed the health check")
+	}
+}
+
+func TestSidecarClassify(t *testing.T) {
+	svc := newTestService(t, "serve")
+	var path string
+	svc.classify = func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		path = req["path"]
+		json.NewEncoder(w).Encode(Result{Genre: "Rock", Tags: map[string]float64{"rock": 0.8}})
+	}
+	s := svc.sidecar()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	res, err := s.Classify(ctx, "track.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Genre != "Rock" || res.Tags["rock"] != 0.8 {
+		t.Errorf("got %+v", res)
+	}
+	if !strings.HasPrefix(path, "/") || !strings.HasSuffix(path, "track.mp3") {
+		t.Errorf("service got path %q, want an absolute path", path)
+	}
+}
+
+func TestSidecarClassifyError(t *testing.T) {
+	svc := newTestService(t, "serve")
+	svc.classify = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "no such file"}`))
+	}
+	s := svc.sidecar()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	if _, err := s.Classify(ctx, "missing.mp3"); err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Fatalf("err = %v, want the service's error", err)
+	}
+}
+
+func TestSidecarTimeout(t *testing.T) {
+	svc := newTestService(t, "serve")
+	release := make(chan struct{})
+	defer close(release)
+	svc.classify = func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}
+	s := svc.sidecar()
+	s.Timeout = 100 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	start := time.Now()
+	_, err := s.Classify(ctx, "slow.mp3")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want a deadline error", err)
+	}
+	// Classify waits for the first health check before its own timeout starts
+	if elapsed := time.Since(start); elapsed > healthInterval+time.Second {
+		t.Errorf("classify took %s", elapsed)
+	}
+}
+
+func TestSidecarNotReady(t *testing.T) {
+	svc := newTestService(t, "serve")
+	svc.healthy.Store(false)
+	s := svc.sidecar()
+	s.StartupTimeout = 1500 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	if _, err := s.Classify(ctx, "track.mp3"); !errors.Is(err, ErrNotReady) {
+		t.Fatalf("err = %v, want ErrNotReady", err)
+	}
+}
+
+func TestSidecarRestartsAfterCrash(t *testing.T) {
+	svc := newTestService(t, "crash")
+	s := svc.sidecar()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	// The first restart comes after minRestartDelay, the second after twice that
+	deadline := time.Now().Add(minRestartDelay*3 + 5*time.Second)
+	for svc.starts.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("service started %d times, want it restarted twice", svc.starts.Load())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after its context was cancelled")
+	}
+}
+
+func TestFake(t *testing.T) {
+	f := &Fake{Result: &Result{Genre: "Jazz"}}
+	res, err := f.Classify(context.Background(), "a.mp3")
+	if err != nil || res.Genre != "Jazz" {
+		t.Fatalf("got %+v, %v", res, err)
+	}
+	f.Err = errors.New("boom")
+	if _, err = f.Classify(context.Background(), "b.mp3"); err == nil {
+		t.Fatal("want the fake's error")
+	}
+	if calls := f.Calls(); len(calls) != 2 || calls[0] != "a.mp3" || calls[1] != "b.mp3" {
+		t.Errorf("calls = %v", calls)
+	}
+}
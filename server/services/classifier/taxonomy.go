@@ -0,0 +1,113 @@
+package classifier
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultTaxonomy maps the musicnn tags used when no taxonomy file is configured
+var DefaultTaxonomy = &Taxonomy{
+	Genres: map[string]string{
+		"rock": "Rock", "pop": "Pop", "alternative": "Alternative", "indie": "Indie", "electronic": "Electronic",
+		"dance": "Dance", "alternative rock": "Alternative Rock", "jazz": "Jazz", "metal": "Metal",
+		"classic rock": "Classic Rock", "soul": "Soul", "indie rock": "Indie Rock", "electronica": "Electronica",
+		"folk": "Folk", "punk": "Punk", "blues": "Blues", "hard rock": "Hard Rock", "ambient": "Ambient",
+		"experimental": "Experimental", "hip-hop": "Hip-Hop", "country": "Country", "easy listening": "Easy Listening",
+		"funk": "Funk", "electro": "Electro", "heavy metal": "Heavy Metal", "progressive rock": "Progressive Rock",
+		"rnb": "R&B", "indie pop": "Indie Pop", "house": "House", "classical": "Classical", "classic": "Classical",
+		"techno": "Techno", "new age": "New Age", "opera": "Opera", "indian": "Indian",
+	},
+	Moods: map[string]string{
+		"beautiful": "Beautiful", "mellow": "Mellow", "chill": "Chill", "chillout": "Chill", "sad": "Sad",
+		"party": "Party", "sexy": "Sexy", "catchy": "Catchy", "happy": "Happy", "soft": "Soft", "weird": "Weird",
+		"slow": "Slow", "fast": "Fast", "loud": "Loud", "quiet": "Quiet",
+	},
+	Instruments: map[string]string{
+		"guitar": "Guitar", "strings": "Strings", "drums": "Drums", "piano": "Piano", "violin": "Violin",
+		"synth": "Synth", "harpsichord": "Harpsichord", "flute": "Flute", "sitar": "Sitar", "harp": "Harp",
+		"cello": "Cello", "choir": "Choir", "choral": "Choir",
+	},
+}
+
+// LoadTaxonomy reads a taxonomy from a YAML file with genres, moods and instruments sections, each mapping raw
+// tags to the names written to tracks.
+func LoadTaxonomy(path string) (*Taxonomy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read genre taxonomy: %w", err)
+	}
+	var t Taxonomy
+	if err = yaml.UnmarshalStrict(data, &t); err != nil {
+		return nil, fmt.Errorf("failed to parse genre taxonomy %s: %w", path, err)
+	}
+	if len(t.Genres) == 0 {
+		return nil, fmt.Errorf("genre taxonomy %s has no genres", path)
+	}
+	return &t, nil
+}
+
+// Labels maps the result's tags scoring at least threshold to genre, mood and instrument names, keeping at most
+// maxGenres genres (0 keeps all of them). A track always gets a genre when it has one at all: the best scoring
+// genre is used when none reaches the threshold, or the service's own pick when it sent no scores.
+func (t *Taxonomy) Labels(res *Result, threshold float64, maxGenres int) Labels {
+	if len(res.Tags) == 0 {
+		if res.Genre == "" {
+			return Labels{}
+		}
+		return Labels{Genres: []string{res.Genre}}
+	}
+	genres := mapTags(t.Genres, res.Tags)
+	labels := Labels{
+		Genres:      above(genres, threshold),
+		Moods:       above(mapTags(t.Moods, res.Tags), threshold),
+		Instruments: above(mapTags(t.Instruments, res.Tags), threshold),
+	}
+	if len(labels.Genres) == 0 && len(genres) > 0 {
+		labels.Genres = []string{genres[0].name}
+	}
+	if maxGenres > 0 && len(labels.Genres) > maxGenres {
+		labels.Genres = labels.Genres[:maxGenres]
+	}
+	return labels
+}
+
+type scoredName struct {
+	name  string
+	score float64
+}
+
+// mapTags returns the names the taxonomy maps tags to, from the highest score down. Tags are matched regardless of
+// case, and a name several tags map to takes the best of their scores.
+func mapTags(taxonomy map[string]string, tags map[string]float64) []scoredName {
+	best := make(map[string]float64)
+	for tag, name := range taxonomy {
+		for raw, score := range tags {
+			if strings.EqualFold(raw, tag) && score > best[name] {
+				best[name] = score
+			}
+		}
+	}
+	names := make([]scoredName, 0, len(best))
+	for name, score := range best {
+		names = append(names, scoredName{name, score})
+	}
+	slices.SortFunc(names, func(a, b scoredName) int {
+		return cmp.Or(cmp.Compare(b.score, a.score), cmp.Compare(a.name, b.name))
+	})
+	return names
+}
+
+func above(names []scoredName, threshold float64) []string {
+	var res []string
+	for _, n := range names {
+		if n.score >= threshold {
+			res = append(res, n.name)
+		}
+	}
+	return res
+}
@@ -0,0 +1,63 @@
+package classifier
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GenreClassifier detects a track's genre from its audio.
+type GenreClassifier interface {
+	Classify(ctx context.Context, audioPath string) (*Result, error)
+}
+
+// Result is what the classifier detected in a track
+type Result struct {
+	// Genre is the service's own pick of a single genre
+	Genre string `json:"genre"`
+	// Tags holds the score from 0 to 1 of every tag the models know, genres as well as moods, instruments and decades
+	Tags map[string]float64 `json:"tags"`
+}
+
+// Taxonomy maps the classifier's raw tags to the genre, mood and instrument names written to tracks. Tags that
+// aren't listed are dropped, and several tags may map to the same name.
+type Taxonomy struct {
+	Genres      map[string]string `yaml:"genres"`
+	Moods       map[string]string `yaml:"moods"`
+	Instruments map[string]string `yaml:"instruments"`
+}
+
+// Labels are a track's tags mapped through a Taxonomy, each list ordered from the highest score down
+type Labels struct {
+	Genres      []string
+	Moods       []string
+	Instruments []string
+}
+
+// Sidecar classifies tracks through the Python genre service running as a long-lived local process, so its models
+// are loaded once rather than for every track. Run starts the process and restarts it whenever it exits.
+type Sidecar struct {
+	// Command starts the service listening on Addr, e.g. python genre-service.py --serve --port 50998
+	Command []string
+	Addr    string
+	// Timeout bounds a single classification and StartupTimeout how long a classification waits for the
+	// service to come up
+	Timeout        time.Duration
+	StartupTimeout time.Duration
+	HTTPClient     *http.Client
+
+	mu sync.Mutex
+	// ready is closed once the running process passes its health check and replaced when it exits
+	ready chan struct{}
+}
+
+// Fake is an in-process GenreClassifier for tests; it returns Result or Err and records the paths it was asked
+// to classify, which Calls returns.
+type Fake struct {
+	Result *Result
+	Err    error
+
+	mu    sync.Mutex
+	calls []string
+}
@@ -0,0 +1,97 @@
+package coverart
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Letterbox detection: a border row or column is dark when its mean luma is below darkMean and no pixel is
+// brighter than darkMax, leaving room for JPEG noise
+const (
+	darkMean = 16
+	darkMax  = 48
+)
+
+// square crops a non-square img, such as a YouTube thumbnail, to its largest centered square after cutting away
+// any black letterbox or pillarbox bars, and scales it down so neither side exceeds maxSize
+func square(img image.Image, maxSize int) *image.RGBA {
+	src := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	r := src.Bounds()
+	if r.Dx() != r.Dy() {
+		r = trimBars(src)
+	}
+	side := min(r.Dx(), r.Dy())
+	x := r.Min.X + (r.Dx()-side)/2
+	y := r.Min.Y + (r.Dy()-side)/2
+	cropped := src.SubImage(image.Rect(x, y, x+side, y+side)).(*image.RGBA)
+	if maxSize <= 0 || side <= maxSize {
+		return cropped
+	}
+	return scale(cropped, maxSize)
+}
+
+// trimBars returns the bounds of img without dark bars along its edges
+func trimBars(img *image.RGBA) image.Rectangle {
+	r := img.Bounds()
+	dark := func(x0, y0, x1, y1 int) bool {
+		var sum, n int
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				l := int(color.GrayModel.Convert(img.RGBAAt(x, y)).(color.Gray).Y)
+				if l > darkMax {
+					return false
+				}
+				sum += l
+				n++
+			}
+		}
+		return n > 0 && sum/n < darkMean
+	}
+	for r.Dy() > 1 && dark(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+1) {
+		r.Min.Y++
+	}
+	for r.Dy() > 1 && dark(r.Min.X, r.Max.Y-1, r.Max.X, r.Max.Y) {
+		r.Max.Y--
+	}
+	for r.Dx() > 1 && dark(r.Min.X, r.Min.Y, r.Min.X+1, r.Max.Y) {
+		r.Min.X++
+	}
+	for r.Dx() > 1 && dark(r.Max.X-1, r.Min.Y, r.Max.X, r.Max.Y) {
+		r.Max.X--
+	}
+	// An image that is dark throughout is kept whole
+	if r.Dx() <= 1 || r.Dy() <= 1 {
+		return img.Bounds()
+	}
+	return r
+}
+
+// scale shrinks the square img to size by size pixels, averaging the source pixels each output pixel covers
+func scale(img *image.RGBA, size int) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0 := b.Min.Y + y*b.Dy()/size
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/size)
+		for x := 0; x < size; x++ {
+			x0 := b.Min.X + x*b.Dx()/size
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/size)
+			var sr, sg, sb, sa, n int
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := img.RGBAAt(sx, sy)
+					sr += int(c.R)
+					sg += int(c.G)
+					sb += int(c.B)
+					sa += int(c.A)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(sr / n), G: uint8(sg / n), B: uint8(sb / n), A: uint8(sa / n)})
+		}
+	}
+	return dst
+}
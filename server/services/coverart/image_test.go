@@ -0,0 +1,105 @@
+package coverart
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+var (
+	black = color.RGBA{A: 255}
+	red   = color.RGBA{R: 255, A: 255}
+	blue  = color.RGBA{B: 255, A: 255}
+	// barNoise is the kind of near-black left in a letterbox bar by JPEG compression
+	barNoise = color.RGBA{R: 40, G: 40, B: 40, A: 255}
+)
+
+func newImage(w, h int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	fill(img, img.Bounds(), c)
+	return img
+}
+
+func fill(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+func TestSquare(t *testing.T) {
+	letterboxed := newImage(160, 90, black)
+	fill(letterboxed, image.Rect(50, 15, 110, 75), red)
+	noisy := newImage(160, 90, black)
+	fill(noisy, image.Rect(30, 5, 130, 85), red)
+	noisy.SetRGBA(3, 2, barNoise)
+	noisy.SetRGBA(150, 88, barNoise)
+	halves := newImage(160, 90, red)
+	fill(halves, image.Rect(80, 0, 160, 90), blue)
+	framed := newImage(100, 100, black)
+	fill(framed, image.Rect(10, 10, 90, 90), red)
+
+	tests := []struct {
+		name     string
+		img      *image.RGBA
+		maxSize  int
+		wantSize int
+		// want lists expected colors at points of the result, relative to its top left corner
+		want map[image.Point]color.RGBA
+	}{
+		{"letterbox and pillarbox", letterboxed, 0, 60, map[image.Point]color.RGBA{{0, 0}: red, {59, 59}: red}},
+		{"bars with compression noise", noisy, 0, 80, map[image.Point]color.RGBA{{0, 0}: red, {79, 79}: red}},
+		{"centered crop", halves, 0, 90, map[image.Point]color.RGBA{{0, 0}: red, {44, 45}: red, {45, 45}: blue, {89, 89}: blue}},
+		{"dark throughout", newImage(160, 90, black), 0, 90, map[image.Point]color.RGBA{{0, 0}: black}},
+		{"square images keep their border", framed, 0, 100, map[image.Point]color.RGBA{{0, 0}: black, {50, 50}: red}},
+		{"scaled down", newImage(200, 200, red), 50, 50, map[image.Point]color.RGBA{{0, 0}: red, {49, 49}: red}},
+		{"not scaled up", newImage(40, 40, red), 50, 40, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := square(tt.img, tt.maxSize)
+			b := got.Bounds()
+			if b.Dx() != tt.wantSize || b.Dy() != tt.wantSize {
+				t.Fatalf("got %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.wantSize, tt.wantSize)
+			}
+			for p, want := range tt.want {
+				if c := got.RGBAAt(b.Min.X+p.X, b.Min.Y+p.Y); c != want {
+					t.Errorf("pixel %v = %v, want %v", p, c, want)
+				}
+			}
+		})
+	}
+}
+
+func TestScale(t *testing.T) {
+	quadrants := newImage(4, 4, red)
+	fill(quadrants, image.Rect(2, 0, 4, 2), blue)
+	fill(quadrants, image.Rect(0, 2, 2, 4), black)
+	checkers := newImage(4, 4, black)
+	for y := range 4 {
+		for x := range 4 {
+			if (x+y)%2 == 0 {
+				checkers.SetRGBA(x, y, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+			}
+		}
+	}
+	gray := color.RGBA{R: 127, G: 127, B: 127, A: 255}
+
+	tests := []struct {
+		name string
+		img  *image.RGBA
+		want [4]color.RGBA
+	}{
+		{"quadrants", quadrants, [4]color.RGBA{red, blue, black, red}},
+		{"averaged", checkers, [4]color.RGBA{gray, gray, gray, gray}},
+	}
+	for _, tt := range tests {
+		got := scale(tt.img, 2)
+		for i, want := range tt.want {
+			if c := got.RGBAAt(i%2, i/2); c != want {
+				t.Errorf("%s: pixel (%d, %d) = %v, want %v", tt.name, i%2, i/2, c, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package coverart
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gcottom/echodaemon/config"
+	"github.com/gcottom/echodaemon/internal/customtags"
+	"github.com/gcottom/echodaemon/logger"
+
+	// YouTube serves video thumbnails as WebP
+	_ "golang.org/x/image/webp"
+)
+
+// maxImageBytes bounds how much of a cover image response is read
+const maxImageBytes = 20 << 20
+
+// Fetch returns the track's cover: the album's cached cover when album names one that was fetched before,
+// otherwise the first of sources that can be downloaded and decoded. It returns nil when there is none; failures
+// are logged rather than returned so a missing cover never fails a track.
+func (s *Service) Fetch(ctx context.Context, album string, sources []Source) *Cover {
+	if album != "" {
+		if cover, err := s.cached(s.cacheKey("album", album)); err == nil {
+			cover.Source = "cache"
+			logger.InfoC(ctx, "using cached album cover", slog.String("album", album))
+			return cover
+		}
+	}
+	for _, source := range sources {
+		cover, err := s.fetch(ctx, source.URL)
+		if err != nil {
+			logger.ErrorC(ctx, "failed to get cover art, trying the next source", slog.String("provider", source.Provider), slog.String("url", source.URL), slog.Any("error", err))
+			continue
+		}
+		cover.Source, cover.URL = source.Provider, source.URL
+		if album != "" && source.AlbumArt {
+			if err = s.store(s.cacheKey("album", album), cover.Data); err != nil {
+				logger.ErrorC(ctx, "failed to cache album cover", slog.Any("error", err))
+			}
+		}
+		return cover
+	}
+	logger.InfoC(ctx, "no cover art available", slog.Int("sources", len(sources)))
+	return nil
+}
+
+// fetch returns the processed image at url, downloading it unless it's cached
+func (s *Service) fetch(ctx context.Context, url string) (*Cover, error) {
+	key := s.cacheKey("url", url)
+	if cover, err := s.cached(key); err == nil {
+		return cover, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	img, _, err := image.Decode(io.LimitReader(resp.Body, maxImageBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode cover art: %w", err)
+	}
+	data, err := s.encode(square(img, s.MaxSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode cover art: %w", err)
+	}
+	if err = s.store(key, data); err != nil {
+		logger.ErrorC(ctx, "failed to cache cover art", slog.Any("error", err))
+	}
+	return s.cover(data)
+}
+
+func (s *Service) encode(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if s.Format == config.CoverFormatPNG {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: s.JPEGQuality})
+	}
+	return buf.Bytes(), err
+}
+
+func (s *Service) cover(data []byte) (*Cover, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return &Cover{Data: data, MIME: "image/" + s.format(), Width: cfg.Width, Height: cfg.Height}, nil
+}
+
+func (s *Service) format() string {
+	if s.Format == config.CoverFormatPNG {
+		return config.CoverFormatPNG
+	}
+	return config.CoverFormatJPEG
+}
+
+// cacheKey names the cache file for id; the processing settings are part of it so changing them refetches covers
+func (s *Service) cacheKey(kind, id string) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\x00%s\x00%d\x00%s\x00%d", kind, id, s.MaxSize, s.format(), s.JPEGQuality))
+	return hex.EncodeToString(sum[:16]) + "." + s.format()
+}
+
+func (s *Service) cached(key string) (*Cover, error) {
+	data, err := os.ReadFile(filepath.Join(s.CacheDir, key))
+	if err != nil {
+		return nil, err
+	}
+	return s.cover(data)
+}
+
+// store writes a cache file through a temporary file so concurrent readers never see it half written
+func (s *Service) store(key string, data []byte) error {
+	if err := os.MkdirAll(s.CacheDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.CacheDir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.CacheDir, key))
+}
+
+// WriteFolderImage saves the cover as folder.jpg (folder.png for PNG covers) in dir and returns its path, or an
+// empty path when the directory already has one.
+func (c *Cover) WriteFolderImage(dir string) (string, error) {
+	name := "folder.jpg"
+	if c.MIME == "image/png" {
+		name = "folder.png"
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err = f.Write(c.Data); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// Picture returns the cover for embedding.
+func (c *Cover) Picture() *customtags.Picture {
+	return &customtags.Picture{Data: c.Data, MIME: c.MIME, Width: c.Width, Height: c.Height}
+}
@@ -0,0 +1,125 @@
+package coverart
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gcottom/echodaemon/config"
+)
+
+// webpThumbnail is a 1x1 lossy WebP image, the format YouTube serves thumbnails in
+const webpThumbnail = "UklGRiIAAABXRUJQVlA4IBYAAAAwAQCdASoBAAEADsD+JaQAA3AAAAAA"
+
+// newTestCovers returns a Service with an empty cache, the root URL of a server with a WebP thumbnail, a 320x180
+// PNG, an undecodable image and nothing else, and the server's hit count by path
+func newTestCovers(t *testing.T) (*Service, string, map[string]int) {
+	t.Helper()
+	thumbnail, err := base64.StdEncoding.DecodeString(webpThumbnail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var album bytes.Buffer
+	if err = png.Encode(&album, newImage(320, 180, red)); err != nil {
+		t.Fatal(err)
+	}
+	hits := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		switch r.URL.Path {
+		case "/thumbnail.webp":
+			w.Write(thumbnail)
+		case "/album.png":
+			w.Write(album.Bytes())
+		case "/broken.jpg":
+			w.Write([]byte("not an image"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	s := &Service{CacheDir: t.TempDir(), Format: config.CoverFormatJPEG, JPEGQuality: 90, HTTPClient: srv.Client()}
+	return s, srv.URL, hits
+}
+
+func TestFetchWebP(t *testing.T) {
+	s, base, hits := newTestCovers(t)
+	sources := []Source{{Provider: "youtube", URL: base + "/thumbnail.webp"}}
+	cover := s.Fetch(context.Background(), "", sources)
+	if cover == nil {
+		t.Fatal("webp thumbnail wasn't decoded")
+	}
+	if cover.MIME != "image/jpeg" || cover.Width != 1 || cover.Height != 1 || cover.Source != "youtube" {
+		t.Errorf("got %s %dx%d from %q", cover.MIME, cover.Width, cover.Height, cover.Source)
+	}
+	// The processed image is cached by URL
+	if s.Fetch(context.Background(), "", sources) == nil || hits["/thumbnail.webp"] != 1 {
+		t.Errorf("thumbnail downloaded %d times, want once", hits["/thumbnail.webp"])
+	}
+}
+
+func TestFetchFallsBack(t *testing.T) {
+	s, base, _ := newTestCovers(t)
+	s.Format, s.MaxSize = config.CoverFormatPNG, 100
+	cover := s.Fetch(context.Background(), "Album", []Source{
+		{Provider: "spotify", URL: base + "/missing.jpg", AlbumArt: true},
+		{Provider: "musicbrainz", URL: base + "/broken.jpg", AlbumArt: true},
+		{Provider: "youtube", URL: base + "/album.png", AlbumArt: true},
+	})
+	if cover == nil {
+		t.Fatal("no cover from the last source")
+	}
+	if cover.Source != "youtube" || cover.MIME != "image/png" || cover.Width != 100 || cover.Height != 100 {
+		t.Errorf("got %s %dx%d from %q, want a 100x100 png from youtube", cover.MIME, cover.Width, cover.Height, cover.Source)
+	}
+	// Album art is reused for the album's other tracks
+	cached := s.Fetch(context.Background(), "Album", nil)
+	if cached == nil || cached.Source != "cache" || !bytes.Equal(cached.Data, cover.Data) {
+		t.Errorf("album cover wasn't cached: %+v", cached)
+	}
+	if s.Fetch(context.Background(), "Other Album", []Source{{URL: base + "/missing.jpg"}}) != nil {
+		t.Error("got a cover with no usable source")
+	}
+}
+
+func TestFetchThumbnailNotCachedForAlbum(t *testing.T) {
+	s, base, _ := newTestCovers(t)
+	if s.Fetch(context.Background(), "Album", []Source{{Provider: "youtube", URL: base + "/thumbnail.webp"}}) == nil {
+		t.Fatal("no cover")
+	}
+	if cover := s.Fetch(context.Background(), "Album", nil); cover != nil {
+		t.Errorf("video thumbnail was cached as the album's cover")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	base := Service{MaxSize: 500, Format: config.CoverFormatJPEG, JPEGQuality: 90}
+	key := base.cacheKey("url", "https://example.com/a.jpg")
+	if key != base.cacheKey("url", "https://example.com/a.jpg") {
+		t.Fatal("cache key isn't stable")
+	}
+	if len(key) != 32+len(".jpeg") || key[32:] != ".jpeg" {
+		t.Errorf("key %q, want 32 hex digits and the format", key)
+	}
+	tests := []struct {
+		name string
+		s    Service
+		kind string
+		id   string
+	}{
+		{"kind", base, "album", "https://example.com/a.jpg"},
+		{"id", base, "url", "https://example.com/b.jpg"},
+		{"size", Service{MaxSize: 600, Format: base.Format, JPEGQuality: 90}, "url", "https://example.com/a.jpg"},
+		{"format", Service{MaxSize: 500, Format: config.CoverFormatPNG, JPEGQuality: 90}, "url", "https://example.com/a.jpg"},
+		{"quality", Service{MaxSize: 500, Format: base.Format, JPEGQuality: 80}, "url", "https://example.com/a.jpg"},
+	}
+	for _, tt := range tests {
+		if tt.s.cacheKey(tt.kind, tt.id) == key {
+			t.Errorf("changing the %s keeps the same cache key", tt.name)
+		}
+	}
+}
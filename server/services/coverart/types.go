@@ -0,0 +1,37 @@
+package coverart
+
+import (
+	"net/http"
+)
+
+// Service fetches cover art, crops it square and scales it down to MaxSize, keeping the processed images in
+// CacheDir by URL and by album so tracks from the same album share one download.
+type Service struct {
+	CacheDir string
+	// MaxSize is the largest width and height of a processed cover in pixels; 0 keeps the original size
+	MaxSize int
+	// Format is config.CoverFormatJPEG or config.CoverFormatPNG
+	Format      string
+	JPEGQuality int
+	HTTPClient  *http.Client
+}
+
+// Source is a cover image URL and the metadata provider that proposed it
+type Source struct {
+	Provider string `json:"provider"`
+	URL      string `json:"url"`
+	// AlbumArt is set when the image is the album's artwork rather than, e.g., a video thumbnail, so it may be
+	// reused for other tracks of the album
+	AlbumArt bool `json:"album_art"`
+}
+
+// Cover is a processed cover image
+type Cover struct {
+	Data   []byte
+	MIME   string
+	Width  int
+	Height int
+	// Source is the provider the image came from, or "cache" for an album's cached cover
+	Source string
+	URL    string
+}
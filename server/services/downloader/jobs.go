@@ -0,0 +1,332 @@
+package downloader
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+var (
+	jobsBucket     = []byte("jobs")
+	playlistBucket = []byte("playlist")
+	playlistRunKey = []byte("run")
+)
+
+// JobStore is a durable, ordered queue of capture jobs backed by a bbolt database.
+type JobStore struct {
+	db *bolt.DB
+}
+
+func OpenJobStore(dir string) (*JobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create job store dir: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "jobs.db"), 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job store: %w", err)
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(jobsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(playlistBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create job store buckets: %w", err)
+	}
+	return &JobStore{db: db}, nil
+}
+
+func (s *JobStore) Close() error {
+	return s.db.Close()
+}
+
+// Create enqueues a new pending job for the given track.
+func (s *JobStore) Create(trackID string) (*Job, error) {
+	var job *Job
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		job = &Job{
+			ID:        strconv.FormatUint(seq, 10),
+			TrackID:   trackID,
+			State:     JobStatePending,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		return putJob(b, job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *JobStore) Get(id string) (*Job, error) {
+	key, err := jobKey(id)
+	if err != nil {
+		return nil, err
+	}
+	var job *Job
+	err = s.db.View(func(tx *bolt.Tx) error {
+		job, err = getJob(tx.Bucket(jobsBucket), key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// List returns every job in the order it was enqueued.
+func (s *JobStore) List() ([]*Job, error) {
+	jobs := make([]*Job, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(_, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			jobs = append(jobs, &job)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Update applies fn to the stored job inside a single transaction and persists the result. A job that reaches a
+// terminal state loses its captured requests, which carry the browser's cookies and auth headers.
+func (s *JobStore) Update(id string, fn func(*Job) error) (*Job, error) {
+	key, err := jobKey(id)
+	if err != nil {
+		return nil, err
+	}
+	var job *Job
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		job, err = getJob(b, key)
+		if err != nil {
+			return err
+		}
+		if err = fn(job); err != nil {
+			return err
+		}
+		if job.Finished() {
+			job.Requests = nil
+		}
+		job.UpdatedAt = time.Now()
+		return putJob(b, job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Pending returns the pending jobs in the order they were enqueued.
+func (s *JobStore) Pending() ([]*Job, error) {
+	jobs, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]*Job, 0)
+	for _, job := range jobs {
+		if job.State == JobStatePending {
+			pending = append(pending, job)
+		}
+	}
+	return pending, nil
+}
+
+func (s *JobStore) Delete(id string) error {
+	key, err := jobKey(id)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		if b.Get(key) == nil {
+			return ErrJobNotFound
+		}
+		return b.Delete(key)
+	})
+}
+
+// RecoverInterrupted moves jobs that were in flight when the daemon stopped back to pending so
+// the worker retries them with their remaining captured requests.
+func (s *JobStore) RecoverInterrupted() (int, error) {
+	count := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			switch job.State {
+			case JobStateReplaying, JobStateConverting, JobStateTagging:
+				job.State = JobStatePending
+			default:
+				continue
+			}
+			job.UpdatedAt = time.Now()
+			if err := putJob(b, &job); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Prune deletes finished jobs last updated before cutoff and returns how many were deleted. The captured requests
+// of newer finished jobs are dropped too, for jobs stored before Update cleared them.
+func (s *JobStore) Prune(cutoff time.Time) (int, error) {
+	var expired [][]byte
+	var stale []*Job
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		// Keys are collected first, since changing a bucket while a cursor walks it can skip entries
+		err := b.ForEach(func(k, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			switch {
+			case !job.Finished():
+			case job.UpdatedAt.Before(cutoff):
+				expired = append(expired, k)
+			case len(job.Requests) > 0:
+				job.Requests = nil
+				stale = append(stale, &job)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, job := range stale {
+			if err = putJob(b, job); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// LoadPlaylistRun returns the most recent playlist run, or nil when none was ever started.
+func (s *JobStore) LoadPlaylistRun() (*PlaylistRun, error) {
+	var run *PlaylistRun
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(playlistBucket).Get(playlistRunKey)
+		if v == nil {
+			return nil
+		}
+		run = new(PlaylistRun)
+		return json.Unmarshal(v, run)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+func (s *JobStore) SavePlaylistRun(run *PlaylistRun) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putPlaylistRun(tx.Bucket(playlistBucket), run)
+	})
+}
+
+// UpdatePlaylistRun applies fn to the stored playlist run inside a single transaction.
+func (s *JobStore) UpdatePlaylistRun(fn func(*PlaylistRun) error) (*PlaylistRun, error) {
+	var run PlaylistRun
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(playlistBucket)
+		v := b.Get(playlistRunKey)
+		if v == nil {
+			return ErrNoPlaylist
+		}
+		if err := json.Unmarshal(v, &run); err != nil {
+			return err
+		}
+		if err := fn(&run); err != nil {
+			return err
+		}
+		run.UpdatedAt = time.Now()
+		return putPlaylistRun(b, &run)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func putPlaylistRun(b *bolt.Bucket, run *PlaylistRun) error {
+	v, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	return b.Put(playlistRunKey, v)
+}
+
+func jobKey(id string) ([]byte, error) {
+	seq, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, ErrJobNotFound
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key, nil
+}
+
+func getJob(b *bolt.Bucket, key []byte) (*Job, error) {
+	v := b.Get(key)
+	if v == nil {
+		return nil, ErrJobNotFound
+	}
+	var job Job
+	if err := json.Unmarshal(v, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func putJob(b *bolt.Bucket, job *Job) error {
+	key, err := jobKey(job.ID)
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, v)
+}
@@ -0,0 +1,79 @@
+package downloader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobStoreDropsRequestsOfFinishedJobs(t *testing.T) {
+	store, err := OpenJobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	job, err := store.Create("track")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Update(job.ID, func(job *Job) error {
+		job.Requests = append(job.Requests, CaptureRequest{URL: "https://example.com", Cookies: "SID=secret"})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ = store.Get(job.ID); len(job.Requests) != 1 {
+		t.Fatalf("pending job has %d requests, want 1", len(job.Requests))
+	}
+	if _, err = store.Update(job.ID, func(job *Job) error {
+		job.State = JobStateSaved
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ = store.Get(job.ID); len(job.Requests) != 0 {
+		t.Errorf("saved job kept %d requests", len(job.Requests))
+	}
+}
+
+func TestJobStorePrune(t *testing.T) {
+	store, err := OpenJobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	states := []JobState{JobStateSaved, JobStateFailed, JobStatePending, JobStateSaved}
+	var ids []string
+	for _, state := range states {
+		job, err := store.Create("track")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = store.Update(job.ID, func(job *Job) error {
+			job.State = state
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+	cutoff := time.Now()
+	// The last job finishes after the cutoff
+	if _, err = store.Update(ids[3], func(*Job) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := store.Prune(cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("pruned %d jobs, want the 2 finished before the cutoff", count)
+	}
+	jobs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != ids[2] || jobs[1].ID != ids[3] {
+		t.Errorf("kept %d jobs, want the pending job and the recently saved one", len(jobs))
+	}
+}
@@ -0,0 +1,124 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gcottom/echodaemon/logger"
+	"github.com/gcottom/echodaemon/services/events"
+)
+
+var (
+	ErrPlaylistRunning = errors.New("a playlist is already running")
+	ErrNoPlaylist      = errors.New("no playlist is running")
+)
+
+// StartPlaylist resolves the playlist's tracks and starts feeding them to the extension one at a time.
+func (s *Service) StartPlaylist(ctx context.Context, playlistID string) (*PlaylistRun, error) {
+	if run, err := s.Jobs.LoadPlaylistRun(); err != nil {
+		return nil, err
+	} else if run != nil && run.State == PlaylistStateRunning {
+		return nil, ErrPlaylistRunning
+	}
+	entries, err := s.MetaServiceClient.GetPlaylistEntries(ctx, playlistID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get playlist entries: %w", err)
+	}
+	tracks := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry != "" {
+			tracks = append(tracks, entry)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("playlist %s has no playable tracks", playlistID)
+	}
+	now := time.Now()
+	run := &PlaylistRun{
+		ID:        playlistID,
+		State:     PlaylistStateRunning,
+		Tracks:    tracks,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	if err = s.Jobs.SavePlaylistRun(run); err != nil {
+		return nil, err
+	}
+	logger.InfoC(ctx, "playlist started", slog.String("playlist", playlistID), slog.Int("tracks", len(tracks)))
+	s.publishPlaylistEvent(run)
+	return run, nil
+}
+
+// CancelPlaylist stops handing out playlist tracks. Jobs that were already captured keep running.
+func (s *Service) CancelPlaylist(ctx context.Context) (*PlaylistRun, error) {
+	run, err := s.Jobs.UpdatePlaylistRun(func(run *PlaylistRun) error {
+		if run.State != PlaylistStateRunning {
+			return ErrNoPlaylist
+		}
+		run.State = PlaylistStateCancelled
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.InfoC(ctx, "playlist cancelled", slog.String("playlist", run.ID))
+	s.publishPlaylistEvent(run)
+	return run, nil
+}
+
+// claimPlaylistJob links a newly started capture to the running playlist when it is the track the playlist asked for.
+func (s *Service) claimPlaylistJob(ctx context.Context, job *Job) {
+	run, err := s.Jobs.UpdatePlaylistRun(func(run *PlaylistRun) error {
+		if run.State != PlaylistStateRunning || run.CurrentJobID != "" || run.CurrentTrack() != job.TrackID {
+			return ErrNoPlaylist
+		}
+		run.CurrentJobID = job.ID
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, ErrNoPlaylist) {
+			logger.ErrorC(ctx, "failed to update playlist", slog.Any("error", err))
+		}
+		return
+	}
+	s.updateJob(ctx, job, func(job *Job) {
+		job.PlaylistID = run.ID
+	})
+	logger.InfoC(ctx, "capture claimed by playlist", slog.String("playlist", run.ID), slog.String("job", job.ID), slog.Int("position", run.Position+1))
+}
+
+// advancePlaylist moves the playlist on to its next track once the job for the current one is finished.
+func (s *Service) advancePlaylist(ctx context.Context, job *Job) {
+	run, err := s.Jobs.UpdatePlaylistRun(func(run *PlaylistRun) error {
+		if run.State != PlaylistStateRunning || run.CurrentJobID != job.ID {
+			return ErrNoPlaylist
+		}
+		run.CurrentJobID = ""
+		run.Done++
+		run.Position++
+		if run.Position >= len(run.Tracks) {
+			run.State = PlaylistStateDone
+		}
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, ErrNoPlaylist) {
+			logger.ErrorC(ctx, "failed to update playlist", slog.Any("error", err))
+		}
+		return
+	}
+	logger.InfoC(ctx, "playlist advanced", slog.String("playlist", run.ID), slog.Int("done", run.Done), slog.Int("total", len(run.Tracks)))
+	s.publishPlaylistEvent(run)
+}
+
+func (s *Service) publishPlaylistEvent(run *PlaylistRun) {
+	s.Events.Publish(events.Event{Type: events.EventPlaylistProgress, TrackID: run.CurrentTrack(), Data: events.PlaylistProgress{
+		PlaylistID: run.ID,
+		State:      string(run.State),
+		TrackCount: len(run.Tracks),
+		TrackDone:  run.Done,
+	}})
+}
@@ -0,0 +1,80 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"time"
+)
+
+// minRateLimitBurst keeps reads from being split into tiny pieces at low rates.
+const minRateLimitBurst = 4096
+
+// rateLimitedReader paces reads with a token bucket filled at roughly rate bytes per second. Each refill varies
+// the rate by up to ±jitter (a fraction of rate) so the download doesn't run at a perfectly steady speed.
+type rateLimitedReader struct {
+	ctx    context.Context
+	r      io.ReadCloser
+	rate   float64
+	jitter float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimitedReader returns r paced to rate bytes per second, or r itself when rate isn't positive. The bucket
+// starts empty so each new response is paced from its first byte.
+func newRateLimitedReader(ctx context.Context, r io.ReadCloser, rate int64, jitter float64) io.ReadCloser {
+	if rate <= 0 {
+		return r
+	}
+	return &rateLimitedReader{
+		ctx:    ctx,
+		r:      r,
+		rate:   float64(rate),
+		jitter: min(max(jitter, 0), 1),
+		burst:  max(float64(rate)/4, minRateLimitBurst),
+		last:   time.Now(),
+	}
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > int(l.burst) {
+		p = p[:int(l.burst)]
+	}
+	if err := l.wait(len(p)); err != nil {
+		return 0, err
+	}
+	n, err := l.r.Read(p)
+	l.tokens -= float64(n)
+	return n, err
+}
+
+func (l *rateLimitedReader) Close() error {
+	return l.r.Close()
+}
+
+// wait blocks until the bucket holds want tokens or the context is cancelled.
+func (l *rateLimitedReader) wait(want int) error {
+	for {
+		l.refill()
+		deficit := float64(want) - l.tokens
+		if deficit <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+		select {
+		case <-l.ctx.Done():
+			timer.Stop()
+			return l.ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (l *rateLimitedReader) refill() {
+	now := time.Now()
+	rate := l.rate * (1 + l.jitter*(2*rand.Float64()-1))
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*rate)
+	l.last = now
+}
@@ -0,0 +1,92 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// zeros is an endless stream
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func (zeros) Close() error { return nil }
+
+func TestRateLimitedReaderRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		jitter float64
+	}{
+		{"steady", 0},
+		{"jittered", 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const rate, size = 200 << 10, 100 << 10
+			start := time.Now()
+			n, err := io.CopyN(io.Discard, newRateLimitedReader(context.Background(), zeros{}, rate, tt.jitter), size)
+			if err != nil || n != size {
+				t.Fatalf("copied %d bytes, %v", n, err)
+			}
+			// The bucket starts empty, so every byte is paid for at the rate; jitter averages out over the refills
+			elapsed := time.Since(start)
+			want := time.Duration(float64(size) / rate * float64(time.Second))
+			if elapsed < want*8/10 || elapsed > want*2 {
+				t.Errorf("read %d bytes in %s, want about %s", size, elapsed, want)
+			}
+		})
+	}
+}
+
+func TestRateLimitedReaderBurst(t *testing.T) {
+	tests := []struct {
+		rate int64
+		want int
+	}{
+		{1000, minRateLimitBurst},
+		{200 << 10, 50 << 10},
+	}
+	for _, tt := range tests {
+		r := newRateLimitedReader(context.Background(), zeros{}, tt.rate, 0).(*rateLimitedReader)
+		// A full bucket lets one burst through without waiting, and no more
+		r.tokens = r.burst
+		start := time.Now()
+		n, err := r.Read(make([]byte, 1<<20))
+		if err != nil || n != tt.want {
+			t.Errorf("rate %d: read %d bytes, %v, want a burst of %d", tt.rate, n, err, tt.want)
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("rate %d: read from a full bucket waited %s", tt.rate, elapsed)
+		}
+	}
+}
+
+func TestRateLimitedReaderUnlimited(t *testing.T) {
+	src := io.NopCloser(bytes.NewReader(nil))
+	for _, rate := range []int64{0, -1} {
+		if r := newRateLimitedReader(context.Background(), src, rate, 0.5); r != src {
+			t.Errorf("rate %d wrapped the reader in %T", rate, r)
+		}
+	}
+}
+
+func TestRateLimitedReaderCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := newRateLimitedReader(ctx, zeros{}, 1000, 0)
+	start := time.Now()
+	_, err := r.Read(make([]byte, 4096))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the context's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled read returned after %s", elapsed)
+	}
+}
@@ -3,14 +3,17 @@ package downloader
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"path/filepath"
@@ -21,62 +24,121 @@ import (
 	"github.com/gcottom/audiometa/v3"
 	"github.com/gcottom/echodaemon/config"
 	"github.com/gcottom/echodaemon/internal"
+	"github.com/gcottom/echodaemon/internal/customtags"
+	"github.com/gcottom/echodaemon/internal/fingerprint"
+	"github.com/gcottom/echodaemon/internal/remux"
 	"github.com/gcottom/echodaemon/internal/ump_parser"
 	"github.com/gcottom/echodaemon/logger"
+	"github.com/gcottom/echodaemon/services/events"
+	"github.com/gcottom/echodaemon/services/lyrics"
+	"github.com/gcottom/echodaemon/services/meta"
 
 	"golang.org/x/text/unicode/norm"
 )
 
-func (s *Service) ConvertFile(ctx context.Context, id string, data []byte) error {
-	convertedData, err := internal.ConvertFile(ctx, data)
-	if err != nil {
-		logger.ErrorC(ctx, "failed to convert file", slog.String("id", id), slog.Any("error", err))
-		return fmt.Errorf("failed to convert file: %w", err)
-	}
-	if err = os.Mkdir(config.AppConfig.TempDir, 0755); err != nil && !os.IsExist(err) {
+// ConvertStream transcodes decoded media read from r into the job's temp file, applying any extra ffmpeg filters.
+func (s *Service) ConvertStream(ctx context.Context, jobID string, r io.Reader, filters ...string) error {
+	if err := os.Mkdir(config.AppConfig.TempDir, 0755); err != nil && !os.IsExist(err) {
 		logger.ErrorC(ctx, "failed to create temp dir", slog.Any("error", err))
 		return fmt.Errorf("failed to create temp dir: %w", err)
 	}
-	savePath := fmt.Sprintf("%s/%s.%s", config.AppConfig.TempDir, id, internal.FILEFORMAT)
-	if err = os.WriteFile(savePath, convertedData, 0644); err != nil {
-		logger.ErrorC(ctx, "failed to write file", slog.String("id", id), slog.Any("error", err))
-		return fmt.Errorf("failed to write file: %w", err)
+	if err := internal.ConvertStream(ctx, r, s.tempPath(jobID), config.AppConfig.Output, filters...); err != nil {
+		logger.ErrorC(ctx, "failed to convert file", slog.String("job", jobID), slog.Any("error", err))
+		return fmt.Errorf("failed to convert file: %w", err)
 	}
 	return nil
 }
 
-func (s *Service) GetMeta(ctx context.Context, id string) ([]byte, error) {
-	return s.MetaServiceClient.AddMeta(ctx, id, fmt.Sprintf("%s/%s.%s", config.AppConfig.TempDir, id, internal.FILEFORMAT))
+// tempPath is where a job's converted audio is written before it's tagged and saved. Like the checkpoint it's keyed
+// by job, so a second capture of a track can't overwrite or remove the file of one that is still being saved.
+func (s *Service) tempPath(jobID string) string {
+	return fmt.Sprintf("%s/job-%s.%s", config.AppConfig.TempDir, jobID, config.AppConfig.Output.Format)
 }
 
-func (s *Service) SaveFile(ctx context.Context, id string, data []byte) error {
+// GetMeta tags the converted audio at path for track id, including extra fields that audiometa can't write.
+// duration is the length of the captured audio in seconds, used to tell apart releases of different lengths.
+func (s *Service) GetMeta(ctx context.Context, id, path string, duration float64, fp *fingerprint.Fingerprint, extra *customtags.Tags) ([]byte, *meta.TrackMeta, error) {
+	return s.MetaServiceClient.AddMeta(ctx, id, path, duration, fp, extra)
+}
+
+// SaveFile writes tagged audio into the save dir and returns the written path, or an empty path
+// when the track is already in the library. Duplicates are found by the track's audio fingerprint; without one
+// the file is saved unchecked.
+func (s *Service) SaveFile(ctx context.Context, id string, data []byte, fp *fingerprint.Fingerprint) (string, error) {
 	reader := bytes.NewReader(data)
 	tag, err := audiometa.OpenTag(reader)
 	if err != nil {
 		logger.ErrorC(ctx, "failed to open tag", slog.String("id", id), slog.Any("error", err))
-		return fmt.Errorf("failed to open tag: %w", err)
+		return "", fmt.Errorf("failed to open tag: %w", err)
 	}
 	if err = os.Mkdir(config.AppConfig.SaveDir, 0755); err != nil && !os.IsExist(err) {
 		logger.ErrorC(ctx, "failed to create save dir", slog.Any("error", err))
-		return fmt.Errorf("failed to create save dir: %w", err)
+		return "", fmt.Errorf("failed to create save dir: %w", err)
 	}
-	logger.InfoC(ctx, "checking if file already exists in library map", slog.String("key", tag.GetTitle()+" - "+tag.GetArtist()))
-	if _, ok := s.LibraryMap.Load(tag.GetTitle() + " - " + tag.GetArtist()); ok {
-		logger.InfoC(ctx, "file already exists in library, skipping", slog.String("id", id), slog.String("key", tag.GetTitle()+" - "+tag.GetArtist()))
-		return nil // File already exists in library map, skip saving
-	}
-	s.LibraryMap.Store(tag.GetTitle()+" - "+tag.GetArtist(), true)
-	savePath := fmt.Sprintf("%s - %s.%s", tag.GetArtist(), tag.GetTitle(), internal.FILEFORMAT)
+	savePath := fmt.Sprintf("%s - %s.%s", tag.GetArtist(), tag.GetTitle(), config.AppConfig.Output.Format)
 	savePath = SanitizeFilename(savePath)
 	savePath = filepath.Join(config.AppConfig.SaveDir, savePath)
-	logger.InfoC(ctx, "Saving file", slog.String("path", savePath), slog.String("id", id))
 	savePath = internal.SanitizePath(savePath)
-	if err = os.WriteFile(savePath, data, 0644); err != nil {
-		logger.ErrorC(ctx, "failed to write file", slog.String("id", id), slog.Any("error", err))
-		return fmt.Errorf("failed to write file: %w", err)
+	write := func() (string, error) {
+		logger.InfoC(ctx, "Saving file", slog.String("path", savePath), slog.String("id", id))
+		path, err := writeNewFile(savePath, data)
+		if err != nil {
+			logger.ErrorC(ctx, "failed to write file", slog.String("id", id), slog.Any("error", err))
+			return "", fmt.Errorf("failed to write file: %w", err)
+		}
+		logger.InfoC(ctx, "File saved successfully", slog.String("path", path), slog.String("id", id))
+		return path, nil
 	}
-	logger.InfoC(ctx, "File saved successfully", slog.String("path", savePath), slog.String("id", id))
-	return nil
+
+	if fp == nil {
+		return write()
+	}
+	logger.InfoC(ctx, "checking if track is already in library", slog.String("id", id))
+	match, savePath, err := s.Library.AddUnlessDuplicate(fp, config.AppConfig.DuplicateSimilarity, write)
+	if match != nil {
+		logger.InfoC(ctx, "track already exists in library, skipping", slog.String("id", id), slog.String("path", match.Entry.Path), slog.Float64("similarity", match.Similarity))
+		return "", nil
+	}
+	if err != nil && savePath != "" {
+		// The file is saved; it just won't be caught as a duplicate of later downloads
+		logger.ErrorC(ctx, "failed to index saved file", slog.String("path", savePath), slog.Any("error", err))
+		return savePath, nil
+	}
+	return savePath, err
+}
+
+// maxSaveSuffix bounds the " (n)" suffixes tried for a save path that's taken
+const maxSaveSuffix = 1000
+
+// writeNewFile writes data to path, or to "path (2)", "path (3)" and so on before the extension when the file exists,
+// so a different recording with the same artist and title never overwrites a saved track. It returns the path written.
+func writeNewFile(path string, data []byte) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for n := 1; n <= maxSaveSuffix; n++ {
+		name := path
+		if n > 1 {
+			name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err = f.Write(data); err != nil {
+			_ = f.Close()
+			_ = os.Remove(name)
+			return "", err
+		}
+		if err = f.Close(); err != nil {
+			_ = os.Remove(name)
+			return "", err
+		}
+		return name, nil
+	}
+	return "", fmt.Errorf("%s and its first %d numbered variants already exist", path, maxSaveSuffix)
 }
 
 func SanitizeFilename(name string) string {
@@ -182,8 +244,9 @@ func truncateBytes(s string, n int) string {
 	return buf.String()
 }
 
-func (s *Service) Cleanup(ctx context.Context, id string) {
-	_ = os.Remove(fmt.Sprintf("%s/%s.%s", config.AppConfig.TempDir, id, internal.FILEFORMAT))
+// Cleanup removes a job's temp file at path.
+func (s *Service) Cleanup(ctx context.Context, path string) {
+	_ = os.Remove(path)
 }
 
 func (s *Service) NewCapture(ctx context.Context, id string) {
@@ -201,79 +264,611 @@ func (s *Service) ContinueCapture(ctx context.Context, req CaptureRequest) {
 	s.CaptureChannel <- capData
 }
 
+// ActiveJobID returns the job that incoming capture requests are currently attributed to.
+func (s *Service) ActiveJobID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.activeJobID
+}
+
+func (s *Service) setActiveJobID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activeJobID = id
+}
+
+// CaptureProcessor turns capture events from the extension into persisted jobs and hands them to the job worker.
 func (s *Service) CaptureProcessor(ctx context.Context) {
-	id := ""
-	replaySuccess := false
+	if count, err := s.Jobs.RecoverInterrupted(); err != nil {
+		logger.ErrorC(ctx, "failed to recover interrupted jobs", slog.Any("error", err))
+	} else if count > 0 {
+		logger.InfoC(ctx, "requeued jobs interrupted by restart", slog.Int("count", count))
+	}
+	s.wake = make(chan struct{}, 1)
+	go s.JobWorker(ctx)
+
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case req := <-s.CaptureChannel:
 			if req.IsStart {
-				logger.InfoC(ctx, "new capture started")
-				id = req.TrackID
-				logger.InfoC(ctx, "Capture track id", slog.String("id", id))
-				s.CurrentCapture = &CurrentCapture{ID: id, Data: make([]byte, 0)}
-				replaySuccess = false
-			} else {
-				if !replaySuccess {
-					if id == "" {
-						logger.ErrorC(ctx, "no current capture ID found")
-						continue
-					}
-					s.CurrentCapture.Requests = append(s.CurrentCapture.Requests, *req.CaptureRequest)
-					if len(s.CurrentCapture.Requests)%2 == 0 {
-						logger.InfoC(ctx, "skipping even numbered request")
-						continue
-					}
-					logger.InfoC(ctx, "attempting to replay request", slog.Int("requestNumber", len(s.CurrentCapture.Requests)))
-					bod, err := ReplayCapture(ctx, *req.CaptureRequest, s.CurrentCapture.ID)
-					if err != nil {
-						logger.ErrorC(ctx, "error replaying request", slog.Any("error", err))
-						continue
-					}
-					if len(bod) < MinimumDownloadSize {
-						logger.InfoC(ctx, "replayed data too small, attempting to retry download with next request", slog.Int("length", len(bod)))
-						continue
-					}
-					replaySuccess = true
-					// Only use the single replayed buffer, no overlap merging
-					s.CurrentCapture.Data = bod
-					logger.InfoC(ctx, "Captured data length", slog.Int("length", len(bod)))
-
-					go func(id string, data []byte) {
-						joinedData, err := internal.ConvertFile(ctx, data)
-						if err != nil {
-							logger.ErrorC(ctx, "error joining data for captured audio", slog.Any("error", err))
-							return
-						}
-						savePath := fmt.Sprintf("%s/%s.%s", config.AppConfig.TempDir, id, internal.FILEFORMAT)
-						if err = os.WriteFile(savePath, joinedData, 0644); err != nil {
-							logger.ErrorC(ctx, "failed to write file", slog.String("id", id), slog.Any("error", err))
-							return
-						}
-						metaedData, err := s.GetMeta(ctx, id)
-						if err != nil {
-							logger.ErrorC(ctx, "error getting meta", slog.Any("error", err))
-							return
-						}
-						if err := s.SaveFile(ctx, id, metaedData); err != nil {
-							logger.ErrorC(ctx, "error saving file", slog.Any("error", err))
-							return
-						}
-					}(s.CurrentCapture.ID, s.CurrentCapture.Data)
+				job, err := s.Jobs.Create(req.TrackID)
+				if err != nil {
+					logger.ErrorC(ctx, "failed to create capture job", slog.String("id", req.TrackID), slog.Any("error", err))
+					continue
 				}
+				s.setActiveJobID(job.ID)
+				s.claimPlaylistJob(ctx, job)
+				logger.InfoC(ctx, "new capture started", slog.String("id", job.TrackID), slog.String("job", job.ID))
+				s.Events.Publish(events.Event{Type: events.EventCaptureStarted, JobID: job.ID, TrackID: job.TrackID})
+				s.wakeWorker()
+				continue
 			}
-		default:
-			time.Sleep(100 * time.Millisecond)
+			activeID := s.ActiveJobID()
+			if activeID == "" {
+				logger.ErrorC(ctx, "no current capture ID found")
+				continue
+			}
+			if _, err := s.Jobs.Update(activeID, func(job *Job) error {
+				// Once a replay succeeded the remaining requests for this track are no longer needed
+				if job.State == JobStatePending || job.State == JobStateReplaying {
+					job.Requests = append(job.Requests, *req.CaptureRequest)
+				}
+				return nil
+			}); err != nil {
+				logger.ErrorC(ctx, "failed to store capture request", slog.String("job", activeID), slog.Any("error", err))
+				continue
+			}
+			s.wakeWorker()
+		}
+	}
+}
+
+func (s *Service) wakeWorker() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// JobWorker replays pending jobs one at a time, oldest first, so only a single download is in flight. Finished
+// jobs are pruned once they're older than JobRetention.
+func (s *Service) JobWorker(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(jobPruneInterval)
+	defer pruneTicker.Stop()
+	s.pruneJobs(ctx)
+	for {
+		for job := s.nextRunnableJob(ctx); job != nil; job = s.nextRunnableJob(ctx) {
+			s.replayJob(ctx, job)
 		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		case <-pruneTicker.C:
+			s.pruneJobs(ctx)
+		}
+	}
+}
+
+func (s *Service) pruneJobs(ctx context.Context) {
+	count, err := s.Jobs.Prune(time.Now().Add(-JobRetention))
+	if err != nil {
+		logger.ErrorC(ctx, "failed to prune finished jobs", slog.Any("error", err))
+		return
+	}
+	if count > 0 {
+		logger.InfoC(ctx, "pruned finished jobs", slog.Int("count", count))
 	}
 }
 
-func ReplayCapture(ctx context.Context, capReq CaptureRequest, id string) ([]byte, error) {
+func (s *Service) nextRunnableJob(ctx context.Context) *Job {
+	pending, err := s.Jobs.Pending()
+	if err != nil {
+		logger.ErrorC(ctx, "failed to list pending jobs", slog.Any("error", err))
+		return nil
+	}
+	activeID := s.ActiveJobID()
+	for _, job := range pending {
+		if job.Attempts < len(job.Requests) {
+			return job
+		}
+		// The browser has moved on, so no further requests will arrive for this job
+		if job.ID != activeID {
+			reason := "no replayable capture requests"
+			if job.Error != "" {
+				reason = fmt.Sprintf("%s: %s", reason, job.Error)
+			}
+			s.failJob(ctx, job, errors.New(reason))
+		}
+	}
+	return nil
+}
+
+func (s *Service) replayJob(ctx context.Context, job *Job) {
+	requestNumber := job.Attempts + 1
+	req := job.Requests[job.Attempts]
+	job, err := s.Jobs.Update(job.ID, func(job *Job) error {
+		job.Attempts++
+		if requestNumber%2 != 0 {
+			job.State = JobStateReplaying
+		}
+		return nil
+	})
+	if err != nil {
+		logger.ErrorC(ctx, "failed to update job", slog.Any("error", err))
+		return
+	}
+	if requestNumber%2 == 0 {
+		logger.InfoC(ctx, "skipping even numbered request", slog.String("job", job.ID))
+		return
+	}
+	ctx, cancel := s.trackJob(ctx, job.ID)
+	logger.InfoC(ctx, "attempting to replay request", slog.String("job", job.ID), slog.Int("requestNumber", requestNumber))
+	s.publishJobEvent(job, events.EventReplayAttempt, events.ReplayAttempt{Attempt: requestNumber})
+	n, err := s.downloadToCheckpoint(ctx, job, req)
+	if err == nil && n < MinimumDownloadSize {
+		logger.InfoC(ctx, "replayed data too small, attempting to retry download with next request", slog.Int64("length", n))
+		err = fmt.Errorf("replayed data too small (%d bytes)", n)
+		s.removeCheckpoint(job.ID)
+	}
+	if err != nil {
+		s.untrackJob(job.ID)
+		cancel()
+		logger.ErrorC(ctx, "error replaying request", slog.String("job", job.ID), slog.Int64("checkpoint", n), slog.Any("error", err))
+		s.requeueJob(ctx, job, err)
+		return
+	}
+	s.setJobState(ctx, job, JobStateConverting)
+	job.Loudness, err = s.convertCheckpoint(ctx, job)
+	if err == nil {
+		err = s.verifyDuration(ctx, job, req)
+	}
+	if err == nil {
+		job.Trim, err = s.trimSilence(ctx, job)
+	}
+	// The downloaded media is used up either way; a bad conversion has to start from a fresh download
+	s.removeCheckpoint(job.ID)
+	if err != nil {
+		s.untrackJob(job.ID)
+		cancel()
+		s.Cleanup(ctx, s.tempPath(job.ID))
+		logger.ErrorC(ctx, "error converting replayed media", slog.String("job", job.ID), slog.Any("error", err))
+		s.requeueJob(ctx, job, err)
+		return
+	}
+	if job.Loudness == nil {
+		job.Loudness = s.measureLoudness(ctx, job)
+	}
+	s.updateJob(ctx, job, func(stored *Job) {
+		stored.Trim = job.Trim
+		stored.Loudness = job.Loudness
+	})
+	logger.InfoC(ctx, "Captured data length", slog.Int64("length", n))
+	s.publishJobEvent(job, events.EventConversionDone, nil)
+	s.setJobState(ctx, job, JobStateTagging)
+	go func() {
+		defer cancel()
+		defer s.untrackJob(job.ID)
+		s.finishJob(ctx, job)
+	}()
+}
+
+// downloadToCheckpoint replays req into the job's checkpoint file in the temp dir and returns the checkpoint
+// size. Media written by an earlier interrupted attempt is kept and the download resumes after it when req
+// describes the same media object.
+func (s *Service) downloadToCheckpoint(ctx context.Context, job *Job, req CaptureRequest) (int64, error) {
+	if err := os.Mkdir(config.AppConfig.TempDir, 0755); err != nil && !os.IsExist(err) {
+		return 0, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	f, err := os.OpenFile(s.checkpointPath(job.ID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat checkpoint: %w", err)
+	}
+	offset := info.Size()
+	if contentLength := capturedContentLength(req.URL); offset > 0 && (contentLength == 0 || contentLength != job.BytesTotal) {
+		logger.InfoC(ctx, "captured request can't resume checkpoint, restarting download", slog.String("job", job.ID), slog.Int64("checkpoint", offset))
+		if err = f.Truncate(0); err != nil {
+			return 0, fmt.Errorf("failed to reset checkpoint: %w", err)
+		}
+		offset = 0
+	} else if offset > 0 {
+		logger.InfoC(ctx, "resuming download from checkpoint", slog.String("job", job.ID), slog.Int64("offset", offset), slog.Int64("total", contentLength))
+	}
+	if contentLength := capturedContentLength(req.URL); contentLength > 0 {
+		// Record the object size up front so an attempt interrupted before its first progress update can resume
+		s.updateJob(ctx, job, func(job *Job) {
+			job.BytesReceived = offset
+			job.BytesTotal = contentLength
+		})
+	}
+	n, err := ReplayCapture(ctx, req, job.TrackID, f, offset, func(p ReplayProgress) {
+		s.updateJob(ctx, job, func(job *Job) {
+			job.BytesReceived = p.BytesReceived
+			job.BytesTotal = p.BytesTotal
+			job.ETASeconds = p.ETASeconds
+		})
+		s.publishJobEvent(job, events.EventProgress, events.Progress{BytesReceived: p.BytesReceived, BytesTotal: p.BytesTotal, ETASeconds: p.ETASeconds})
+	})
+	if err != nil {
+		return offset + n, err
+	}
+	if err = f.Sync(); err != nil {
+		return offset + n, fmt.Errorf("failed to flush checkpoint: %w", err)
+	}
+	return offset + n, nil
+}
+
+// convertCheckpoint transcodes a fully downloaded checkpoint into the job's temp file. Opus output is remuxed in
+// process when the checkpoint is WebM/Opus, falling back to an ffmpeg stream copy otherwise. When loudness
+// normalization is enabled for a re-encoded format, the checkpoint is measured first and the returned measurement
+// is the one the track was normalized with.
+func (s *Service) convertCheckpoint(ctx context.Context, job *Job) (*internal.Loudness, error) {
+	output := config.AppConfig.Output
+	if output.Remuxes() {
+		err := s.remuxCheckpoint(job)
+		if err == nil {
+			logger.InfoC(ctx, "remuxed opus audio without ffmpeg", slog.String("job", job.ID))
+			return nil, nil
+		}
+		logger.InfoC(ctx, "falling back to ffmpeg for remux", slog.String("job", job.ID), slog.Any("reason", err))
+	}
+	var filters []string
+	var measured *internal.Loudness
+	if loudness := config.AppConfig.Loudness; loudness.Mode == config.LoudnessNormalize && !output.Remuxes() {
+		l, err := internal.AnalyzeLoudness(ctx, s.checkpointPath(job.ID), loudness)
+		if err != nil {
+			logger.ErrorC(ctx, "loudness analysis failed, converting without normalization", slog.String("job", job.ID), slog.Any("error", err))
+		} else {
+			logger.InfoC(ctx, "normalizing loudness", slog.String("job", job.ID), slog.Float64("measured_lufs", l.IntegratedLUFS), slog.Float64("target_lufs", loudness.TargetLUFS))
+			l.Normalized = true
+			measured = l
+			filters = append(filters, internal.LoudnormFilter(loudness, l))
+		}
+	}
+	f, err := os.Open(s.checkpointPath(job.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+	defer f.Close()
+	return measured, s.ConvertStream(ctx, job.ID, f, filters...)
+}
+
+// trimSilence cuts leading and trailing silence from the converted track when trimming is enabled and returns
+// the span that was kept. Only a track that is silent throughout fails the job; any other problem leaves the track
+// untrimmed.
+func (s *Service) trimSilence(ctx context.Context, job *Job) (*internal.Trim, error) {
+	if !config.AppConfig.Trim.Enabled {
+		return nil, nil
+	}
+	path := s.tempPath(job.ID)
+	trim, err := internal.DetectTrim(ctx, path, config.AppConfig.Trim)
+	if errors.Is(err, internal.ErrSilent) {
+		return nil, err
+	}
+	if err != nil {
+		logger.ErrorC(ctx, "silence detection failed, saving untrimmed", slog.String("job", job.ID), slog.Any("error", err))
+		return nil, nil
+	}
+	if trim == nil {
+		return nil, nil
+	}
+	if err = internal.TrimFile(ctx, path, trim, config.AppConfig.Output); err != nil {
+		logger.ErrorC(ctx, "trimming failed, saving untrimmed", slog.String("job", job.ID), slog.Any("error", err))
+		return nil, nil
+	}
+	logger.InfoC(ctx, "trimmed silence", slog.String("job", job.ID), slog.Float64("start", trim.Start), slog.Float64("end", trim.End), slog.Float64("original", trim.Original))
+	return trim, nil
+}
+
+// measureLoudness measures the converted track so it can be tagged with its gain. A failed measurement only
+// means the track is saved without gain tags.
+func (s *Service) measureLoudness(ctx context.Context, job *Job) *internal.Loudness {
+	loudness := config.AppConfig.Loudness
+	if loudness.Mode == config.LoudnessOff || (loudness.Mode == config.LoudnessNormalize && !config.AppConfig.Output.Remuxes()) {
+		return nil
+	}
+	l, err := internal.AnalyzeLoudness(ctx, s.tempPath(job.ID), loudness)
+	if err != nil {
+		logger.ErrorC(ctx, "loudness analysis failed, saving without gain tags", slog.String("job", job.ID), slog.Any("error", err))
+		return nil
+	}
+	logger.InfoC(ctx, "measured loudness", slog.String("job", job.ID), slog.Float64("integrated_lufs", l.IntegratedLUFS), slog.Float64("true_peak_dbtp", l.TruePeakDBTP))
+	return l
+}
+
+// sourceDuration returns the length in seconds of the audio as captured, before any silence was trimmed: the dur
+// parameter of the replayed request when it has one, otherwise the measured length. It returns 0 when unknown.
+func (s *Service) sourceDuration(job *Job, fp *fingerprint.Fingerprint) float64 {
+	if job.Attempts > 0 && job.Attempts <= len(job.Requests) {
+		if d := capturedDuration(job.Requests[job.Attempts-1].URL); d > 0 {
+			return d.Seconds()
+		}
+	}
+	if job.Trim != nil {
+		return job.Trim.Original
+	}
+	if fp != nil {
+		return fp.Duration
+	}
+	return 0
+}
+
+// findLyrics looks up lyrics for the chosen metadata, lined up with the saved audio. A failed lookup only means the
+// track is saved without lyrics.
+func (s *Service) findLyrics(ctx context.Context, job *Job, trackMeta *meta.TrackMeta, fp *fingerprint.Fingerprint) (*lyrics.Lyrics, lyrics.Track) {
+	track := lyrics.Track{Title: trackMeta.Title, Artist: trackMeta.Artist, Album: trackMeta.Album, Duration: trackMeta.Duration}
+	if track.Duration == 0 {
+		track.Duration = s.sourceDuration(job, fp)
+	}
+	if s.Lyrics == nil {
+		return nil, track
+	}
+	lyr, err := s.Lyrics.Find(ctx, track)
+	if err != nil {
+		logger.ErrorC(ctx, "lyrics lookup failed, saving without lyrics", slog.String("job", job.ID), slog.Any("error", err))
+		return nil, track
+	}
+	if lyr == nil {
+		logger.InfoC(ctx, "no lyrics found", slog.String("job", job.ID))
+		return nil, track
+	}
+	logger.InfoC(ctx, "found lyrics", slog.String("job", job.ID), slog.Bool("synced", len(lyr.Synced) > 0), slog.Bool("instrumental", lyr.Instrumental))
+	// Synced lyrics are timed against the untrimmed track
+	if job.Trim != nil {
+		lyr.Shift(-time.Duration(job.Trim.Start * float64(time.Second)))
+	}
+	return lyr, track
+}
+
+// writeLyricsSidecar writes the synced lyrics to a .lrc file next to the saved track.
+func (s *Service) writeLyricsSidecar(ctx context.Context, savePath string, lyr *lyrics.Lyrics, track lyrics.Track) {
+	lrc := lyr.LRC(track)
+	if lrc == "" {
+		return
+	}
+	lrcPath := strings.TrimSuffix(savePath, filepath.Ext(savePath)) + ".lrc"
+	if err := os.WriteFile(lrcPath, []byte(lrc), 0644); err != nil {
+		logger.ErrorC(ctx, "failed to write lyrics file", slog.String("path", lrcPath), slog.Any("error", err))
+		return
+	}
+	logger.InfoC(ctx, "lyrics file saved", slog.String("path", lrcPath))
+}
+
+// extraTags returns the job's tag fields that audiometa can't write itself.
+func (s *Service) extraTags(job *Job) *customtags.Tags {
+	tags := &customtags.Tags{Fields: make(map[string]string)}
+	if job.Loudness != nil && !job.Loudness.Normalized {
+		maps.Copy(tags.Fields, job.Loudness.GainFields(config.AppConfig.Output, config.AppConfig.Loudness.TargetLUFS))
+	}
+	return tags
+}
+
+// remuxCheckpoint rewraps the checkpoint's WebM/Opus audio into an Ogg container in the job's temp file.
+func (s *Service) remuxCheckpoint(job *Job) error {
+	in, err := os.Open(s.checkpointPath(job.ID))
+	if err != nil {
+		return fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+	defer in.Close()
+	path := s.tempPath(job.ID)
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create remux output: %w", err)
+	}
+	if err = remux.WebMOpusToOgg(in, out); err != nil {
+		_ = out.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	return out.Close()
+}
+
+// checkpointPath is where a job's decoded media is written while it downloads. It's keyed by job rather than
+// track so that two captures of the same track don't share a checkpoint.
+func (s *Service) checkpointPath(jobID string) string {
+	return fmt.Sprintf("%s/job-%s.part", config.AppConfig.TempDir, jobID)
+}
+
+func (s *Service) removeCheckpoint(jobID string) {
+	_ = os.Remove(s.checkpointPath(jobID))
+}
+
+// verifyDuration compares the converted audio with the track length the captured request announced, so a
+// download that was cut short is retried instead of being saved.
+func (s *Service) verifyDuration(ctx context.Context, job *Job, req CaptureRequest) error {
+	expected := capturedDuration(req.URL)
+	if expected == 0 {
+		logger.InfoC(ctx, "captured request has no duration, skipping completeness check", slog.String("job", job.ID))
+		return nil
+	}
+	actual, err := internal.ProbeDuration(ctx, s.tempPath(job.ID))
+	if err != nil {
+		return fmt.Errorf("failed to probe converted audio: %w", err)
+	}
+	logger.InfoC(ctx, "probed converted audio", slog.String("job", job.ID), slog.Duration("expected", expected), slog.Duration("actual", actual))
+	if actual < expected-DurationTolerance {
+		return fmt.Errorf("replayed audio is truncated (%s of %s)", actual.Truncate(time.Second), expected.Truncate(time.Second))
+	}
+	return nil
+}
+
+// capturedDuration returns the track length from a captured request's dur parameter, or 0 when it has none.
+func capturedDuration(rawURL string) time.Duration {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(u.Query().Get("dur"), 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// capturedContentLength returns the media object size from a captured request's clen parameter, or 0 when it
+// has none.
+func capturedContentLength(rawURL string) int64 {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.ParseInt(u.Query().Get("clen"), 10, 64)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
+
+// trackJob derives a context for a running job that CancelJob can cancel.
+func (s *Service) trackJob(ctx context.Context, id string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running == nil {
+		s.running = make(map[string]context.CancelFunc)
+	}
+	s.running[id] = cancel
+	return ctx, cancel
+}
+
+func (s *Service) untrackJob(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, id)
+}
+
+// CancelJob stops any in-flight work for the job and removes it from the store.
+func (s *Service) CancelJob(ctx context.Context, id string) error {
+	s.mu.Lock()
+	if cancel, ok := s.running[id]; ok {
+		cancel()
+		delete(s.running, id)
+	}
+	if s.activeJobID == id {
+		s.activeJobID = ""
+	}
+	s.mu.Unlock()
+	if err := s.Jobs.Delete(id); err != nil {
+		return err
+	}
+	s.removeCheckpoint(id)
+	logger.InfoC(ctx, "job deleted", slog.String("job", id))
+	s.advancePlaylist(ctx, &Job{ID: id})
+	return nil
+}
+
+// finishJob tags and saves converted audio; it runs concurrently with the next replay.
+func (s *Service) finishJob(ctx context.Context, job *Job) {
+	path := s.tempPath(job.ID)
+	defer s.Cleanup(ctx, path)
+	fp, err := fingerprint.FromFile(ctx, path)
+	if err != nil {
+		logger.ErrorC(ctx, "failed to fingerprint track, saving without duplicate check", slog.String("job", job.ID), slog.Any("error", err))
+	}
+	metaedData, trackMeta, err := s.GetMeta(ctx, job.TrackID, path, s.sourceDuration(job, fp), fp, s.extraTags(job))
+	if err != nil {
+		logger.ErrorC(ctx, "error getting meta", slog.Any("error", err))
+		s.failJob(ctx, job, err)
+		return
+	}
+	lyr, track := s.findLyrics(ctx, job, trackMeta, fp)
+	if lyr != nil {
+		if tagged, err := customtags.Write(metaedData, lyr.Tags()); err != nil {
+			logger.ErrorC(ctx, "failed to embed lyrics, saving without", slog.String("job", job.ID), slog.Any("error", err))
+		} else {
+			metaedData = tagged
+			trackMeta.Sources["lyrics"] = "lrclib"
+		}
+	}
+	s.publishJobEvent(job, events.EventMetadataChosen, trackMeta)
+	savePath, err := s.SaveFile(ctx, job.TrackID, metaedData, fp)
+	if err != nil {
+		logger.ErrorC(ctx, "error saving file", slog.Any("error", err))
+		s.failJob(ctx, job, err)
+		return
+	}
+	if lyr != nil && savePath != "" && config.AppConfig.Lyrics.Sidecar {
+		s.writeLyricsSidecar(ctx, savePath, lyr, track)
+	}
+	if trackMeta.CoverArt != nil && savePath != "" && config.AppConfig.CoverArt.FolderImage {
+		if path, err := trackMeta.CoverArt.WriteFolderImage(filepath.Dir(savePath)); err != nil {
+			logger.ErrorC(ctx, "failed to write folder image", slog.String("job", job.ID), slog.Any("error", err))
+		} else if path != "" {
+			logger.InfoC(ctx, "folder image saved", slog.String("path", path))
+		}
+	}
+	s.updateJob(ctx, job, func(job *Job) {
+		job.State = JobStateSaved
+		job.SavePath = savePath
+		job.MetaSources = trackMeta.Sources
+		job.ETASeconds = 0
+		job.Error = ""
+	})
+	s.publishJobEvent(job, events.EventFileSaved, events.FileSaved{Path: savePath})
+	s.advancePlaylist(ctx, job)
+}
+
+func (s *Service) publishJobEvent(job *Job, eventType events.EventType, data any) {
+	s.Events.Publish(events.Event{Type: eventType, JobID: job.ID, TrackID: job.TrackID, Data: data})
+}
+
+// updateJob persists fn's changes to the job. Jobs deleted while in flight are ignored.
+func (s *Service) updateJob(ctx context.Context, job *Job, fn func(*Job)) {
+	if _, err := s.Jobs.Update(job.ID, func(job *Job) error {
+		fn(job)
+		return nil
+	}); err != nil && !errors.Is(err, ErrJobNotFound) {
+		logger.ErrorC(ctx, "failed to update job", slog.String("job", job.ID), slog.Any("error", err))
+	}
+}
+
+func (s *Service) setJobState(ctx context.Context, job *Job, state JobState) {
+	s.updateJob(ctx, job, func(job *Job) {
+		job.State = state
+	})
+}
+
+// requeueJob returns a job to pending so the worker retries it with its next captured request.
+func (s *Service) requeueJob(ctx context.Context, job *Job, cause error) {
+	s.updateJob(ctx, job, func(job *Job) {
+		job.State = JobStatePending
+		job.ETASeconds = 0
+		job.Error = cause.Error()
+	})
+}
+
+func (s *Service) failJob(ctx context.Context, job *Job, cause error) {
+	logger.ErrorC(ctx, "capture job failed", slog.String("job", job.ID), slog.String("id", job.TrackID), slog.Any("error", cause))
+	s.updateJob(ctx, job, func(job *Job) {
+		job.State = JobStateFailed
+		job.ETASeconds = 0
+		job.Error = cause.Error()
+	})
+	s.removeCheckpoint(job.ID)
+	s.publishJobEvent(job, events.EventJobFailed, events.JobFailed{Error: cause.Error()})
+	s.advancePlaylist(ctx, job)
+}
+
+// ReplayCapture re-issues a captured googlevideo request and writes the decoded media from byte offset of the
+// media object onwards into w, returning the number of media bytes written. When the request carries the object
+// size (clen) the media is fetched in ReplayChunkSize ranges, so an interrupted download can later be resumed from
+// the last byte written. onProgress, when non-nil, is called periodically while the download is running.
+func ReplayCapture(ctx context.Context, capReq CaptureRequest, id string, w io.Writer, offset int64, onProgress func(ReplayProgress)) (int64, error) {
 	logger.InfoC(ctx, "replaying capture request", slog.String("url", capReq.URL))
 	if u, err := url.Parse(capReq.URL); err == nil && u.Scheme != "" && u.Host != "" {
 		if strings.Contains(u.Host, "googlevideo.com") {
 			q := u.Query()
-			// Many sabr/ump links include transient range params for partial fetches; remove to fetch full object
+			// Captured links carry the range the player asked for; ranges are rebuilt below to fetch the full object
 			q.Del("range")
 			q.Del("rn")
 			q.Del("rbuf")
@@ -281,20 +876,31 @@ func ReplayCapture(ctx context.Context, capReq CaptureRequest, id string) ([]byt
 			expireStr := q.Get("expire")
 			if expireStr == "" {
 				logger.ErrorC(ctx, "missing expire param")
-				return nil, fmt.Errorf("missing expire param")
+				return 0, fmt.Errorf("missing expire param")
 			}
 			expireUnix, err := strconv.ParseInt(expireStr, 10, 64)
 			if err != nil {
 				logger.ErrorC(ctx, "failed to parse expire param", slog.Any("error", err), slog.String("expire", expireStr))
-				return nil, fmt.Errorf("invalid expire param: %w", err)
+				return 0, fmt.Errorf("invalid expire param: %w", err)
 			}
 			totalLength := q.Get("dur")
 			totalLengthVal, err := strconv.ParseFloat(totalLength, 32)
 			if err != nil {
 				logger.ErrorC(ctx, "failed to parse total length", slog.Any("error", err), slog.String("totalLength", totalLength))
-				return nil, fmt.Errorf("invalid total length: %w", err)
+				return 0, fmt.Errorf("invalid total length: %w", err)
+			}
+			contentLength := capturedContentLength(capReq.URL)
+			if contentLength == 0 && offset > 0 {
+				return 0, fmt.Errorf("can't resume a download without a content length")
 			}
 			estDownloadTimeRemaining := int(totalLengthVal / 2)
+			if contentLength > 0 {
+				estDownloadTimeRemaining = int(float64(estDownloadTimeRemaining) * float64(contentLength-offset) / float64(contentLength))
+				// A configured rate limit slower than the server's own pacing sets the download time instead
+				if rate := config.AppConfig.DownloadRateLimit; rate > 0 {
+					estDownloadTimeRemaining = max(estDownloadTimeRemaining, int((contentLength-offset)/rate))
+				}
+			}
 
 			// Round up estDownloadTimeRemaining to the next multiple of downloadTimeRoundingInterval.
 			// This ensures the estimated time aligns with expected intervals (e.g., for UI updates or protocol requirements).
@@ -305,52 +911,151 @@ func ReplayCapture(ctx context.Context, capReq CaptureRequest, id string) ([]byt
 
 			expiryTime := time.Unix(expireUnix, 0)
 			remaining := time.Until(expiryTime)
-			const minLifetime = 30 * time.Second
-			if remaining <= minLifetime {
+			if remaining <= minTokenLifetime {
 				logger.ErrorC(ctx, "insufficient token life remaining", slog.Int64("expire_unix", expireUnix), slog.Time("expiry_time", expiryTime), slog.Duration("remaining", remaining))
-				return nil, fmt.Errorf("insufficient token life remaining (%s)", remaining)
+				return 0, fmt.Errorf("insufficient token life remaining (%s)", remaining)
 			}
-			done := false
-			defer func() {
-				done = true
-			}()
-			// Update query (after cleaning transient params)
-			u.RawQuery = q.Encode()
+			progress := new(DownloadProgress)
+			// clen is the size of the media object, so progress against it counts decoded media rather than the UMP
+			// bytes on the wire, which also carry part headers and discarded streams
+			media := new(atomic.Int64)
+			w = &countingWriter{w: w, n: media}
+			snapshot := func(eta int) ReplayProgress {
+				if contentLength > 0 {
+					return ReplayProgress{BytesReceived: offset + media.Load(), BytesTotal: contentLength, ETASeconds: eta}
+				}
+				return ReplayProgress{BytesReceived: progress.Received.Load(), BytesTotal: progress.Total.Load(), ETASeconds: eta}
+			}
+			done := make(chan struct{})
+			defer close(done)
 			go func() {
 				startTime := time.Now()
+				ticker := time.NewTicker(5 * time.Second)
+				defer ticker.Stop()
 				for {
-					if done {
-						return
-					}
-					time.Sleep(5 * time.Second)
-					if done {
+					select {
+					case <-done:
 						return
+					case <-ticker.C:
 					}
 					elapsed := time.Since(startTime).Truncate(time.Second).Seconds()
-					logger.InfoC(ctx, "downloading UMP-encoded data", slog.String("id", id), slog.Float64("time elapsed (seconds)", elapsed), slog.Int("eta (seconds)", estDownloadTimeRemaining-int(elapsed)-5))
+					eta := max(estDownloadTimeRemaining-int(elapsed)-5, 0)
+					logger.InfoC(ctx, "downloading UMP-encoded data", slog.String("id", id), slog.Float64("time elapsed (seconds)", elapsed), slog.Int("eta (seconds)", eta))
+					if onProgress != nil {
+						onProgress(snapshot(eta))
+					}
 				}
 			}()
 			logger.InfoC(ctx, "token life OK", slog.Int64("expire_unix", expireUnix), slog.Time("expiry_time", expiryTime), slog.Int("remaining_seconds", int(remaining.Seconds())))
-			logger.InfoC(ctx, fmt.Sprintf("Downloading UMP-encoded data from: %s", u.String()))
-			out, err := DownloadWithHeaders(u.String(), map[string]string{
-				"Accept":     "application/vnd.yt-ump",
-				"User-Agent": "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Safari/537.36",
-			})
+			// Select the audio stream explicitly when the captured URL names it, otherwise let the decoder pick one
+			var itag int32
+			if v, err := strconv.ParseInt(q.Get("itag"), 10, 32); err == nil && ump_parser.IsAudioItag(int32(v)) {
+				itag = int32(v)
+			}
+			var n int64
+			if contentLength > 0 {
+				n, err = downloadRanges(ctx, u, q, itag, w, offset, contentLength, expiryTime, progress)
+			} else {
+				u.RawQuery = q.Encode()
+				logger.InfoC(ctx, fmt.Sprintf("Downloading UMP-encoded data from: %s", u.String()))
+				n, _, err = downloadUMP(ctx, u.String(), itag, w, progress)
+			}
 			if err != nil {
-				logger.ErrorC(ctx, "failed to download UMP data", slog.Any("error", err))
-				return nil, err
+				return n, err
+			}
+			if onProgress != nil {
+				onProgress(snapshot(0))
 			}
-			done = true
-			logger.InfoC(ctx, "Decoding UMP data", slog.Int("bytes", len(out)))
-			return ump_parser.DecodeUMPFile(out)
+			logger.InfoC(ctx, "Decoded UMP data", slog.Int64("received", progress.Received.Load()), slog.Int64("media", n))
+			return n, nil
 		}
 	}
 	logger.ErrorC(ctx, "unsupported URL scheme")
-	return nil, fmt.Errorf("unsupported URL scheme")
+	return 0, fmt.Errorf("unsupported URL scheme")
 }
 
-func DownloadWithHeaders(rawURL string, headers map[string]string) ([]byte, error) {
-	req, err := http.NewRequest("GET", rawURL, nil)
+// downloadRanges fetches bytes offset through length of the media object in ReplayChunkSize ranges, writing the
+// media of each range into w as it arrives. It stops once the token is too close to expiry so a later captured
+// request with a fresh token can pick up from where it left off. When itag is 0 the stream selected in the first range
+// is requested from every later range, so a response listing its streams in another order can't switch tracks.
+func downloadRanges(ctx context.Context, u *url.URL, q url.Values, itag int32, w io.Writer, offset, length int64, expiry time.Time, progress *DownloadProgress) (int64, error) {
+	var written int64
+	for rn := 1; offset+written < length; rn++ {
+		start := offset + written
+		if remaining := time.Until(expiry); remaining <= minTokenLifetime {
+			return written, fmt.Errorf("token expired after %d of %d bytes", start, length)
+		}
+		end := min(start+ReplayChunkSize, length) - 1
+		q.Set("range", fmt.Sprintf("%d-%d", start, end))
+		q.Set("rn", strconv.Itoa(rn))
+		u.RawQuery = q.Encode()
+		logger.InfoC(ctx, "downloading media range", slog.Int64("start", start), slog.Int64("end", end), slog.Int64("total", length))
+		n, selected, err := downloadUMP(ctx, u.String(), itag, w, progress)
+		written += n
+		if itag == 0 && n > 0 {
+			itag = selected
+		}
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, fmt.Errorf("no media returned for range %d-%d", start, end)
+		}
+	}
+	return written, nil
+}
+
+// downloadUMP fetches a UMP response and streams its media into w, following SABR redirects that arrive
+// before any media, and returns the number of media bytes written and the itag of the stream they came from. It fails
+// when the server reports an error or the media stream comes back incomplete.
+func downloadUMP(ctx context.Context, rawURL string, itag int32, w io.Writer, progress *DownloadProgress) (int64, int32, error) {
+	const maxRedirects = 3
+	var written int64
+	for redirects := 0; ; redirects++ {
+		body, err := DownloadWithHeaders(ctx, rawURL, map[string]string{
+			"Accept":     "application/vnd.yt-ump",
+			"User-Agent": "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Safari/537.36",
+		}, progress)
+		if err != nil {
+			logger.ErrorC(ctx, "failed to download UMP data", slog.Any("error", err))
+			return written, itag, err
+		}
+		res, err := ump_parser.Decode(body, w, itag)
+		_ = body.Close()
+		written += res.MediaBytes
+		if err != nil {
+			logger.ErrorC(ctx, "failed to decode UMP data", slog.Any("error", err))
+			return written, res.SelectedItag, err
+		}
+		if res.ProtectionStatus != nil && res.ProtectionStatus.Status != ump_parser.StreamProtectionOK {
+			logger.InfoC(ctx, "stream protection status", slog.Int("status", int(res.ProtectionStatus.Status)), slog.Int("max_retries", int(res.ProtectionStatus.MaxRetries)))
+		}
+		if res.Redirect != nil && res.MediaBytes == 0 {
+			if redirects >= maxRedirects {
+				return written, res.SelectedItag, fmt.Errorf("too many sabr redirects")
+			}
+			logger.InfoC(ctx, "following sabr redirect", slog.String("url", res.Redirect.URL))
+			rawURL = res.Redirect.URL
+			itag = res.SelectedItag
+			continue
+		}
+		if err = res.Incomplete(); err != nil {
+			logger.ErrorC(ctx, "incomplete UMP media stream", slog.Any("error", err))
+			return written, res.SelectedItag, fmt.Errorf("incomplete media stream: %w", err)
+		}
+		for otherItag, n := range res.Discarded {
+			logger.InfoC(ctx, "discarded media from unselected stream", slog.Int("itag", int(otherItag)), slog.Int64("bytes", n))
+		}
+		logger.InfoC(ctx, "received complete media stream", slog.Int("itag", int(res.SelectedItag)), slog.Int("segments", len(res.Headers)))
+		return written, res.SelectedItag, nil
+	}
+}
+
+// DownloadWithHeaders requests rawURL with the given headers and returns the response body, which the caller must
+// close. The body is paced to the configured download rate limit, and byte counts are recorded in progress as it is
+// read when progress is non-nil.
+func DownloadWithHeaders(ctx context.Context, rawURL string, headers map[string]string, progress *DownloadProgress) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -361,6 +1066,43 @@ func DownloadWithHeaders(rawURL string, headers map[string]string) ([]byte, erro
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = resp.Body.Close() }()
-	return io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status downloading media: %s", resp.Status)
+	}
+	var body io.ReadCloser = resp.Body
+	body = newRateLimitedReader(ctx, body, config.AppConfig.DownloadRateLimit, config.AppConfig.DownloadRateJitter)
+	if progress == nil {
+		return body, nil
+	}
+	progress.Total.Store(max(resp.ContentLength, 0))
+	return &countingReader{r: body, n: &progress.Received}, nil
+}
+
+// countingReader adds the number of bytes read through it to n.
+type countingReader struct {
+	r io.ReadCloser
+	n *atomic.Int64
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countingWriter adds the number of bytes written through it to n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
 }
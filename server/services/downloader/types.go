@@ -1,16 +1,31 @@
 package downloader
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gcottom/echodaemon/internal"
+	"github.com/gcottom/echodaemon/services/events"
+	"github.com/gcottom/echodaemon/services/library"
+	"github.com/gcottom/echodaemon/services/lyrics"
 	"github.com/gcottom/echodaemon/services/meta"
 )
 
 type Service struct {
 	MetaServiceClient *meta.Service
-	CurrentCapture    *CurrentCapture
 	CaptureChannel    chan CaptureChanData
-	LibraryMap        *sync.Map
+	Library           *library.Service
+	Jobs              *JobStore
+	Events            *events.Service
+	// Lyrics finds lyrics to embed in saved tracks; nil leaves them without
+	Lyrics *lyrics.Service
+
+	mu          sync.Mutex
+	activeJobID string
+	running     map[string]context.CancelFunc
+	wake        chan struct{}
 }
 
 type CaptureStartRequest struct {
@@ -25,16 +40,106 @@ type CaptureRequest struct {
 	Body    string
 }
 
-type CurrentCapture struct {
-	ID       string           `json:"id"`
-	Requests []CaptureRequest `json:"requests"`
-	Data     []byte           `json:"data"`
-}
-
 type CaptureChanData struct {
 	IsStart        bool
 	TrackID        string
 	CaptureRequest *CaptureRequest
 }
 
+type JobState string
+
+const (
+	JobStatePending    JobState = "pending"
+	JobStateReplaying  JobState = "replaying"
+	JobStateConverting JobState = "converting"
+	JobStateTagging    JobState = "tagging"
+	JobStateSaved      JobState = "saved"
+	JobStateFailed     JobState = "failed"
+)
+
+// Job is a single capture moving through the download pipeline. Jobs are persisted
+// in the JobStore so they survive a daemon restart.
+type Job struct {
+	ID            string             `json:"id"`
+	TrackID       string             `json:"track_id"`
+	State         JobState           `json:"state"`
+	Requests      []CaptureRequest   `json:"requests,omitempty"`
+	Attempts      int                `json:"attempts"`
+	BytesReceived int64              `json:"bytes_received"`
+	BytesTotal    int64              `json:"bytes_total"`
+	ETASeconds    int                `json:"eta_seconds"`
+	PlaylistID    string             `json:"playlist_id,omitempty"`
+	Trim          *internal.Trim     `json:"trim,omitempty"`
+	Loudness      *internal.Loudness `json:"loudness,omitempty"`
+	SavePath      string             `json:"save_path,omitempty"`
+	Error         string             `json:"error,omitempty"`
+	CreatedAt     time.Time          `json:"created_at"`
+	UpdatedAt     time.Time          `json:"updated_at"`
+	// MetaSources records which metadata provider each tag of the saved track came from, e.g. "genre": "spotify"
+	MetaSources map[string]string `json:"meta_sources,omitempty"`
+}
+
+// Finished reports whether the job has reached a terminal state.
+func (j *Job) Finished() bool {
+	return j.State == JobStateSaved || j.State == JobStateFailed
+}
+
+type PlaylistState string
+
+const (
+	PlaylistStateRunning   PlaylistState = "running"
+	PlaylistStateDone      PlaylistState = "done"
+	PlaylistStateCancelled PlaylistState = "cancelled"
+)
+
+// PlaylistRun tracks a playlist download. The extension is asked to play Tracks[Position]; once the job
+// capturing it finishes the run moves on to the next track.
+type PlaylistRun struct {
+	ID           string        `json:"id"`
+	State        PlaylistState `json:"state"`
+	Tracks       []string      `json:"tracks"`
+	Position     int           `json:"position"`
+	Done         int           `json:"done"`
+	CurrentJobID string        `json:"current_job_id,omitempty"`
+	StartedAt    time.Time     `json:"started_at"`
+	UpdatedAt    time.Time     `json:"updated_at"`
+}
+
+// CurrentTrack returns the video ID the extension should be playing, or "" when the run is over.
+func (r *PlaylistRun) CurrentTrack() string {
+	if r.State != PlaylistStateRunning || r.Position >= len(r.Tracks) {
+		return ""
+	}
+	return r.Tracks[r.Position]
+}
+
+// ReplayProgress is a snapshot of a running replay download.
+type ReplayProgress struct {
+	BytesReceived int64
+	BytesTotal    int64
+	ETASeconds    int
+}
+
+// DownloadProgress is updated by DownloadWithHeaders as the response body is read.
+type DownloadProgress struct {
+	Received atomic.Int64
+	Total    atomic.Int64
+}
+
 const MinimumDownloadSize = 1000000
+
+// ReplayChunkSize is the size of each range requested when a captured request carries the media object size.
+const ReplayChunkSize = 2 << 20
+
+// JobRetention is how long a saved or failed job stays in the job store before it's pruned.
+const JobRetention = 7 * 24 * time.Hour
+
+// jobPruneInterval is how often the job worker prunes expired jobs.
+const jobPruneInterval = time.Hour
+
+// minTokenLifetime is the least time a captured request's expire token must have left to start another download.
+const minTokenLifetime = 30 * time.Second
+
+// DurationTolerance is how much shorter than the captured dur parameter converted audio may be before
+// the download is treated as truncated.
+const DurationTolerance = 2 * time.Second
@@ -0,0 +1,61 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+type Service struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+type EventType string
+
+const (
+	EventCaptureStarted EventType = "capture_started"
+	EventReplayAttempt  EventType = "replay_attempt"
+	EventProgress       EventType = "progress"
+	EventConversionDone EventType = "conversion_done"
+	EventMetadataChosen EventType = "metadata_chosen"
+	EventFileSaved      EventType = "file_saved"
+	EventJobFailed      EventType = "job_failed"
+
+	EventPlaylistProgress EventType = "playlist_progress"
+)
+
+type Event struct {
+	Type    EventType `json:"type"`
+	JobID   string    `json:"job_id,omitempty"`
+	TrackID string    `json:"track_id,omitempty"`
+	Time    time.Time `json:"time"`
+	Data    any       `json:"data,omitempty"`
+}
+
+type ReplayAttempt struct {
+	Attempt int `json:"attempt"`
+}
+
+type Progress struct {
+	BytesReceived int64 `json:"bytes_received"`
+	BytesTotal    int64 `json:"bytes_total"`
+	ETASeconds    int   `json:"eta_seconds"`
+}
+
+type FileSaved struct {
+	Path string `json:"path"`
+}
+
+type JobFailed struct {
+	Error string `json:"error"`
+}
+
+type PlaylistProgress struct {
+	PlaylistID string `json:"playlist_id"`
+	State      string `json:"state"`
+	TrackCount int    `json:"track_count"`
+	TrackDone  int    `json:"track_done"`
+}
+
+// subscriberBuffer is how many events a slow subscriber may fall behind before events are dropped for it.
+const subscriberBuffer = 64
@@ -0,0 +1,190 @@
+package library
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gcottom/echodaemon/internal"
+	"github.com/gcottom/echodaemon/internal/fingerprint"
+	"github.com/gcottom/echodaemon/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+var entriesBucket = []byte("fingerprints")
+
+func Open(dir string) (*Service, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create library index dir: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "library.db"), 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open library index: %w", err)
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(entriesBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create library index bucket: %w", err)
+	}
+	return &Service{db: db}, nil
+}
+
+func (s *Service) Close() error {
+	return s.db.Close()
+}
+
+// Scan fingerprints every audio file under musicDir that is new or changed since it was last indexed, and drops
+// entries whose file no longer exists.
+func (s *Service) Scan(ctx context.Context, musicDir string) {
+	logger.InfoC(ctx, "scanning library...", slog.String("musicDir", musicDir))
+	indexed, skipped := 0, 0
+	if err := filepath.WalkDir(musicDir, func(path string, info fs.DirEntry, err error) error {
+		if err != nil {
+			logger.ErrorC(ctx, "error walking directory", slog.String("path", path), slog.Any("error", err))
+			return err
+		}
+		if info.IsDir() || !internal.IsAudioFile(path) {
+			return nil // Skip directories, artwork, playlists and other non-audio files
+		}
+		stat, err := info.Info()
+		if err != nil {
+			return nil
+		}
+		if entry, err := s.get(path); err == nil && entry != nil && entry.ModTime.Equal(stat.ModTime()) {
+			skipped++
+			return nil
+		}
+		fp, err := fingerprint.FromFile(ctx, path)
+		if err != nil {
+			logger.ErrorC(ctx, "failed to fingerprint file", slog.String("path", path), slog.Any("error", err))
+			return ctx.Err() // Keep scanning past files that can't be decoded
+		}
+		if err = s.put(&Entry{Path: path, ModTime: stat.ModTime(), Fingerprint: fp}); err != nil {
+			return err
+		}
+		indexed++
+		return nil
+	}); err != nil {
+		logger.ErrorC(ctx, "library scan stopped", slog.String("musicDir", musicDir), slog.Any("error", err))
+		return
+	}
+	removed, err := s.prune()
+	if err != nil {
+		logger.ErrorC(ctx, "failed to prune library index", slog.Any("error", err))
+	}
+	logger.InfoC(ctx, "library scan complete", slog.Int("indexed", indexed), slog.Int("unchanged", skipped), slog.Int("removed", removed))
+}
+
+// Add indexes a file that was just written to the library.
+func (s *Service) Add(path string, fp *fingerprint.Fingerprint) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat library file: %w", err)
+	}
+	return s.put(&Entry{Path: path, ModTime: stat.ModTime(), Fingerprint: fp})
+}
+
+// FindDuplicate returns the indexed file most similar to fp, or nil when none reaches minSimilarity.
+func (s *Service) FindDuplicate(fp *fingerprint.Fingerprint, minSimilarity float64) (*Match, error) {
+	var best *Match
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(_, v []byte) error {
+			var entry Entry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if entry.Fingerprint == nil {
+				return nil
+			}
+			similarity := fp.Similarity(entry.Fingerprint)
+			if similarity >= minSimilarity && (best == nil || similarity > best.Similarity) {
+				best = &Match{Entry: &entry, Similarity: similarity}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return best, nil
+}
+
+// AddUnlessDuplicate indexes the file produced by write unless the library already holds a file that sounds
+// like fp, in which case write isn't called and the match is returned. The check and the write are serialized so
+// two copies of the same recording finishing together can't both be saved.
+func (s *Service) AddUnlessDuplicate(fp *fingerprint.Fingerprint, minSimilarity float64, write func() (string, error)) (*Match, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	match, err := s.FindDuplicate(fp, minSimilarity)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to check library index: %w", err)
+	}
+	if match != nil {
+		return match, "", nil
+	}
+	path, err := write()
+	if err != nil {
+		return nil, "", err
+	}
+	return nil, path, s.Add(path, fp)
+}
+
+func (s *Service) get(path string) (*Entry, error) {
+	var entry *Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(entriesBucket).Get([]byte(path))
+		if v == nil {
+			return nil
+		}
+		entry = new(Entry)
+		return json.Unmarshal(v, entry)
+	})
+	return entry, err
+}
+
+func (s *Service) put(entry *Entry) error {
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Put([]byte(entry.Path), v)
+	})
+}
+
+// prune removes entries for files that have been moved or deleted
+func (s *Service) prune() (int, error) {
+	var gone [][]byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(k, _ []byte) error {
+			if _, err := os.Stat(string(k)); errors.Is(err, fs.ErrNotExist) {
+				gone = append(gone, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+	if err != nil || len(gone) == 0 {
+		return 0, err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(entriesBucket)
+		for _, k := range gone {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(gone), nil
+}
@@ -0,0 +1,216 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gcottom/echodaemon/internal/fingerprint"
+)
+
+// testFingerprints returns n unrelated fingerprints, each 200 sub-fingerprints long
+func testFingerprints(n int) []*fingerprint.Fingerprint {
+	rng := rand.New(rand.NewPCG(1, 2))
+	fps := make([]*fingerprint.Fingerprint, n)
+	for i := range fps {
+		values := make([]uint32, 200)
+		for j := range values {
+			values[j] = rng.Uint32()
+		}
+		fps[i] = &fingerprint.Fingerprint{Values: values, Duration: 180}
+	}
+	return fps
+}
+
+// laterStart returns fp as if its audio started a few seconds later, with some bits flipped as a re-encode would
+func laterStart(fp *fingerprint.Fingerprint) *fingerprint.Fingerprint {
+	values := slices.Clone(fp.Values[30:])
+	for i := range values {
+		values[i] ^= 0x00010001
+	}
+	return &fingerprint.Fingerprint{Values: values, Duration: fp.Duration}
+}
+
+func openTest(t *testing.T) *Service {
+	t.Helper()
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+// writeFile creates an empty library file
+func writeFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindDuplicate(t *testing.T) {
+	s := openTest(t)
+	dir := t.TempDir()
+	fps := testFingerprints(3)
+	for i, fp := range fps[:2] {
+		path := filepath.Join(dir, []string{"a.opus", "b.opus"}[i])
+		writeFile(t, path)
+		if err := s.Add(path, fp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name          string
+		fp            *fingerprint.Fingerprint
+		minSimilarity float64
+		want          string
+	}{
+		{"same audio", fps[1], 0.9, "b.opus"},
+		{"later start", laterStart(fps[0]), 0.9, "a.opus"},
+		{"below threshold", laterStart(fps[0]), 0.95, ""},
+		{"unrelated", fps[2], 0.9, ""},
+	}
+	for _, tt := range tests {
+		match, err := s.FindDuplicate(tt.fp, tt.minSimilarity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if match != nil {
+			got = filepath.Base(match.Entry.Path)
+			if match.Similarity < tt.minSimilarity {
+				t.Errorf("%s: match with similarity %.3f", tt.name, match.Similarity)
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%s: matched %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindDuplicateBestMatch(t *testing.T) {
+	s := openTest(t)
+	dir := t.TempDir()
+	fp := testFingerprints(1)[0]
+	// Both files are duplicates of fp, but the exact copy matches better than the re-encode
+	for name, indexed := range map[string]*fingerprint.Fingerprint{"reencode.opus": laterStart(fp), "copy.opus": fp} {
+		path := filepath.Join(dir, name)
+		writeFile(t, path)
+		if err := s.Add(path, indexed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	match, err := s.FindDuplicate(fp, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match == nil || filepath.Base(match.Entry.Path) != "copy.opus" || match.Similarity != 1 {
+		t.Errorf("match = %+v, want copy.opus", match)
+	}
+}
+
+func TestAddUnlessDuplicate(t *testing.T) {
+	s := openTest(t)
+	dir := t.TempDir()
+	fps := testFingerprints(2)
+	writes := 0
+	write := func(name string) func() (string, error) {
+		return func() (string, error) {
+			writes++
+			path := filepath.Join(dir, name)
+			writeFile(t, path)
+			return path, nil
+		}
+	}
+
+	match, path, err := s.AddUnlessDuplicate(fps[0], 0.9, write("first.opus"))
+	if err != nil || match != nil || filepath.Base(path) != "first.opus" {
+		t.Fatalf("first save: match %v path %q err %v", match, path, err)
+	}
+	if entry, err := s.get(path); err != nil || entry == nil {
+		t.Fatalf("first save wasn't indexed: %v", err)
+	}
+
+	match, path, err = s.AddUnlessDuplicate(laterStart(fps[0]), 0.9, write("second.opus"))
+	if err != nil || match == nil || path != "" {
+		t.Fatalf("duplicate: match %v path %q err %v", match, path, err)
+	}
+	if filepath.Base(match.Entry.Path) != "first.opus" {
+		t.Errorf("duplicate matched %q", match.Entry.Path)
+	}
+	if writes != 1 {
+		t.Errorf("duplicate was written")
+	}
+
+	if _, path, err = s.AddUnlessDuplicate(fps[1], 0.9, write("other.opus")); err != nil || filepath.Base(path) != "other.opus" {
+		t.Errorf("different track: path %q err %v", path, err)
+	}
+
+	errWrite := errors.New("disk full")
+	failing := func() (string, error) { return "", errWrite }
+	if _, _, err = s.AddUnlessDuplicate(testFingerprints(3)[2], 0.9, failing); !errors.Is(err, errWrite) {
+		t.Errorf("failed write: err = %v", err)
+	}
+}
+
+func TestAddUnlessDuplicateConcurrent(t *testing.T) {
+	s := openTest(t)
+	dir := t.TempDir()
+	fp := testFingerprints(1)[0]
+	// Two copies of the same recording finishing together: only one may be saved
+	var writes atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := s.AddUnlessDuplicate(fp, 0.9, func() (string, error) {
+				writes.Add(1)
+				path := filepath.Join(dir, fmt.Sprintf("copy%d.opus", i))
+				return path, os.WriteFile(path, nil, 0644)
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := writes.Load(); n != 1 {
+		t.Errorf("%d copies written, want 1", n)
+	}
+}
+
+func TestScanDropsMissingFiles(t *testing.T) {
+	s := openTest(t)
+	dir := t.TempDir()
+	fps := testFingerprints(2)
+	kept, gone := filepath.Join(dir, "kept.txt"), filepath.Join(dir, "gone.opus")
+	for i, path := range []string{kept, gone} {
+		writeFile(t, path)
+		if err := s.Add(path, fps[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+	// The directory holds no audio files, so scanning only prunes
+	s.Scan(context.Background(), dir)
+	if entry, _ := s.get(kept); entry == nil {
+		t.Error("entry of an existing file was dropped")
+	}
+	if entry, _ := s.get(gone); entry != nil {
+		t.Error("entry of a deleted file was kept")
+	}
+	if match, _ := s.FindDuplicate(fps[1], 0.9); match != nil {
+		t.Errorf("deleted file still matches: %s", match.Entry.Path)
+	}
+}
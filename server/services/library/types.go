@@ -0,0 +1,30 @@
+package library
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gcottom/echodaemon/internal/fingerprint"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Service is the library index of audio fingerprints used to spot tracks that are already in the library,
+// whatever they are tagged as. It is persisted in a bbolt database alongside the job store.
+type Service struct {
+	db *bolt.DB
+	// mu serializes duplicate checks with the writes that follow them
+	mu sync.Mutex
+}
+
+// Entry is one indexed audio file
+type Entry struct {
+	Path        string                   `json:"path"`
+	ModTime     time.Time                `json:"mod_time"`
+	Fingerprint *fingerprint.Fingerprint `json:"fingerprint"`
+}
+
+// Match is an indexed file that sounds like the audio being checked
+type Match struct {
+	Entry      *Entry
+	Similarity float64
+}
@@ -0,0 +1,161 @@
+package lyrics
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gcottom/echodaemon/internal/customtags"
+)
+
+// durationTolerance is how many seconds a result's length may differ from the track's, matching LRCLIB's own
+// lookup tolerance
+const durationTolerance = 2
+
+var errNotFound = errors.New("not found")
+
+var lrcTimestamp = regexp.MustCompile(`\[(\d+):(\d{1,2}(?:[.:]\d{1,3})?)\]`)
+
+// Find looks up the track's lyrics, returning nil when LRCLIB has none. An exact lookup by title, artist, album and
+// duration is tried first, then a search by title and artist that skips results of a different length.
+func (s *Service) Find(ctx context.Context, track Track) (*Lyrics, error) {
+	if track.Duration > 0 {
+		query := url.Values{
+			"track_name":  {track.Title},
+			"artist_name": {track.Artist},
+			"album_name":  {track.Album},
+			"duration":    {strconv.Itoa(int(math.Round(track.Duration)))},
+		}
+		var record lrclibRecord
+		err := s.get(ctx, "/get?"+query.Encode(), &record)
+		if err == nil {
+			return record.lyrics(), nil
+		}
+		if !errors.Is(err, errNotFound) {
+			return nil, fmt.Errorf("lyrics lookup failed: %w", err)
+		}
+	}
+	query := url.Values{
+		"track_name":  {track.Title},
+		"artist_name": {track.Artist},
+	}
+	var records []lrclibRecord
+	if err := s.get(ctx, "/search?"+query.Encode(), &records); err != nil {
+		return nil, fmt.Errorf("lyrics search failed: %w", err)
+	}
+	for _, record := range records {
+		if track.Duration > 0 && math.Abs(record.Duration-track.Duration) > durationTolerance {
+			continue
+		}
+		if lyrics := record.lyrics(); lyrics != nil {
+			return lyrics, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *Service) get(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", s.UserAgent)
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// lyrics returns the record's lyrics, or nil when it has neither lyrics nor the instrumental flag
+func (r *lrclibRecord) lyrics() *Lyrics {
+	l := &Lyrics{Plain: strings.TrimSpace(r.PlainLyrics), Synced: ParseLRC(r.SyncedLyrics), Instrumental: r.Instrumental}
+	if l.Plain == "" && len(l.Synced) == 0 && !l.Instrumental {
+		return nil
+	}
+	return l
+}
+
+// ParseLRC reads the timestamped lines of LRC text in time order. Lines with several timestamps are repeated at
+// each of them; metadata tags such as [ar:...] and untimed lines are skipped.
+func ParseLRC(text string) []customtags.SyncedLyric {
+	var lines []customtags.SyncedLyric
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		var times []time.Duration
+		for {
+			m := lrcTimestamp.FindStringSubmatchIndex(line)
+			if m == nil || m[0] != 0 {
+				break
+			}
+			minutes, _ := strconv.Atoi(line[m[2]:m[3]])
+			seconds, _ := strconv.ParseFloat(strings.Replace(line[m[4]:m[5]], ":", ".", 1), 64)
+			// Rounded to the millisecond, the finest LRC precision, so e.g. 1.005 isn't read as 1.004999999
+			times = append(times, time.Duration(minutes)*time.Minute+time.Duration(math.Round(seconds*1000))*time.Millisecond)
+			line = line[m[1]:]
+		}
+		text := strings.TrimSpace(line)
+		for _, t := range times {
+			lines = append(lines, customtags.SyncedLyric{Time: t, Text: text})
+		}
+	}
+	slices.SortStableFunc(lines, func(a, b customtags.SyncedLyric) int {
+		return cmp.Compare(a.Time, b.Time)
+	})
+	return lines
+}
+
+// Shift moves the synced lyrics by offset, e.g. to follow silence trimmed from the start of the track. Lines that
+// would start before the track are moved to its start.
+func (l *Lyrics) Shift(offset time.Duration) {
+	for i := range l.Synced {
+		l.Synced[i].Time = max(0, l.Synced[i].Time+offset)
+	}
+}
+
+// Tags returns the lyrics as tags to embed.
+func (l *Lyrics) Tags() *customtags.Tags {
+	return &customtags.Tags{Lyrics: l.Plain, SyncedLyrics: l.Synced}
+}
+
+// LRC renders the synced lyrics as an .lrc file with the track's details in its header, or "" when there are no
+// synced lyrics.
+func (l *Lyrics) LRC(track Track) string {
+	if len(l.Synced) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, header := range [][2]string{{"ti", track.Title}, {"ar", track.Artist}, {"al", track.Album}} {
+		if header[1] != "" {
+			fmt.Fprintf(&b, "[%s:%s]\n", header[0], header[1])
+		}
+	}
+	if track.Duration > 0 {
+		seconds := int(math.Round(track.Duration))
+		fmt.Fprintf(&b, "[length:%02d:%02d]\n", seconds/60, seconds%60)
+	}
+	b.WriteString(customtags.FormatLRC(l.Synced))
+	return b.String()
+}
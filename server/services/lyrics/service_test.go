@@ -0,0 +1,210 @@
+package lyrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gcottom/echodaemon/internal/customtags"
+)
+
+func line(d time.Duration, text string) customtags.SyncedLyric {
+	return customtags.SyncedLyric{Time: d, Text: text}
+}
+
+func TestParseLRC(t *testing.T) {
+	tests := []struct {
+		name string
+		lrc  string
+		want []customtags.SyncedLyric
+	}{
+		{
+			name: "centiseconds",
+			lrc:  "[00:12.34]First\n[01:02.50] Second \n",
+			want: []customtags.SyncedLyric{line(12340*time.Millisecond, "First"), line(62500*time.Millisecond, "Second")},
+		},
+		{
+			name: "milliseconds, colons and whole seconds",
+			lrc:  "[0:01.005]a\n[00:02:50]b\n[00:03]c",
+			want: []customtags.SyncedLyric{line(1005*time.Millisecond, "a"), line(2500*time.Millisecond, "b"), line(3*time.Second, "c")},
+		},
+		{
+			name: "repeated lines in time order",
+			lrc:  "[00:10.00][00:01.00]Chorus\n[00:05.00]Verse",
+			want: []customtags.SyncedLyric{line(time.Second, "Chorus"), line(5*time.Second, "Verse"), line(10*time.Second, "Chorus")},
+		},
+		{
+			name: "metadata and untimed lines skipped",
+			lrc:  "[ar:Artist]\n[ti:Title]\nno timestamp\n[00:01.00]Line\r\n[00:02.00]",
+			want: []customtags.SyncedLyric{line(time.Second, "Line"), line(2*time.Second, "")},
+		},
+		{
+			name: "timestamp inside a line",
+			lrc:  "Intro [00:01.00]",
+			want: nil,
+		},
+		{name: "empty", lrc: "", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseLRC(tt.lrc); !slices.Equal(got, tt.want) {
+				t.Errorf("ParseLRC = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLRCRoundTrip(t *testing.T) {
+	synced := []customtags.SyncedLyric{line(0, "Start"), line(1230*time.Millisecond, "Next"), line(61*time.Second+990*time.Millisecond, "Later")}
+	l := &Lyrics{Synced: synced}
+	tests := []struct {
+		name   string
+		track  Track
+		header string
+	}{
+		{"full header", Track{Title: "Song", Artist: "Artist", Album: "Album", Duration: 185.6}, "[ti:Song]\n[ar:Artist]\n[al:Album]\n[length:03:06]\n"},
+		{"partial header", Track{Title: "Song"}, "[ti:Song]\n"},
+	}
+	for _, tt := range tests {
+		lrc := l.LRC(tt.track)
+		if !strings.HasPrefix(lrc, tt.header) {
+			t.Errorf("%s: LRC = %q, want header %q", tt.name, lrc, tt.header)
+		}
+		if got := ParseLRC(lrc); !slices.Equal(got, synced) {
+			t.Errorf("%s: parsed back %v, want %v", tt.name, got, synced)
+		}
+	}
+	if lrc := (&Lyrics{Plain: "plain only"}).LRC(Track{Title: "Song"}); lrc != "" {
+		t.Errorf("LRC without synced lyrics = %q", lrc)
+	}
+}
+
+func TestShift(t *testing.T) {
+	l := &Lyrics{Synced: []customtags.SyncedLyric{line(time.Second, "a"), line(3*time.Second, "b"), line(10*time.Second, "c")}}
+	l.Shift(-2 * time.Second)
+	want := []customtags.SyncedLyric{line(0, "a"), line(time.Second, "b"), line(8*time.Second, "c")}
+	if !slices.Equal(l.Synced, want) {
+		t.Errorf("shifted back: %v, want %v", l.Synced, want)
+	}
+	l.Shift(500 * time.Millisecond)
+	if l.Synced[0].Time != 500*time.Millisecond || l.Synced[2].Time != 8500*time.Millisecond {
+		t.Errorf("shifted forward: %v", l.Synced)
+	}
+}
+
+func TestFind(t *testing.T) {
+	const synced = "[00:01.00]Hello"
+	tests := []struct {
+		name        string
+		track       Track
+		get         string
+		getStatus   int
+		search      string
+		wantPaths   []string
+		wantPlain   string
+		wantSynced  bool
+		wantInstr   bool
+		wantNothing bool
+		wantErr     bool
+	}{
+		{
+			name:       "exact match",
+			track:      Track{Title: "Song", Artist: "Artist", Album: "Album", Duration: 180.4},
+			get:        `{"id": 1, "duration": 180, "plainLyrics": "Hello", "syncedLyrics": "` + synced + `"}`,
+			getStatus:  http.StatusOK,
+			wantPaths:  []string{"/api/get"},
+			wantPlain:  "Hello",
+			wantSynced: true,
+		},
+		{
+			name:      "search after a missed lookup skips other lengths",
+			track:     Track{Title: "Song", Artist: "Artist", Duration: 180},
+			getStatus: http.StatusNotFound,
+			search: `[{"id": 1, "duration": 240, "plainLyrics": "Extended mix"},
+				{"id": 2, "duration": 182, "plainLyrics": "Album version"}]`,
+			wantPaths: []string{"/api/get", "/api/search"},
+			wantPlain: "Album version",
+		},
+		{
+			name:      "search without a duration takes the first with lyrics",
+			track:     Track{Title: "Song", Artist: "Artist"},
+			search:    `[{"id": 1, "duration": 240}, {"id": 2, "duration": 100, "instrumental": true}]`,
+			wantPaths: []string{"/api/search"},
+			wantInstr: true,
+		},
+		{
+			name:        "nothing within tolerance",
+			track:       Track{Title: "Song", Artist: "Artist", Duration: 180},
+			getStatus:   http.StatusNotFound,
+			search:      `[{"id": 1, "duration": 177.9, "plainLyrics": "Too short"}]`,
+			wantPaths:   []string{"/api/get", "/api/search"},
+			wantNothing: true,
+		},
+		{
+			name:      "lookup error",
+			track:     Track{Title: "Song", Artist: "Artist", Duration: 180},
+			getStatus: http.StatusInternalServerError,
+			wantPaths: []string{"/api/get"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, r.URL.Path)
+				if got := r.Header.Get("User-Agent"); got != "echo-daemon-test/1.0" {
+					t.Errorf("User-Agent = %q", got)
+				}
+				q := r.URL.Query()
+				if q.Get("track_name") != tt.track.Title || q.Get("artist_name") != tt.track.Artist {
+					t.Errorf("query %v doesn't name the track", q)
+				}
+				switch r.URL.Path {
+				case "/api/get":
+					if q.Get("album_name") != tt.track.Album || q.Get("duration") != "180" {
+						t.Errorf("lookup query %v, want the album and the duration in whole seconds", q)
+					}
+					w.WriteHeader(tt.getStatus)
+					w.Write([]byte(tt.get))
+				case "/api/search":
+					w.Write([]byte(tt.search))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer srv.Close()
+			s := &Service{BaseURL: srv.URL + "/api", UserAgent: "echo-daemon-test/1.0", HTTPClient: srv.Client()}
+
+			got, err := s.Find(context.Background(), tt.track)
+			if !slices.Equal(paths, tt.wantPaths) {
+				t.Errorf("requested %v, want %v", paths, tt.wantPaths)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantNothing {
+				if got != nil {
+					t.Fatalf("got %+v, want no lyrics", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("no lyrics")
+			}
+			if got.Plain != tt.wantPlain || (len(got.Synced) > 0) != tt.wantSynced || got.Instrumental != tt.wantInstr {
+				t.Errorf("got %+v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package lyrics
+
+import (
+	"net/http"
+
+	"github.com/gcottom/echodaemon/internal/customtags"
+)
+
+// Service looks up lyrics on an LRCLIB compatible API. BaseURL is the API root, e.g. https://lrclib.net/api.
+type Service struct {
+	BaseURL    string
+	UserAgent  string
+	HTTPClient *http.Client
+}
+
+// Lyrics are a track's plain and time-synced lyrics; either may be empty
+type Lyrics struct {
+	Plain        string                   `json:"plain,omitempty"`
+	Synced       []customtags.SyncedLyric `json:"synced,omitempty"`
+	Instrumental bool                     `json:"instrumental,omitempty"`
+}
+
+// Track identifies the track to find lyrics for. Duration is in seconds; 0 means unknown.
+type Track struct {
+	Title    string
+	Artist   string
+	Album    string
+	Duration float64
+}
+
+type lrclibRecord struct {
+	ID           int     `json:"id"`
+	TrackName    string  `json:"trackName"`
+	ArtistName   string  `json:"artistName"`
+	AlbumName    string  `json:"albumName"`
+	Duration     float64 `json:"duration"`
+	Instrumental bool    `json:"instrumental"`
+	PlainLyrics  string  `json:"plainLyrics"`
+	SyncedLyrics string  `json:"syncedLyrics"`
+}
@@ -0,0 +1,101 @@
+package meta
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/gcottom/echodaemon/config"
+)
+
+// mergeGenre sets the track's genres from the matched Spotify track's artist genres and the classifier's according to
+// s.GenrePolicy, recording in Sources which of them were used. When neither has genres, the first other provider
+// in priority order that does is used.
+func (s *Service) mergeGenre(merged *TrackMeta, ranked [][]rankedCandidate) {
+	spotify := s.providerGenres(ranked, ProviderSpotify)
+	ml := s.providerGenres(ranked, ProviderClassifier)
+	var genres []string
+	var source string
+	switch s.genrePolicy() {
+	case config.GenrePolicyPreferSpotify, config.GenrePolicyMLFallback:
+		genres, source = preferGenres(spotify, ProviderSpotify, ml, ProviderClassifier)
+	case config.GenrePolicyUnion:
+		genres = slices.Clone(spotify)
+		for _, genre := range ml {
+			if !slices.ContainsFunc(genres, func(g string) bool { return sameGenre(g, genre) }) {
+				genres = append(genres, genre)
+			}
+		}
+		switch {
+		case len(spotify) > 0 && len(ml) > 0:
+			source = ProviderSpotify + "+" + ProviderClassifier
+		case len(spotify) > 0:
+			source = ProviderSpotify
+		case len(ml) > 0:
+			source = ProviderClassifier
+		}
+	default:
+		genres, source = preferGenres(ml, ProviderClassifier, spotify, ProviderSpotify)
+	}
+	if len(genres) == 0 {
+		for _, provider := range s.Providers {
+			if name := provider.Name(); name != ProviderSpotify && name != ProviderClassifier {
+				if genres = s.providerGenres(ranked, name); len(genres) > 0 {
+					source = name
+					break
+				}
+			}
+		}
+	}
+	if len(genres) == 0 {
+		return
+	}
+	merged.Genres = genres
+	merged.Genre = strings.Join(genres, "; ")
+	merged.Sources["genre"] = source
+}
+
+// genreSpelling drops the separators that spellings of a genre differ in, such as "Hip Hop" and "Hip-Hop"
+var genreSpelling = strings.NewReplacer(" ", "", "-", "")
+
+func sameGenre(a, b string) bool {
+	return strings.EqualFold(genreSpelling.Replace(a), genreSpelling.Replace(b))
+}
+
+func preferGenres(first []string, firstSource string, second []string, secondSource string) ([]string, string) {
+	if len(first) > 0 {
+		return first, firstSource
+	}
+	if len(second) > 0 {
+		return second, secondSource
+	}
+	return nil, ""
+}
+
+// providerGenres returns the genres of the named provider's best matching candidate, at most s.MaxGenres of them
+func (s *Service) providerGenres(ranked [][]rankedCandidate, name string) []string {
+	i := s.providerIndex(name)
+	if i < 0 || len(ranked[i]) == 0 {
+		return nil
+	}
+	best := ranked[i][0].Meta
+	genres := best.Genres
+	if len(genres) == 0 && best.Genre != "" {
+		genres = []string{best.Genre}
+	}
+	if s.MaxGenres > 0 && len(genres) > s.MaxGenres {
+		genres = genres[:s.MaxGenres]
+	}
+	return genres
+}
+
+// providerIndex returns the position of the named provider in s.Providers, or -1 when it isn't enabled
+func (s *Service) providerIndex(name string) int {
+	return slices.IndexFunc(s.Providers, func(p MetadataProvider) bool { return p.Name() == name })
+}
+
+func (s *Service) genrePolicy() string {
+	if s.GenrePolicy == "" {
+		return config.GenrePolicyPreferML
+	}
+	return s.GenrePolicy
+}
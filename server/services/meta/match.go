@@ -0,0 +1,166 @@
+package meta
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Weights of the title and artist similarity in a candidate's match score
+const (
+	titleWeight  = 0.6
+	artistWeight = 0.4
+)
+
+// Durations within durationGrace seconds of each other aren't penalized; beyond it the score falls off linearly
+// and reaches zero durationFalloff seconds later, so live versions, extended mixes and radio edits score low.
+const (
+	durationGrace   = 3
+	durationFalloff = 30
+)
+
+// DefaultMinScore is the match score a candidate needs when no threshold is configured
+const DefaultMinScore = 0.85
+
+var (
+	artistSeparators = regexp.MustCompile(`(?i)\s*(?:,|&|;|/|\bfeat\.?|\bft\.?|\bfeaturing\b|\bvs\.?|\bx\b)\s*`)
+	featuring        = regexp.MustCompile(`(?i)\s*\b(?:feat\.?|ft\.?|featuring)\s.*$`)
+	nonAlphanumeric  = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+)
+
+// matchScore rates from 0 to 1 how well a candidate's title, artist and duration agree with the track. Titles and
+// artists are compared against every variant derived from the video, keeping the best similarity of each.
+func (s *Service) matchScore(q *Query, c *TrackMeta) float64 {
+	titleScore := 0.0
+	for _, candidateTitle := range s.titleForms(c.Title) {
+		for _, title := range q.Titles {
+			titleScore = max(titleScore, similarity(title, candidateTitle))
+		}
+	}
+	artistScore := 0.0
+	for _, artist := range q.Artists {
+		artistScore = max(artistScore, artistSimilarity(artist, c.Artist))
+	}
+	return (titleWeight*titleScore + artistWeight*artistScore) * durationFactor(q.Source.Duration, c.Duration)
+}
+
+// titleForms returns the candidate title as given and without bracketed parts, "feat." credits or a " - Remastered"
+// style suffix, so a bare video title can still match a decorated release title
+func (s *Service) titleForms(title string) []string {
+	bare := strings.TrimSpace(s.SanitizeParenthesis(title))
+	forms := []string{title, bare, featuring.ReplaceAllString(bare, "")}
+	if before, _, ok := strings.Cut(bare, " - "); ok {
+		forms = append(forms, strings.TrimSpace(before))
+	}
+	return forms
+}
+
+// artistSimilarity compares two artist credits both whole and name by name after splitting on separators like
+// "feat.", "ft.", "x", "&" and commas, so "A x B" matches "A, B" and a channel named after the main artist matches
+// a credit that also lists featured artists
+func artistSimilarity(a, b string) float64 {
+	best := similarity(a, b)
+	for _, x := range artistSeparators.Split(a, -1) {
+		for _, y := range artistSeparators.Split(b, -1) {
+			if x != "" && y != "" {
+				best = max(best, similarity(x, y))
+			}
+		}
+	}
+	return best
+}
+
+// durationFactor is 1 when either duration is unknown or they are close, falling to 0 as they drift apart
+func durationFactor(a, b float64) float64 {
+	if a <= 0 || b <= 0 {
+		return 1
+	}
+	diff := math.Abs(a - b)
+	if diff <= durationGrace {
+		return 1
+	}
+	return max(0, 1-(diff-durationGrace)/durationFalloff)
+}
+
+// similarity is the mean of the normalized Levenshtein similarity and the Jaro-Winkler similarity of the two
+// strings after folding case, accents, punctuation and whitespace
+func similarity(a, b string) float64 {
+	ra, rb := []rune(normalize(a)), []rune(normalize(b))
+	if len(ra) == 0 || len(rb) == 0 {
+		return 0
+	}
+	levenshteinScore := 1 - float64(levenshtein(ra, rb))/float64(max(len(ra), len(rb)))
+	return (levenshteinScore + jaroWinkler(ra, rb)) / 2
+}
+
+func normalize(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(s)) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(r)
+		}
+	}
+	return strings.TrimSpace(nonAlphanumeric.ReplaceAllString(b.String(), " "))
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func jaroWinkler(a, b []rune) float64 {
+	window := max(0, max(len(a), len(b))/2-1)
+	matchedA := make([]bool, len(a))
+	matchedB := make([]bool, len(b))
+	matches := 0
+	for i := range a {
+		for j := max(0, i-window); j < min(len(b), i+window+1); j++ {
+			if !matchedB[j] && a[i] == b[j] {
+				matchedA[i], matchedB[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+	transpositions := 0
+	for i, j := 0, 0; i < len(a); i++ {
+		if !matchedA[i] {
+			continue
+		}
+		for !matchedB[j] {
+			j++
+		}
+		if a[i] != b[j] {
+			transpositions++
+		}
+		j++
+	}
+	m := float64(matches)
+	jaro := (m/float64(len(a)) + m/float64(len(b)) + (m-float64(transpositions)/2)/m) / 3
+	prefix := 0
+	for prefix < min(4, len(a), len(b)) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
@@ -0,0 +1,164 @@
+package meta
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+		{"flaw", "lawn", 2},
+		{"same", "same", 0},
+		{"café", "cafe", 1},
+	}
+	for _, tt := range tests {
+		if got := levenshtein([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestJaroWinkler(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"martha", "marhta", 0.9611},
+		{"dwayne", "duane", 0.84},
+		{"dixon", "dicksonx", 0.8133},
+		{"same", "same", 1},
+		{"abc", "xyz", 0},
+		{"a", "b", 0},
+	}
+	for _, tt := range tests {
+		if got := jaroWinkler([]rune(tt.a), []rune(tt.b)); math.Abs(got-tt.want) > 1e-3 {
+			t.Errorf("jaroWinkler(%q, %q) = %.4f, want %.4f", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		min  float64
+		max  float64
+	}{
+		{name: "both empty", a: "", b: "", max: 0},
+		{name: "one empty", a: "Song", b: "", max: 0},
+		{name: "only punctuation", a: "!!!", b: "Song", max: 0},
+		{name: "identical", a: "Song", b: "Song", min: 1, max: 1},
+		{name: "case and punctuation", a: "Hello, World!", b: "hello   world", min: 1, max: 1},
+		{name: "accents", a: "Beyoncé", b: "BEYONCE", min: 1, max: 1},
+		{name: "typo", a: "Bohemian Rhapsody", b: "Bohemian Rapsody", min: 0.9, max: 0.99},
+		{name: "different", a: "Yesterday", b: "Thriller", max: 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := similarity(tt.a, tt.b)
+			if got < tt.min || got > tt.max {
+				t.Errorf("similarity(%q, %q) = %.3f, want between %g and %g", tt.a, tt.b, got, tt.min, tt.max)
+			}
+			if rev := similarity(tt.b, tt.a); math.Abs(rev-got) > 1e-9 {
+				t.Errorf("similarity isn't symmetric: %.3f and %.3f", got, rev)
+			}
+		})
+	}
+}
+
+func TestArtistSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		exact bool
+	}{
+		{"A x B", "A, B", true},
+		{"Drake feat. Rihanna", "Drake", true},
+		{"Drake ft Rihanna", "Rihanna", true},
+		{"Simon & Garfunkel", "Paul Simon", false},
+		{"Calvin Harris", "Calvin Harris; Dua Lipa", true},
+		// "x" only separates as a whole word
+		{"Xavier Rudd", "Rudd", false},
+	}
+	for _, tt := range tests {
+		got := artistSimilarity(tt.a, tt.b)
+		if tt.exact != (got == 1) {
+			t.Errorf("artistSimilarity(%q, %q) = %.3f, want exact match %v", tt.a, tt.b, got, tt.exact)
+		}
+	}
+}
+
+func TestDurationFactor(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b float64
+		want float64
+	}{
+		{"unknown source", 0, 200, 1},
+		{"unknown candidate", 200, 0, 1},
+		{"equal", 200, 200, 1},
+		{"at the grace limit", 200, 200 + durationGrace, 1},
+		{"just past the grace limit", 200 + durationGrace + 0.3, 200, 0.99},
+		{"halfway through the falloff", 200, 200 + durationGrace + durationFalloff/2, 0.5},
+		{"end of the falloff", 200, 200 + durationGrace + durationFalloff, 0},
+		{"far apart", 200, 600, 0},
+	}
+	for _, tt := range tests {
+		if got := durationFactor(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: durationFactor(%g, %g) = %g, want %g", tt.name, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestTitleForms(t *testing.T) {
+	s := &Service{}
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Song (Remastered 2011)", "Song"},
+		{"Song [Official Audio]", "Song"},
+		{"Song feat. Someone", "Song"},
+		{"Song (feat. Someone) - 2011 Remaster", "Song"},
+		{"Song - Radio Edit", "Song"},
+	}
+	for _, tt := range tests {
+		if forms := s.titleForms(tt.title); !slices.Contains(forms, tt.want) {
+			t.Errorf("titleForms(%q) = %q, want it to include %q", tt.title, forms, tt.want)
+		}
+	}
+}
+
+func TestMatchScore(t *testing.T) {
+	s := &Service{}
+	q := &Query{
+		Source:  TrackMeta{Duration: 200},
+		Titles:  []string{"Song", "Artist - Song"},
+		Artists: []string{"Artist"},
+	}
+	tests := []struct {
+		name      string
+		candidate TrackMeta
+		min, max  float64
+	}{
+		{"exact", TrackMeta{Title: "Song", Artist: "Artist", Duration: 201}, 1, 1},
+		{"remaster", TrackMeta{Title: "Song - 2011 Remaster", Artist: "Artist", Duration: 199}, 1, 1},
+		{"featured artist", TrackMeta{Title: "Song (feat. Guest)", Artist: "Artist, Guest", Duration: 200}, 1, 1},
+		{"unknown duration", TrackMeta{Title: "Song", Artist: "Artist"}, 1, 1},
+		{"extended mix", TrackMeta{Title: "Song", Artist: "Artist", Duration: 260}, 0, 0},
+		{"wrong artist", TrackMeta{Title: "Song", Artist: "Somebody Else", Duration: 200}, 0, DefaultMinScore},
+		{"wrong title", TrackMeta{Title: "Another Tune", Artist: "Artist", Duration: 200}, 0, DefaultMinScore},
+	}
+	for _, tt := range tests {
+		if got := s.matchScore(q, &tt.candidate); got < tt.min || got > tt.max {
+			t.Errorf("%s: matchScore = %.3f, want between %g and %g", tt.name, got, tt.min, tt.max)
+		}
+	}
+}
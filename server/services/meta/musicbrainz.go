@@ -0,0 +1,334 @@
+package meta
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gcottom/echodaemon/internal/fingerprint"
+)
+
+// musicBrainzInterval is the least time between MusicBrainz requests allowed by its rate limit
+const musicBrainzInterval = time.Second
+
+// minAcoustIDScore is the least AcoustID match score treated as the same recording
+const minAcoustIDScore = 0.8
+
+var ErrNoAcoustIDKey = errors.New("no acoustid api key configured")
+
+// MusicBrainzClient looks up recordings on the MusicBrainz web service, resolving audio fingerprints to recordings
+// through AcoustID. BaseURL and AcoustIDURL are the API roots, e.g. https://musicbrainz.org/ws/2 and
+// https://api.acoustid.org/v2.
+type MusicBrainzClient struct {
+	BaseURL     string
+	AcoustIDURL string
+	AcoustIDKey string
+	UserAgent   string
+	HTTPClient  *http.Client
+
+	mu       sync.Mutex
+	lastCall time.Time
+}
+
+type acoustIDResponse struct {
+	Status string `json:"status"`
+	Error  *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+	Results []struct {
+		Score      float64 `json:"score"`
+		Recordings []struct {
+			ID string `json:"id"`
+		} `json:"recordings"`
+	} `json:"results"`
+}
+
+type mbSearchResponse struct {
+	Recordings []mbRecording `json:"recordings"`
+}
+
+type mbRecording struct {
+	ID               string           `json:"id"`
+	Title            string           `json:"title"`
+	Length           int              `json:"length"` // milliseconds
+	Score            int              `json:"score"`
+	FirstReleaseDate string           `json:"first-release-date"`
+	ISRCs            []string         `json:"isrcs"`
+	ArtistCredit     []mbArtistCredit `json:"artist-credit"`
+	Releases         []mbRelease      `json:"releases"`
+	// Relations are only included in lookups; composers are credited on the recorded work
+	Relations []struct {
+		Type string `json:"type"`
+		Work *struct {
+			Relations []struct {
+				Type   string `json:"type"`
+				Artist *struct {
+					Name string `json:"name"`
+				} `json:"artist"`
+			} `json:"relations"`
+		} `json:"work"`
+	} `json:"relations"`
+}
+
+type mbArtistCredit struct {
+	Name       string `json:"name"`
+	JoinPhrase string `json:"joinphrase"`
+}
+
+type mbRelease struct {
+	ID           string           `json:"id"`
+	Title        string           `json:"title"`
+	Status       string           `json:"status"`
+	Date         string           `json:"date"`
+	ArtistCredit []mbArtistCredit `json:"artist-credit"`
+	ReleaseGroup struct {
+		ID          string `json:"id"`
+		PrimaryType string `json:"primary-type"`
+	} `json:"release-group"`
+	Media []struct {
+		Position   int       `json:"position"`
+		TrackCount int       `json:"track-count"`
+		Tracks     []mbTrack `json:"tracks"` // lookups
+		Track      []mbTrack `json:"track"`  // searches
+	} `json:"media"`
+}
+
+type mbTrack struct {
+	Position int `json:"position"`
+}
+
+// LookupFingerprint resolves the fingerprint to a MusicBrainz recording through AcoustID. It returns nil when
+// AcoustID has no confident match.
+func (c *MusicBrainzClient) LookupFingerprint(ctx context.Context, fp *fingerprint.Fingerprint) (*MusicBrainzRecording, error) {
+	if c.AcoustIDKey == "" {
+		return nil, ErrNoAcoustIDKey
+	}
+	form := url.Values{
+		"client":      {c.AcoustIDKey},
+		"meta":        {"recordingids"},
+		"duration":    {strconv.Itoa(int(fp.Duration))},
+		"fingerprint": {fp.Encode()},
+		"format":      {"json"},
+	}
+	var res acoustIDResponse
+	if err := c.do(ctx, http.MethodPost, c.AcoustIDURL+"/lookup", form, &res); err != nil {
+		return nil, fmt.Errorf("acoustid lookup failed: %w", err)
+	}
+	if res.Status != "ok" {
+		if res.Error != nil {
+			return nil, fmt.Errorf("acoustid lookup failed: %s", res.Error.Message)
+		}
+		return nil, fmt.Errorf("acoustid lookup failed with status %q", res.Status)
+	}
+	for _, result := range res.Results {
+		if result.Score < minAcoustIDScore || len(result.Recordings) == 0 {
+			continue
+		}
+		recording, err := c.Recording(ctx, result.Recordings[0].ID)
+		if err != nil {
+			return nil, err
+		}
+		recording.Score = result.Score
+		return recording, nil
+	}
+	return nil, nil
+}
+
+// Recording looks up the recording with the given MusicBrainz ID.
+func (c *MusicBrainzClient) Recording(ctx context.Context, id string) (*MusicBrainzRecording, error) {
+	query := url.Values{
+		"inc": {"artist-credits+isrcs+releases+release-groups+media+work-rels+work-level-rels+artist-rels"},
+		"fmt": {"json"},
+	}
+	var rec mbRecording
+	if err := c.do(ctx, http.MethodGet, c.BaseURL+"/recording/"+url.PathEscape(id)+"?"+query.Encode(), nil, &rec); err != nil {
+		return nil, fmt.Errorf("musicbrainz recording lookup failed: %w", err)
+	}
+	recording := rec.resolve()
+	recording.Score = 1
+	return recording, nil
+}
+
+// Search finds recordings by title and artist, best match first.
+func (c *MusicBrainzClient) Search(ctx context.Context, title, artist string) ([]MusicBrainzRecording, error) {
+	query := url.Values{
+		"query": {fmt.Sprintf(`recording:"%s" AND artist:"%s"`, luceneEscape(title), luceneEscape(artist))},
+		"limit": {"5"},
+		"fmt":   {"json"},
+	}
+	var res mbSearchResponse
+	if err := c.do(ctx, http.MethodGet, c.BaseURL+"/recording?"+query.Encode(), nil, &res); err != nil {
+		return nil, fmt.Errorf("musicbrainz search failed: %w", err)
+	}
+	recordings := make([]MusicBrainzRecording, 0, len(res.Recordings))
+	for _, rec := range res.Recordings {
+		recording := rec.resolve()
+		recording.Score = float64(rec.Score) / 100
+		recordings = append(recordings, *recording)
+	}
+	return recordings, nil
+}
+
+// do sends a request and decodes the JSON response into out. MusicBrainz requests are paced to its rate limit.
+func (c *MusicBrainzClient) do(ctx context.Context, method, rawURL string, form url.Values, out any) error {
+	if strings.HasPrefix(rawURL, c.BaseURL) {
+		if err := c.wait(ctx); err != nil {
+			return err
+		}
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", c.UserAgent)
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// AcoustID reports errors in a JSON body, so only MusicBrainz statuses are checked here
+	if resp.StatusCode != http.StatusOK && !(form != nil && resp.StatusCode == http.StatusBadRequest) {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *MusicBrainzClient) wait(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if delay := time.Until(c.lastCall.Add(musicBrainzInterval)); delay > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	c.lastCall = time.Now()
+	return nil
+}
+
+// resolve flattens the recording, picking the release that best represents it
+func (r *mbRecording) resolve() *MusicBrainzRecording {
+	recording := &MusicBrainzRecording{
+		RecordingID: r.ID,
+		Title:       r.Title,
+		Artist:      creditedName(r.ArtistCredit),
+		Composer:    r.composer(),
+		Year:        parseYear(r.FirstReleaseDate),
+		ReleaseDate: r.FirstReleaseDate,
+		Duration:    float64(r.Length) / 1000,
+	}
+	if len(r.ISRCs) > 0 {
+		recording.ISRC = r.ISRCs[0]
+	}
+	if len(r.Releases) == 0 {
+		return recording
+	}
+	release := slices.MinFunc(r.Releases, compareReleases)
+	recording.ReleaseID = release.ID
+	recording.Album = release.Title
+	recording.AlbumArtist = creditedName(release.ArtistCredit)
+	recording.ReleaseGroupID = release.ReleaseGroup.ID
+	if recording.Year == 0 {
+		recording.Year = parseYear(release.Date)
+		recording.ReleaseDate = release.Date
+	}
+	for _, medium := range release.Media {
+		tracks := append(medium.Tracks, medium.Track...)
+		if len(tracks) > 0 {
+			recording.DiscNumber = medium.Position
+			recording.TrackNumber = tracks[0].Position
+			recording.TrackTotal = medium.TrackCount
+			break
+		}
+	}
+	return recording
+}
+
+// composer lists the composers of the works the recording is a performance of
+func (r *mbRecording) composer() string {
+	var composers []string
+	for _, rel := range r.Relations {
+		if rel.Type != "performance" || rel.Work == nil {
+			continue
+		}
+		for _, workRel := range rel.Work.Relations {
+			if workRel.Type == "composer" && workRel.Artist != nil && !slices.Contains(composers, workRel.Artist.Name) {
+				composers = append(composers, workRel.Artist.Name)
+			}
+		}
+	}
+	return strings.Join(composers, ", ")
+}
+
+func creditedName(credits []mbArtistCredit) string {
+	var name strings.Builder
+	for _, credit := range credits {
+		name.WriteString(credit.Name + credit.JoinPhrase)
+	}
+	return name.String()
+}
+
+// compareReleases orders official album releases first, then by earliest release date
+func compareReleases(a, b mbRelease) int {
+	rank := func(r mbRelease) int {
+		n := 0
+		if r.Status != "Official" {
+			n += 2
+		}
+		if r.ReleaseGroup.PrimaryType != "Album" {
+			n++
+		}
+		return n
+	}
+	if c := cmp.Compare(rank(a), rank(b)); c != 0 {
+		return c
+	}
+	// Undated releases sort last
+	switch {
+	case a.Date == "" && b.Date != "":
+		return 1
+	case a.Date != "" && b.Date == "":
+		return -1
+	}
+	return strings.Compare(a.Date, b.Date)
+}
+
+func parseYear(date string) int {
+	if len(date) < 4 {
+		return 0
+	}
+	year, err := strconv.Atoi(date[:4])
+	if err != nil {
+		return 0
+	}
+	return year
+}
+
+var luceneReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func luceneEscape(s string) string {
+	return luceneReplacer.Replace(s)
+}
@@ -0,0 +1,262 @@
+package meta
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gcottom/echodaemon/internal/fingerprint"
+)
+
+// newTestMusicBrainz returns a client whose MusicBrainz and AcoustID roots both point at handler, under /ws/2 and /v2
+func newTestMusicBrainz(t *testing.T, handler http.HandlerFunc) *MusicBrainzClient {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &MusicBrainzClient{
+		BaseURL:     srv.URL + "/ws/2",
+		AcoustIDURL: srv.URL + "/v2",
+		AcoustIDKey: "key",
+		UserAgent:   "echo-daemon-test/1.0",
+		HTTPClient:  srv.Client(),
+	}
+}
+
+func TestMusicBrainzSearch(t *testing.T) {
+	client := newTestMusicBrainz(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws/2/recording" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if got := r.Header.Get("User-Agent"); got != "echo-daemon-test/1.0" {
+			t.Errorf("User-Agent = %q", got)
+		}
+		want := `recording:"Say \"Hi\"" AND artist:"AC\\DC"`
+		if got := r.URL.Query().Get("query"); got != want {
+			t.Errorf("query = %q, want %q", got, want)
+		}
+		w.Write([]byte(`{"recordings": [
+			{"id": "rec-1", "title": "Say \"Hi\"", "score": 100, "length": 215000,
+			 "artist-credit": [{"name": "AC/DC"}],
+			 "releases": [{"id": "rel-1", "title": "Album", "status": "Official", "date": "1990-05-01",
+			   "release-group": {"id": "rg-1", "primary-type": "Album"},
+			   "media": [{"position": 1, "track-count": 10, "track": [{"position": 3}]}]}]},
+			{"id": "rec-2", "title": "Say Hi (live)", "score": 85, "artist-credit": [{"name": "AC/DC"}]}
+		]}`))
+	})
+
+	recordings, err := client.Search(context.Background(), `Say "Hi"`, `AC\DC`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recordings) != 2 {
+		t.Fatalf("got %d recordings, want 2", len(recordings))
+	}
+	first := recordings[0]
+	if first.Score != 1 || recordings[1].Score != 0.85 {
+		t.Errorf("scores = %g, %g, want 1, 0.85", first.Score, recordings[1].Score)
+	}
+	if first.RecordingID != "rec-1" || first.ReleaseID != "rel-1" || first.ReleaseGroupID != "rg-1" || first.Album != "Album" {
+		t.Errorf("unexpected release fields: %+v", first)
+	}
+	if first.TrackNumber != 3 || first.TrackTotal != 10 || first.DiscNumber != 1 {
+		t.Errorf("track %d/%d disc %d, want 3/10 disc 1", first.TrackNumber, first.TrackTotal, first.DiscNumber)
+	}
+	if first.Duration != 215 || first.Year != 1990 {
+		t.Errorf("duration %g year %d, want 215 and 1990", first.Duration, first.Year)
+	}
+}
+
+func TestMusicBrainzRecording(t *testing.T) {
+	client := newTestMusicBrainz(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws/2/recording/rec-1" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if inc := r.URL.Query().Get("inc"); !strings.Contains(inc, "work-level-rels") {
+			t.Errorf("inc %q doesn't ask for work relations", inc)
+		}
+		w.Write([]byte(`{"id": "rec-1", "title": "Song", "length": 180500, "isrcs": ["USABC0000001"],
+			"artist-credit": [{"name": "Singer", "joinphrase": " feat. "}, {"name": "Guest"}],
+			"relations": [
+				{"type": "performance", "work": {"relations": [
+					{"type": "composer", "artist": {"name": "Writer One"}},
+					{"type": "lyricist", "artist": {"name": "Lyricist"}},
+					{"type": "composer", "artist": {"name": "Writer Two"}},
+					{"type": "composer", "artist": {"name": "Writer One"}}]}},
+				{"type": "remix", "work": {"relations": [{"type": "composer", "artist": {"name": "Remixer"}}]}}
+			],
+			"releases": [
+				{"id": "bootleg", "title": "Early Bootleg", "status": "Bootleg", "date": "1998",
+				 "release-group": {"id": "rg-b", "primary-type": "Album"}},
+				{"id": "single", "title": "Song", "status": "Official", "date": "1999-01-01",
+				 "release-group": {"id": "rg-s", "primary-type": "Single"}},
+				{"id": "undated", "title": "Album", "status": "Official",
+				 "release-group": {"id": "rg-a", "primary-type": "Album"}},
+				{"id": "reissue", "title": "Album (Deluxe)", "status": "Official", "date": "2010-06-01",
+				 "release-group": {"id": "rg-a", "primary-type": "Album"}},
+				{"id": "album", "title": "Album", "status": "Official", "date": "1999-03-15",
+				 "artist-credit": [{"name": "Singer"}],
+				 "release-group": {"id": "rg-a", "primary-type": "Album"},
+				 "media": [
+					{"position": 1, "track-count": 11, "tracks": []},
+					{"position": 2, "track-count": 9, "tracks": [{"position": 4}]}]}
+			]}`))
+	})
+
+	recording, err := client.Recording(context.Background(), "rec-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recording.ReleaseID != "album" {
+		t.Errorf("release = %q, want the earliest official album", recording.ReleaseID)
+	}
+	if recording.Artist != "Singer feat. Guest" || recording.AlbumArtist != "Singer" {
+		t.Errorf("artist %q album artist %q", recording.Artist, recording.AlbumArtist)
+	}
+	if recording.Composer != "Writer One, Writer Two" {
+		t.Errorf("composer = %q, want %q", recording.Composer, "Writer One, Writer Two")
+	}
+	if recording.DiscNumber != 2 || recording.TrackNumber != 4 || recording.TrackTotal != 9 {
+		t.Errorf("track %d/%d disc %d, want 4/9 disc 2", recording.TrackNumber, recording.TrackTotal, recording.DiscNumber)
+	}
+	if recording.ISRC != "USABC0000001" || recording.Duration != 180.5 || recording.Score != 1 {
+		t.Errorf("isrc %q duration %g score %g", recording.ISRC, recording.Duration, recording.Score)
+	}
+	if recording.Year != 1999 || recording.ReleaseDate != "1999-03-15" {
+		t.Errorf("year %d date %q, want the release's date when the recording has none", recording.Year, recording.ReleaseDate)
+	}
+}
+
+func TestCompareReleases(t *testing.T) {
+	album := func(status, primaryType, date string) mbRelease {
+		r := mbRelease{Status: status, Date: date}
+		r.ReleaseGroup.PrimaryType = primaryType
+		return r
+	}
+	tests := []struct {
+		name string
+		a, b mbRelease
+		want int
+	}{
+		{"official before bootleg", album("Official", "Album", "2000"), album("Bootleg", "Album", "1990"), -1},
+		{"album before single", album("Official", "Album", "2000"), album("Official", "Single", "1990"), -1},
+		{"official single before bootleg album", album("Official", "Single", "2000"), album("Bootleg", "Album", "1990"), -1},
+		{"earlier date first", album("Official", "Album", "1999-03"), album("Official", "Album", "2001"), -1},
+		{"undated last", album("Official", "Album", ""), album("Official", "Album", "2001"), 1},
+		{"equal", album("Official", "Album", "2001"), album("Official", "Album", "2001"), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compareReleases(tt.a, tt.b); got != tt.want {
+				t.Errorf("compareReleases = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMusicBrainzLookupFingerprint(t *testing.T) {
+	fp := &fingerprint.Fingerprint{Values: []uint32{1, 2, 3, 4}, Duration: 201.7}
+	tests := []struct {
+		name     string
+		status   int
+		acoustID string
+		noKey    bool
+		wantID   string
+		wantErr  string
+	}{
+		{
+			name:     "confident match",
+			status:   http.StatusOK,
+			acoustID: `{"status": "ok", "results": [{"score": 0.93, "recordings": [{"id": "rec-1"}]}]}`,
+			wantID:   "rec-1",
+		},
+		{
+			name:     "skips results without recordings",
+			status:   http.StatusOK,
+			acoustID: `{"status": "ok", "results": [{"score": 0.99}, {"score": 0.85, "recordings": [{"id": "rec-1"}]}]}`,
+			wantID:   "rec-1",
+		},
+		{
+			name:     "below threshold",
+			status:   http.StatusOK,
+			acoustID: `{"status": "ok", "results": [{"score": 0.79, "recordings": [{"id": "rec-1"}]}]}`,
+		},
+		{
+			name:     "no results",
+			status:   http.StatusOK,
+			acoustID: `{"status": "ok", "results": []}`,
+		},
+		{
+			name:     "error body",
+			status:   http.StatusBadRequest,
+			acoustID: `{"status": "error", "error": {"code": 4, "message": "invalid API key"}}`,
+			wantErr:  "invalid API key",
+		},
+		{
+			name:     "server error",
+			status:   http.StatusInternalServerError,
+			acoustID: `oops`,
+			wantErr:  "unexpected status",
+		},
+		{
+			name:    "no key",
+			noKey:   true,
+			wantErr: ErrNoAcoustIDKey.Error(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var recordingLookups int
+			client := newTestMusicBrainz(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v2/lookup":
+					if err := r.ParseForm(); err != nil {
+						t.Error(err)
+					}
+					if r.PostForm.Get("client") != "key" || r.PostForm.Get("duration") != "201" || r.PostForm.Get("fingerprint") != fp.Encode() {
+						t.Errorf("unexpected lookup form %v", r.PostForm)
+					}
+					w.WriteHeader(tt.status)
+					w.Write([]byte(tt.acoustID))
+				case "/ws/2/recording/rec-1":
+					recordingLookups++
+					w.Write([]byte(`{"id": "rec-1", "title": "Song", "artist-credit": [{"name": "Singer"}]}`))
+				default:
+					t.Errorf("unexpected path %s", r.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+			if tt.noKey {
+				client.AcoustIDKey = ""
+			}
+
+			recording, err := client.LookupFingerprint(context.Background(), fp)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				if tt.noKey && !errors.Is(err, ErrNoAcoustIDKey) {
+					t.Errorf("err = %v, want ErrNoAcoustIDKey", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantID == "" {
+				if recording != nil || recordingLookups != 0 {
+					t.Fatalf("got %+v after %d lookups, want no match", recording, recordingLookups)
+				}
+				return
+			}
+			if recording == nil || recording.RecordingID != tt.wantID {
+				t.Fatalf("got %+v, want recording %s", recording, tt.wantID)
+			}
+			if recording.Score < minAcoustIDScore || recording.Score == 1 {
+				t.Errorf("score = %g, want the AcoustID score", recording.Score)
+			}
+		})
+	}
+}
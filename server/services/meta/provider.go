@@ -0,0 +1,254 @@
+package meta
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gcottom/echodaemon/config"
+	"github.com/gcottom/echodaemon/internal/fingerprint"
+	"github.com/gcottom/echodaemon/logger"
+	"github.com/gcottom/echodaemon/services/coverart"
+)
+
+// MetadataProvider proposes metadata for a track. Providers only need to fill in the fields they know; the
+// merger takes each field from the highest priority provider that supplied it.
+type MetadataProvider interface {
+	// Name identifies the provider in settings.yaml and in the sources recorded on merged metadata
+	Name() string
+	Candidates(ctx context.Context, q *Query) ([]Candidate, error)
+}
+
+// Query describes the track being looked up. Source is the metadata of the YouTube video, which the title and
+// artist variants used to judge candidates are derived from.
+type Query struct {
+	ID          string
+	Source      TrackMeta
+	Fingerprint *fingerprint.Fingerprint
+	// AudioPath is the converted track, for providers that analyze the audio itself
+	AudioPath string
+
+	SanitizedTitle string
+	CoverArtist    string
+	Titles         []string
+	Artists        []string
+}
+
+// Candidate is one provider's proposal for the track's metadata
+type Candidate struct {
+	Meta TrackMeta
+	// Confidence is the provider's own certainty that the candidate describes the track, from 0 to 1
+	Confidence float64
+	// AudioMatch is set when the candidate was identified from the audio, so its title isn't compared to the video's
+	AudioMatch bool
+}
+
+type rankedCandidate struct {
+	Candidate
+	score float64
+}
+
+// Merged fields; Title, Artist and Duration are taken together so they always describe the same release. The genre
+// is merged separately by mergeGenre.
+var mergeFields = []struct {
+	name string
+	has  func(m *TrackMeta) bool
+	copy func(dst, src *TrackMeta)
+}{
+	{"title", func(m *TrackMeta) bool { return m.Title != "" && m.Artist != "" }, func(dst, src *TrackMeta) {
+		dst.Title, dst.Artist, dst.Duration = src.Title, src.Artist, src.Duration
+	}},
+	{"album", func(m *TrackMeta) bool { return m.Album != "" }, func(dst, src *TrackMeta) { dst.Album = src.Album }},
+	{"cover_art", func(m *TrackMeta) bool { return m.CoverArtURL != "" }, func(dst, src *TrackMeta) { dst.CoverArtURL = src.CoverArtURL }},
+	{"mood", func(m *TrackMeta) bool { return len(m.Moods) > 0 }, func(dst, src *TrackMeta) { dst.Moods = src.Moods }},
+	{"instruments", func(m *TrackMeta) bool { return len(m.Instruments) > 0 }, func(dst, src *TrackMeta) {
+		dst.Instruments = src.Instruments
+	}},
+	{"album_artist", func(m *TrackMeta) bool { return m.AlbumArtist != "" }, func(dst, src *TrackMeta) { dst.AlbumArtist = src.AlbumArtist }},
+	{"composer", func(m *TrackMeta) bool { return m.Composer != "" }, func(dst, src *TrackMeta) { dst.Composer = src.Composer }},
+	{"year", func(m *TrackMeta) bool { return m.Year != 0 }, func(dst, src *TrackMeta) {
+		dst.Year, dst.ReleaseDate = src.Year, src.ReleaseDate
+	}},
+	{"track_number", func(m *TrackMeta) bool { return m.TrackNumber != 0 }, func(dst, src *TrackMeta) {
+		dst.TrackNumber, dst.TrackTotal, dst.DiscNumber = src.TrackNumber, src.TrackTotal, src.DiscNumber
+	}},
+	{"isrc", func(m *TrackMeta) bool { return m.ISRC != "" }, func(dst, src *TrackMeta) { dst.ISRC = src.ISRC }},
+	{"musicbrainz", func(m *TrackMeta) bool { return m.MusicBrainzRecordingID != "" }, func(dst, src *TrackMeta) {
+		dst.MusicBrainzRecordingID = src.MusicBrainzRecordingID
+		dst.MusicBrainzReleaseID = src.MusicBrainzReleaseID
+		dst.MusicBrainzReleaseGroupID = src.MusicBrainzReleaseGroupID
+	}},
+}
+
+// UseProviders enables the named providers from available, in priority order.
+func (s *Service) UseProviders(names []string, available map[string]MetadataProvider) error {
+	providers := make([]MetadataProvider, 0, len(names))
+	for _, name := range names {
+		provider, ok := available[name]
+		if !ok {
+			return fmt.Errorf("unknown metadata provider %q", name)
+		}
+		providers = append(providers, provider)
+	}
+	s.Providers = providers
+	return nil
+}
+
+// newQuery derives the title and artist variants that candidates are matched against from the video's metadata
+func (s *Service) newQuery(ctx context.Context, id string, source TrackMeta, audioPath string, fp *fingerprint.Fingerprint) *Query {
+	q := &Query{ID: id, Source: source, AudioPath: audioPath, Fingerprint: fp}
+	q.CoverArtist = s.CoverArtistCheck(ctx, source.Title)
+	if q.CoverArtist != "" {
+		logger.InfoC(ctx, "cover artist found", slog.String("coverArtist", q.CoverArtist))
+	}
+	q.SanitizedTitle = s.SanitizeString(s.SanitizeParenthesis(source.Title))
+	logger.InfoC(ctx, "sanitized title", slog.String("title", q.SanitizedTitle))
+	q.Titles, q.Artists = s.titleArtistVariants(ctx, source, q.SanitizedTitle, q.CoverArtist)
+	return q
+}
+
+// score rates how well a candidate matches the track, returning 0 when it falls short of the service's minimum
+// match score. Candidates without a title, such as genre-only ones, and candidates identified from the audio
+// aren't compared to the video and keep the provider's confidence.
+func (s *Service) score(q *Query, c *Candidate) float64 {
+	if c.AudioMatch || (c.Meta.Title == "" && c.Meta.Artist == "") {
+		return c.Confidence
+	}
+	match := s.matchScore(q, &c.Meta)
+	if match < s.minScore() {
+		return 0
+	}
+	return match * c.Confidence
+}
+
+func (s *Service) minScore() float64 {
+	if s.MinScore <= 0 {
+		return DefaultMinScore
+	}
+	return s.MinScore
+}
+
+// mergeCandidates asks every provider for candidates in parallel, drops the ones that don't match the track and
+// fills each field from the first provider, in priority order, whose best remaining candidate has it; a provider's
+// other candidates are never used. Every provider's cover art is kept as a fallback, with the video thumbnail last.
+// Under GenrePolicyMLFallback the classifier is only asked once the other providers are done, and only if Spotify
+// found no genres.
+func (s *Service) mergeCandidates(ctx context.Context, q *Query) *TrackMeta {
+	ranked := make([][]rankedCandidate, len(s.Providers))
+	deferClassifier := s.genrePolicy() == config.GenrePolicyMLFallback
+	var wg sync.WaitGroup
+	for i, provider := range s.Providers {
+		if deferClassifier && provider.Name() == ProviderClassifier {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ranked[i] = s.rankCandidates(ctx, q, provider)
+		}()
+	}
+	wg.Wait()
+	if i := s.providerIndex(ProviderClassifier); deferClassifier && i >= 0 {
+		if genres := s.providerGenres(ranked, ProviderSpotify); len(genres) > 0 {
+			logger.InfoC(ctx, "spotify has genres, skipping the classifier", slog.Any("genres", genres))
+		} else {
+			ranked[i] = s.rankCandidates(ctx, q, s.Providers[i])
+		}
+	}
+
+	// Each provider contributes only its best candidate, so one provider's fields never mix different recordings
+	best := make([]*rankedCandidate, len(s.Providers))
+	for i := range ranked {
+		if len(ranked[i]) > 0 {
+			best[i] = &ranked[i][0]
+		}
+	}
+	merged := &TrackMeta{ID: q.ID, Sources: make(map[string]string)}
+	for _, field := range mergeFields {
+		for i, provider := range s.Providers {
+			if best[i] != nil && field.has(&best[i].Meta) {
+				field.copy(merged, &best[i].Meta)
+				merged.Sources[field.name] = provider.Name()
+				if field.name == "title" {
+					merged.MatchScore = best[i].score
+				}
+				break
+			}
+		}
+	}
+	s.mergeGenre(merged, ranked)
+	for i, provider := range s.Providers {
+		if best[i] != nil && best[i].Meta.CoverArtURL != "" {
+			merged.CoverArtSources = append(merged.CoverArtSources, coverart.Source{Provider: provider.Name(), URL: best[i].Meta.CoverArtURL, AlbumArt: provider.Name() != ProviderYouTube})
+		}
+	}
+	if q.Source.CoverArtURL != "" && !slices.ContainsFunc(merged.CoverArtSources, func(c coverart.Source) bool { return c.URL == q.Source.CoverArtURL }) {
+		merged.CoverArtSources = append(merged.CoverArtSources, coverart.Source{Provider: ProviderYouTube, URL: q.Source.CoverArtURL})
+	}
+	logger.InfoC(ctx, "merged metadata", slog.Any("meta", merged))
+	return merged
+}
+
+// rankCandidates returns the provider's candidates that match the track, best first
+func (s *Service) rankCandidates(ctx context.Context, q *Query, provider MetadataProvider) []rankedCandidate {
+	candidates, err := provider.Candidates(ctx, q)
+	if err != nil {
+		logger.ErrorC(ctx, "metadata provider failed", slog.String("provider", provider.Name()), slog.Any("error", err))
+	}
+	matched := make([]rankedCandidate, 0, len(candidates))
+	for _, c := range candidates {
+		if score := s.score(q, &c); score > 0 {
+			matched = append(matched, rankedCandidate{Candidate: c, score: score})
+		}
+	}
+	slices.SortStableFunc(matched, func(a, b rankedCandidate) int {
+		return cmp.Compare(b.score, a.score)
+	})
+	logger.InfoC(ctx, "metadata candidates", slog.String("provider", provider.Name()), slog.Int("found", len(candidates)), slog.Int("matched", len(matched)))
+	return matched
+}
+
+// titleArtistVariants lists the titles and artists a matching candidate may carry: the video title with and without
+// bracketed parts and "feat." credits, every run of its dash or colon separated parts (as titles and as artists),
+// and the channel and cover artist names
+func (s *Service) titleArtistVariants(ctx context.Context, source TrackMeta, sanitizedTitle, coverArtist string) ([]string, []string) {
+	featStrippedTitle := featuring.ReplaceAllString(sanitizedTitle, "")
+	logger.InfoC(ctx, "feat stripped title", slog.String("title", featStrippedTitle))
+	titles := []string{source.Title, sanitizedTitle, featStrippedTitle}
+	artists := []string{source.Artist, s.SanitizeAuthor(source.Artist)}
+	if coverArtist != "" {
+		artists = append(artists, s.SanitizeAuthor(coverArtist))
+	}
+	for _, title := range []string{sanitizedTitle, featStrippedTitle} {
+		parts := strings.Split(strings.ReplaceAll(title, ":", "-"), "-")
+		// Any part, or run of adjacent parts short of the whole title, may be the song title or the artist
+		for start := range parts {
+			for end := start + 1; end <= len(parts); end++ {
+				if end-start == len(parts) && len(parts) > 1 {
+					continue
+				}
+				span := strings.Join(parts[start:end], " ")
+				titles = append(titles, span)
+				if len(parts) > 1 {
+					artists = append(artists, s.SanitizeAuthor(span))
+				}
+			}
+		}
+	}
+	for i, title := range titles {
+		titles[i] = strings.Join(strings.Fields(title), " ")
+	}
+	for i, artist := range artists {
+		artists[i] = strings.Join(strings.Fields(artist), " ")
+	}
+	slices.Sort(titles)
+	slices.Sort(artists)
+	titles, artists = slices.Compact(titles), slices.Compact(artists)
+	logger.InfoC(ctx, "titles", slog.Any("titles", titles))
+	logger.InfoC(ctx, "artists", slog.Any("artists", artists))
+	return titles, artists
+}
@@ -0,0 +1,159 @@
+package meta
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/gcottom/echodaemon/logger"
+	"github.com/gcottom/echodaemon/services/classifier"
+	"github.com/gcottom/retry"
+)
+
+// Built-in metadata provider names
+const (
+	ProviderSpotify     = "spotify"
+	ProviderMusicBrainz = "musicbrainz"
+	ProviderClassifier  = "classifier"
+	ProviderYouTube     = "youtube"
+)
+
+// BuiltinProviders returns the providers that ship with the daemon, keyed by name. The musicbrainz provider is
+// only available when s.MusicBrainz is set and the classifier provider when s.Classifier is.
+func (s *Service) BuiltinProviders() map[string]MetadataProvider {
+	providers := map[string]MetadataProvider{
+		ProviderSpotify: &spotifyProvider{s: s},
+		ProviderYouTube: &youTubeProvider{},
+	}
+	if s.MusicBrainz != nil {
+		providers[ProviderMusicBrainz] = &musicBrainzProvider{s: s}
+	}
+	if s.Classifier != nil {
+		taxonomy := s.Taxonomy
+		if taxonomy == nil {
+			taxonomy = classifier.DefaultTaxonomy
+		}
+		providers[ProviderClassifier] = &classifierProvider{
+			classifier: s.Classifier,
+			taxonomy:   taxonomy,
+			threshold:  s.TagThreshold,
+			maxGenres:  s.MaxGenres,
+		}
+	}
+	return providers
+}
+
+// youTubeProvider proposes the video's own title and channel, cleaned up, as the fallback when nothing better matches
+type youTubeProvider struct{}
+
+func (p *youTubeProvider) Name() string { return ProviderYouTube }
+
+func (p *youTubeProvider) Candidates(ctx context.Context, q *Query) ([]Candidate, error) {
+	return []Candidate{{
+		Meta:       TrackMeta{Title: q.SanitizedTitle, Artist: q.Source.Artist, CoverArtURL: q.Source.CoverArtURL, Duration: q.Source.Duration},
+		Confidence: 0.5,
+	}}, nil
+}
+
+// spotifyProvider proposes Spotify search results for the video's title and artist, retrying with the cleaned up
+// title and any cover artist when the raw title finds nothing
+type spotifyProvider struct {
+	s *Service
+}
+
+func (p *spotifyProvider) Name() string { return ProviderSpotify }
+
+func (p *spotifyProvider) Candidates(ctx context.Context, q *Query) ([]Candidate, error) {
+	res, err := retry.Retry(retry.NewAlgSimpleDefault(), 3, p.s.GetSpotifyMeta, ctx, q.Source)
+	if err != nil {
+		return nil, err
+	}
+	spotifyMetas := res[0].([]TrackMeta)
+	if len(spotifyMetas) == 0 {
+		spotifyMetas, err = p.s.GetSpotifyMeta(ctx, TrackMeta{Title: q.SanitizedTitle, Artist: q.Source.Artist, ID: q.ID})
+		if err != nil {
+			return nil, err
+		}
+		if q.CoverArtist != "" {
+			caSpotifyMetas, err := p.s.GetSpotifyMeta(ctx, TrackMeta{Title: q.SanitizedTitle, Artist: q.CoverArtist, ID: q.ID})
+			if err != nil {
+				return nil, err
+			}
+			spotifyMetas = append(spotifyMetas, caSpotifyMetas...)
+		}
+	}
+	candidates := make([]Candidate, 0, len(spotifyMetas))
+	for _, spotifyMeta := range spotifyMetas {
+		candidates = append(candidates, Candidate{Meta: spotifyMeta, Confidence: 1})
+	}
+	// Only the best match can contribute genres, so only its artists are looked up
+	best, bestScore := -1, 0.0
+	for i := range candidates {
+		if score := p.s.score(q, &candidates[i]); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best >= 0 {
+		p.s.addSpotifyGenres(ctx, &candidates[best].Meta)
+	}
+	return candidates, nil
+}
+
+// musicBrainzProvider proposes the MusicBrainz recording identified by the track's fingerprint through AcoustID,
+// or found by searching for the video's cleaned up title and artist
+type musicBrainzProvider struct {
+	s *Service
+}
+
+func (p *musicBrainzProvider) Name() string { return ProviderMusicBrainz }
+
+func (p *musicBrainzProvider) Candidates(ctx context.Context, q *Query) ([]Candidate, error) {
+	client := p.s.MusicBrainz
+	if q.Fingerprint != nil && client.AcoustIDKey != "" {
+		recording, err := client.LookupFingerprint(ctx, q.Fingerprint)
+		if err != nil {
+			logger.ErrorC(ctx, "failed to look up fingerprint, searching musicbrainz instead", slog.Any("error", err))
+		} else if recording != nil {
+			return []Candidate{{Meta: recording.trackMeta(), Confidence: recording.Score, AudioMatch: true}}, nil
+		}
+	}
+	recordings, err := client.Search(ctx, q.SanitizedTitle, q.Source.Artist)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]Candidate, 0, len(recordings))
+	for _, recording := range recordings {
+		candidates = append(candidates, Candidate{Meta: recording.trackMeta(), Confidence: recording.Score})
+	}
+	return candidates, nil
+}
+
+// classifierProvider proposes the genres, moods and instruments detected from the audio by the genre classifier
+type classifierProvider struct {
+	classifier classifier.GenreClassifier
+	taxonomy   *classifier.Taxonomy
+	threshold  float64
+	maxGenres  int
+}
+
+func (p *classifierProvider) Name() string { return ProviderClassifier }
+
+func (p *classifierProvider) Candidates(ctx context.Context, q *Query) ([]Candidate, error) {
+	logger.InfoC(ctx, "starting meta genre enrichment", slog.String("id", q.ID))
+	res, err := p.classifier.Classify(ctx, q.AudioPath)
+	if err != nil {
+		return nil, fmt.Errorf("genre classification failed: %w", err)
+	}
+	if res == nil {
+		return nil, nil
+	}
+	labels := p.taxonomy.Labels(res, p.threshold, p.maxGenres)
+	logger.InfoC(ctx, "classified track", slog.Any("genres", labels.Genres), slog.Any("moods", labels.Moods), slog.Any("instruments", labels.Instruments))
+	return []Candidate{{Meta: TrackMeta{
+		Genre:       strings.Join(labels.Genres, "; "),
+		Genres:      labels.Genres,
+		Moods:       labels.Moods,
+		Instruments: labels.Instruments,
+	}, Confidence: 1}}, nil
+}
@@ -0,0 +1,57 @@
+package meta
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/gcottom/echodaemon/services/classifier"
+)
+
+func TestClassifierProvider(t *testing.T) {
+	fake := &classifier.Fake{Result: &classifier.Result{Genre: "Hip-Hop", Tags: map[string]float64{
+		"Hip-Hop": 0.6, "rnb": 0.4, "pop": 0.3, "rock": 0.25, "jazz": 0.05,
+		"sad": 0.5, "piano": 0.3, "male vocalists": 0.9,
+	}}}
+	s := &Service{Classifier: fake, TagThreshold: 0.2, MaxGenres: 3}
+	provider, ok := s.BuiltinProviders()[ProviderClassifier]
+	if !ok {
+		t.Fatal("classifier provider missing with a classifier set")
+	}
+
+	candidates, err := provider.Candidates(context.Background(), &Query{ID: "id", AudioPath: "track.mp3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("got %d candidates, want 1", len(candidates))
+	}
+	got := candidates[0].Meta
+	if want := []string{"Hip-Hop", "R&B", "Pop"}; !slices.Equal(got.Genres, want) {
+		t.Errorf("genres = %v, want %v", got.Genres, want)
+	}
+	if got.Genre != "Hip-Hop; R&B; Pop" {
+		t.Errorf("genre = %q", got.Genre)
+	}
+	if !slices.Equal(got.Moods, []string{"Sad"}) || !slices.Equal(got.Instruments, []string{"Piano"}) {
+		t.Errorf("moods %v instruments %v", got.Moods, got.Instruments)
+	}
+	if calls := fake.Calls(); !slices.Equal(calls, []string{"track.mp3"}) {
+		t.Errorf("classified %v, want the query's audio path", calls)
+	}
+}
+
+func TestClassifierProviderError(t *testing.T) {
+	s := &Service{Classifier: &classifier.Fake{Err: classifier.ErrNotReady}}
+	_, err := s.BuiltinProviders()[ProviderClassifier].Candidates(context.Background(), &Query{AudioPath: "track.mp3"})
+	if !errors.Is(err, classifier.ErrNotReady) {
+		t.Fatalf("err = %v, want the classifier's error", err)
+	}
+}
+
+func TestClassifierProviderUnavailable(t *testing.T) {
+	if _, ok := (&Service{}).BuiltinProviders()[ProviderClassifier]; ok {
+		t.Fatal("classifier provider available without a classifier")
+	}
+}
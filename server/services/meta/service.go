@@ -2,84 +2,113 @@ package meta
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
-	"image"
 	"log/slog"
-	"net/http"
+	"maps"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
+	"unicode"
 
 	"github.com/gcottom/audiometa/v3"
 	"github.com/gcottom/echodaemon/internal"
+	"github.com/gcottom/echodaemon/internal/customtags"
+	"github.com/gcottom/echodaemon/internal/fingerprint"
 	"github.com/gcottom/echodaemon/logger"
+	"github.com/gcottom/echodaemon/services/coverart"
 	"github.com/gcottom/retry"
 	"github.com/zmb3/spotify/v2"
 	spotifyauth "github.com/zmb3/spotify/v2/auth"
 	"golang.org/x/oauth2"
 )
 
-type GenreResponse struct {
-	Genre string `json:"genre"`
-}
-
-func (s *Service) AddMeta(ctx context.Context, id string, filepath string) ([]byte, error) {
-	trackMeta, err := s.GetBestMeta(ctx, id)
+// AddMeta looks up the best metadata for the track and writes it into the file at filepath along with any extra
+// fields, returning the tagged file and the metadata that was chosen. duration is the length in seconds of the
+// captured audio, or 0 when unknown, and fp is the track's audio fingerprint, or nil when it couldn't be computed.
+func (s *Service) AddMeta(ctx context.Context, id string, filepath string, duration float64, fp *fingerprint.Fingerprint, extra *customtags.Tags) ([]byte, *TrackMeta, error) {
+	trackMeta, err := s.GetBestMeta(ctx, id, filepath, duration, fp)
 	if err != nil {
 		logger.ErrorC(ctx, "failed to get best meta", slog.Any("error", err))
-		return nil, err
-	}
-	logger.InfoC(ctx, "starting meta genre enrichment", slog.String("id", id))
-	res, err := internal.OSExecuteFindJSONStart(ctx, "python", "./python/genre-service/genre-service.py", filepath)
-	if err != nil {
-		logger.ErrorC(ctx, "failed to add meta", slog.Any("error", err))
+		return nil, nil, err
 	}
-	var genreRes GenreResponse
-	if err = json.Unmarshal(res, &genreRes); err != nil {
-		logger.ErrorC(ctx, "failed to unmarshal genre response", slog.Any("error", err))
-	}
-	trackMeta.Genre = genreRes.Genre
 	out := new(bytes.Buffer)
 
 	f, err := os.Open(filepath)
 	if err != nil {
 		logger.ErrorC(ctx, "failed to open file", slog.Any("error", err))
-		return nil, err
+		return nil, nil, err
 	}
 	defer f.Close()
 	tag, err := audiometa.OpenTag(f)
 	if err != nil {
 		logger.ErrorC(ctx, "failed to open tag", slog.Any("error", err))
-		return nil, err
+		return nil, nil, err
 	}
 	tag.SetAlbum(strings.TrimSpace(trackMeta.Album))
 	tag.SetArtist(strings.TrimSpace(trackMeta.Artist))
 	tag.SetTitle(strings.TrimSpace(trackMeta.Title))
 	tag.SetGenre(strings.TrimSpace(trackMeta.Genre))
-	if trackMeta.CoverArtURL != "" {
-		response, err := http.Get(trackMeta.CoverArtURL)
-		if err != nil {
-			logger.ErrorC(ctx, "failed to get cover art", slog.Any("error", err))
-			return nil, err
-		}
-		defer response.Body.Close()
-		img, _, err := image.Decode(response.Body)
-		if err != nil {
-			logger.ErrorC(ctx, "failed to decode cover art", slog.Any("error", err))
-			return nil, err
-		}
-		tag.SetCoverArt(&img)
+	if trackMeta.AlbumArtist != "" {
+		tag.SetAlbumArtist(strings.TrimSpace(trackMeta.AlbumArtist))
+	}
+	if trackMeta.Composer != "" {
+		tag.SetComposer(strings.TrimSpace(trackMeta.Composer))
+	}
+	if trackMeta.TrackNumber > 0 {
+		tag.SetTrackNumber(trackMeta.TrackNumber)
+		tag.SetTrackTotal(trackMeta.TrackTotal)
+		tag.SetDiscNumber(trackMeta.DiscNumber)
 	}
 	if err = tag.Save(out); err != nil {
 		logger.ErrorC(ctx, "failed to save tag", slog.Any("error", err))
-		return nil, err
+		return nil, nil, err
+	}
+	fields := trackMeta.customFields()
+	if extra != nil {
+		maps.Copy(fields, extra.Fields)
+	}
+	custom := &customtags.Tags{Fields: fields}
+	// The cover goes through customtags since audiometa picks the image encoding itself
+	if cover := s.coverArt(ctx, trackMeta); cover != nil {
+		custom.Cover = cover.Picture()
 	}
-	return out.Bytes(), nil
+	tagged, err := customtags.Write(out.Bytes(), custom)
+	if err != nil {
+		logger.ErrorC(ctx, "failed to write extra tags", slog.Any("error", err))
+		return nil, nil, err
+	}
+	return tagged, trackMeta, nil
 }
 
-func (s *Service) GetBestMeta(ctx context.Context, id string) (*TrackMeta, error) {
+// coverArt fetches the first available of the track's cover art sources and records where it came from. A track
+// without any is tagged without cover art.
+func (s *Service) coverArt(ctx context.Context, trackMeta *TrackMeta) *coverart.Cover {
+	delete(trackMeta.Sources, "cover_art")
+	if s.CoverArt == nil {
+		return nil
+	}
+	var album string
+	if trackMeta.Album != "" {
+		album = cmp.Or(trackMeta.AlbumArtist, trackMeta.Artist) + "\x00" + trackMeta.Album
+	}
+	cover := s.CoverArt.Fetch(ctx, album, trackMeta.CoverArtSources)
+	if cover == nil {
+		trackMeta.CoverArtURL = ""
+		return nil
+	}
+	trackMeta.CoverArt = cover
+	trackMeta.CoverArtURL = cmp.Or(cover.URL, trackMeta.CoverArtURL)
+	trackMeta.Sources["cover_art"] = cover.Source
+	return cover
+}
+
+// GetBestMeta looks up the video's own metadata and merges the candidates the enabled providers propose for it.
+// Candidates whose length differs from duration by more than a few seconds score lower.
+func (s *Service) GetBestMeta(ctx context.Context, id string, audioPath string, duration float64, fp *fingerprint.Fingerprint) (*TrackMeta, error) {
 	res, err := retry.Retry(retry.NewAlgSimpleDefault(), 3, s.GetYTMetaFromID, ctx, id)
 	if err != nil {
 		logger.ErrorC(ctx, "failed to get yt meta", slog.Any("error", err))
@@ -87,17 +116,12 @@ func (s *Service) GetBestMeta(ctx context.Context, id string) (*TrackMeta, error
 	}
 	trackMeta := res[0].(TrackMeta)
 	trackMeta.ID = id
-	res, err = retry.Retry(retry.NewAlgSimpleDefault(), 3, s.GetSpotifyMeta, ctx, trackMeta)
-	if err != nil {
-		logger.ErrorC(ctx, "failed to get spotify meta", slog.Any("error", err))
-		return nil, err
+	trackMeta.Duration = duration
+	merged := s.mergeCandidates(ctx, s.newQuery(ctx, id, trackMeta, audioPath, fp))
+	if merged.Title == "" {
+		return nil, fmt.Errorf("no metadata provider matched a title and artist for %s", id)
 	}
-	spotifyMetas := res[0].([]TrackMeta)
-	for _, spotifyMeta := range spotifyMetas {
-		spotifyMeta.ID = id
-	}
-	bestMeta := s.GetBestMetaMatch(ctx, trackMeta, spotifyMetas)
-	return &bestMeta, nil
+	return merged, nil
 }
 
 func (s *Service) GetYTMetaFromID(ctx context.Context, id string) (TrackMeta, error) {
@@ -145,11 +169,27 @@ func (s *Service) GetSpotifyMeta(ctx context.Context, trackMeta TrackMeta) ([]Tr
 		artists := make([]string, 0)
 		for _, artist := range track.Artists {
 			artists = append(artists, artist.Name)
+			if artist.ID != "" && !slices.Contains(resMeta.spotifyArtistIDs, artist.ID) {
+				resMeta.spotifyArtistIDs = append(resMeta.spotifyArtistIDs, artist.ID)
+			}
+		}
+
+		albumArtists := make([]string, 0, len(track.Album.Artists))
+		for _, artist := range track.Album.Artists {
+			albumArtists = append(albumArtists, artist.Name)
 		}
 
 		resMeta.Artist = strings.Join(artists, ", ")
 		resMeta.Album = track.Album.Name
+		resMeta.AlbumArtist = strings.Join(albumArtists, ", ")
 		resMeta.Title = track.Name
+		resMeta.Duration = track.TimeDuration().Seconds()
+		// Spotify only counts the album's tracks across all discs, so the per-disc track total is left unset
+		resMeta.TrackNumber = int(track.TrackNumber)
+		resMeta.DiscNumber = int(track.DiscNumber)
+		resMeta.ReleaseDate = track.Album.ReleaseDate
+		resMeta.Year = parseYear(track.Album.ReleaseDate)
+		resMeta.ISRC = track.ExternalIDs["isrc"]
 		resMeta.ID = trackMeta.ID
 		trackMetas = append(trackMetas, resMeta)
 	}
@@ -158,106 +198,59 @@ func (s *Service) GetSpotifyMeta(ctx context.Context, trackMeta TrackMeta) ([]Tr
 	return trackMetas, nil
 }
 
-func (s *Service) GetSpotifyToken(ctx context.Context) (*oauth2.Token, error) {
-	token, err := s.SpotifyConfig.Token(ctx)
-	if err != nil {
-		logger.ErrorC(ctx, "failed to get spotify token", slog.Any("error", err))
-		return nil, err
-	}
-	return token, nil
-}
-
-func (s *Service) GetBestMetaMatch(ctx context.Context, trackMeta TrackMeta, spotifyMetas []TrackMeta) TrackMeta {
-	coverArtist := s.CoverArtistCheck(ctx, trackMeta.Title)
-	if coverArtist != "" {
-		logger.InfoC(ctx, "cover artist found", slog.String("coverArtist", coverArtist))
+// addSpotifyGenres fills in the genres of a Spotify result from its artists, the main artist's first. Spotify only
+// has genres for artists, so they're looked up for the result that matched the track rather than for every search
+// result. Genres are optional, so a failed lookup is logged and leaves the track without them.
+func (s *Service) addSpotifyGenres(ctx context.Context, m *TrackMeta) {
+	if len(m.spotifyArtistIDs) == 0 {
+		return
 	}
-	sanitizedTitle := s.SanitizeString(s.SanitizeParenthesis(trackMeta.Title))
-	logger.InfoC(ctx, "sanitized title", slog.String("title", sanitizedTitle))
-	featStrippedTitle := strings.Split(sanitizedTitle, "feat")[0]
-	logger.InfoC(ctx, "feat stripped title", slog.String("title", featStrippedTitle))
-	titles := []string{trackMeta.Title, sanitizedTitle, featStrippedTitle}
-	artists := []string{trackMeta.Artist}
-	if coverArtist != "" {
-		artists = append(artists, s.SanitizeAuthor(coverArtist))
+	token, err := s.GetSpotifyToken(ctx)
+	if err != nil {
+		return
 	}
-	if len(spotifyMetas) == 0 {
-		spotifyMetas, err := s.GetSpotifyMeta(ctx, TrackMeta{Title: sanitizedTitle, Artist: trackMeta.Artist, ID: trackMeta.ID})
+	client := spotify.New(spotifyauth.New().Client(ctx, token))
+	for batch := range slices.Chunk(m.spotifyArtistIDs, spotifyMaxArtists) {
+		artists, err := client.GetArtists(ctx, batch...)
 		if err != nil {
-			logger.ErrorC(ctx, "failed to get spotify meta", slog.Any("error", err))
-			return TrackMeta{Title: sanitizedTitle, Artist: trackMeta.Artist, Album: sanitizedTitle, ID: trackMeta.ID, CoverArtURL: trackMeta.CoverArtURL}
+			logger.ErrorC(ctx, "failed to get spotify artist genres", slog.Any("error", err))
+			break
 		}
-		if coverArtist != "" {
-			caSpotifyMetas, err := s.GetSpotifyMeta(ctx, TrackMeta{Title: sanitizedTitle, Artist: coverArtist, ID: trackMeta.ID})
-			if err != nil {
-				logger.ErrorC(ctx, "failed to get spotify meta", slog.Any("error", err))
-				return TrackMeta{Title: sanitizedTitle, Artist: trackMeta.Artist, Album: sanitizedTitle, ID: trackMeta.ID, CoverArtURL: trackMeta.CoverArtURL}
+		for _, artist := range artists {
+			if artist == nil {
+				continue
 			}
-			spotifyMetas = append(spotifyMetas, caSpotifyMetas...)
-		}
-		if len(spotifyMetas) == 0 {
-			return TrackMeta{Title: sanitizedTitle, Artist: trackMeta.Artist, Album: sanitizedTitle, ID: trackMeta.ID, CoverArtURL: trackMeta.CoverArtURL}
-		}
-	}
-	sanitizedSplits := strings.Split(strings.ReplaceAll(sanitizedTitle, ":", "-"), "-")
-	if len(sanitizedSplits) < 2 {
-		titles = append(titles, sanitizedSplits[0])
-	}
-	if len(sanitizedSplits) == 2 {
-		titles = append(titles, sanitizedSplits[0], sanitizedSplits[1])
-		artists = append(artists, s.SanitizeAuthor(sanitizedSplits[0]), s.SanitizeAuthor(sanitizedSplits[1]))
-	} else if len(sanitizedSplits) == 3 {
-		titles = append(titles, sanitizedSplits[0], sanitizedSplits[1], sanitizedSplits[2], fmt.Sprintf("%s %s", sanitizedSplits[0], sanitizedSplits[1]), fmt.Sprintf("%s %s", sanitizedSplits[1], sanitizedSplits[2]))
-		artists = append(artists, s.SanitizeAuthor(sanitizedSplits[0]), s.SanitizeAuthor(sanitizedSplits[1]), s.SanitizeAuthor(sanitizedSplits[2]), s.SanitizeAuthor(fmt.Sprintf("%s %s", sanitizedSplits[0], sanitizedSplits[1])), s.SanitizeAuthor(fmt.Sprintf("%s %s", sanitizedSplits[1], sanitizedSplits[2])))
-	} else if len(sanitizedSplits) == 4 {
-		titles = append(titles, sanitizedSplits[0], sanitizedSplits[1], sanitizedSplits[2], sanitizedSplits[3], fmt.Sprintf("%s %s", sanitizedSplits[0], sanitizedSplits[1]), fmt.Sprintf("%s %s", sanitizedSplits[1], sanitizedSplits[2]), fmt.Sprintf("%s %s", sanitizedSplits[2], sanitizedSplits[3]), fmt.Sprintf("%s %s %s", sanitizedSplits[0], sanitizedSplits[1], sanitizedSplits[2]), fmt.Sprintf("%s %s %s", sanitizedSplits[1], sanitizedSplits[2], sanitizedSplits[3]), fmt.Sprintf("%s %s", sanitizedSplits[0], sanitizedSplits[1]))
-		artists = append(artists, s.SanitizeAuthor(sanitizedSplits[0]), s.SanitizeAuthor(sanitizedSplits[1]), s.SanitizeAuthor(sanitizedSplits[2]), s.SanitizeAuthor(sanitizedSplits[3]), s.SanitizeAuthor(fmt.Sprintf("%s %s", sanitizedSplits[0], sanitizedSplits[1])), s.SanitizeAuthor(fmt.Sprintf("%s %s", sanitizedSplits[1], sanitizedSplits[2])), s.SanitizeAuthor(fmt.Sprintf("%s %s", sanitizedSplits[2], sanitizedSplits[3])), s.SanitizeAuthor(fmt.Sprintf("%s %s %s", sanitizedSplits[0], sanitizedSplits[1], sanitizedSplits[2])), s.SanitizeAuthor(fmt.Sprintf("%s %s %s", sanitizedSplits[1], sanitizedSplits[2], sanitizedSplits[3])), s.SanitizeAuthor(fmt.Sprintf("%s %s", sanitizedSplits[0], sanitizedSplits[1])))
-	}
-	featStrippedSplits := strings.Split(strings.ReplaceAll(featStrippedTitle, ":", "-"), "-")
-	if len(featStrippedSplits) < 2 {
-		titles = append(titles, featStrippedSplits[0])
-	}
-	if len(featStrippedSplits) == 2 {
-		titles = append(titles, featStrippedSplits[0], featStrippedSplits[1])
-		artists = append(artists, s.SanitizeAuthor(featStrippedSplits[0]), s.SanitizeAuthor(featStrippedSplits[1]))
-	} else if len(featStrippedSplits) == 3 {
-		titles = append(titles, featStrippedSplits[0], featStrippedSplits[1], featStrippedSplits[2], fmt.Sprintf("%s %s", featStrippedSplits[0], featStrippedSplits[1]), fmt.Sprintf("%s %s", featStrippedSplits[1], featStrippedSplits[2]))
-		artists = append(artists, s.SanitizeAuthor(featStrippedSplits[0]), s.SanitizeAuthor(featStrippedSplits[1]), s.SanitizeAuthor(featStrippedSplits[2]), s.SanitizeAuthor(fmt.Sprintf("%s %s", featStrippedSplits[0], featStrippedSplits[1])), s.SanitizeAuthor(fmt.Sprintf("%s %s", featStrippedSplits[1], featStrippedSplits[2])))
-	} else if len(featStrippedSplits) == 4 {
-		titles = append(titles, featStrippedSplits[0], featStrippedSplits[1], featStrippedSplits[2], featStrippedSplits[3], fmt.Sprintf("%s %s", featStrippedSplits[0], featStrippedSplits[1]), fmt.Sprintf("%s %s", featStrippedSplits[1], featStrippedSplits[2]), fmt.Sprintf("%s %s", featStrippedSplits[2], featStrippedSplits[3]), fmt.Sprintf("%s %s %s", featStrippedSplits[0], featStrippedSplits[1], featStrippedSplits[2]), fmt.Sprintf("%s %s %s", featStrippedSplits[1], featStrippedSplits[2], featStrippedSplits[3]), fmt.Sprintf("%s %s", featStrippedSplits[0], featStrippedSplits[1]))
-		artists = append(artists, s.SanitizeAuthor(featStrippedSplits[0]), s.SanitizeAuthor(featStrippedSplits[1]), s.SanitizeAuthor(featStrippedSplits[2]), s.SanitizeAuthor(featStrippedSplits[3]), s.SanitizeAuthor(fmt.Sprintf("%s %s", featStrippedSplits[0], featStrippedSplits[1])), s.SanitizeAuthor(fmt.Sprintf("%s %s", featStrippedSplits[1], featStrippedSplits[2])), s.SanitizeAuthor(fmt.Sprintf("%s %s", featStrippedSplits[2], featStrippedSplits[3])), s.SanitizeAuthor(fmt.Sprintf("%s %s %s", featStrippedSplits[0], featStrippedSplits[1], featStrippedSplits[2])), s.SanitizeAuthor(fmt.Sprintf("%s %s %s", featStrippedSplits[1], featStrippedSplits[2], featStrippedSplits[3])), s.SanitizeAuthor(fmt.Sprintf("%s %s", featStrippedSplits[0], featStrippedSplits[1])))
-	}
-	for i, title := range titles {
-		titles[i] = strings.Trim(strings.ReplaceAll(title, "  ", " "), " ")
-	}
-	for i, artist := range artists {
-		artists[i] = strings.Trim(strings.ReplaceAll(artist, "  ", " "), " ")
-	}
-	logger.InfoC(ctx, "titles", slog.Any("titles", titles))
-	logger.InfoC(ctx, "artists", slog.Any("artists", artists))
-
-	for _, spotifyMeta := range spotifyMetas {
-		if coverArtist != "" {
-			if s.EqualIgnoringWhitespace(coverArtist, spotifyMeta.Artist) {
-				for _, title := range titles {
-					if s.EqualIgnoringWhitespace(title, spotifyMeta.Title) {
-						return TrackMeta{Title: spotifyMeta.Title, Artist: spotifyMeta.Artist, Album: spotifyMeta.Album, ID: trackMeta.ID, CoverArtURL: spotifyMeta.CoverArtURL}
-					}
+			for _, genre := range artist.Genres {
+				if genre = titleCase(genre); !slices.Contains(m.Genres, genre) {
+					m.Genres = append(m.Genres, genre)
 				}
 			}
 		}
-		for _, title := range titles {
-			if s.EqualIgnoringWhitespace(title, spotifyMeta.Title) {
-				for _, artist := range artists {
-					if s.EqualIgnoringWhitespace(artist, spotifyMeta.Artist) {
-						return TrackMeta{Title: spotifyMeta.Title, Artist: spotifyMeta.Artist, Album: spotifyMeta.Album, ID: trackMeta.ID, CoverArtURL: spotifyMeta.CoverArtURL}
-					}
-				}
-			}
+	}
+	m.Genre = strings.Join(m.Genres, "; ")
+}
+
+// spotifyMaxArtists is the most artists Spotify returns from one request
+const spotifyMaxArtists = 50
+
+// titleCase capitalizes each word of a lowercase Spotify genre, e.g. "hip hop" and "k-pop" become "Hip Hop" and "K-Pop"
+func titleCase(genre string) string {
+	runes := []rune(genre)
+	for i := range runes {
+		if i == 0 || runes[i-1] == ' ' || runes[i-1] == '-' {
+			runes[i] = unicode.ToUpper(runes[i])
 		}
 	}
+	return string(runes)
+}
 
-	return TrackMeta{Title: sanitizedTitle, Artist: trackMeta.Artist, Album: sanitizedTitle, CoverArtURL: trackMeta.CoverArtURL}
+func (s *Service) GetSpotifyToken(ctx context.Context) (*oauth2.Token, error) {
+	token, err := s.SpotifyConfig.Token(ctx)
+	if err != nil {
+		logger.ErrorC(ctx, "failed to get spotify token", slog.Any("error", err))
+		return nil, err
+	}
+	return token, nil
 }
 
 func (s *Service) GetPlaylistEntries(ctx context.Context, playlistID string) ([]string, error) {
@@ -284,16 +277,6 @@ func (s *Service) SanitizeParenthesis(str string) string {
 	return regex.ReplaceAllString(str, "")
 }
 
-func (s *Service) EqualIgnoringWhitespace(s1, s2 string) bool {
-	// Remove all whitespace from both strings
-	regex := regexp.MustCompile(`\s+`)
-	cleanS1 := regex.ReplaceAllString(s1, "")
-	cleanS2 := regex.ReplaceAllString(s2, "")
-
-	// Compare the cleaned strings
-	return strings.EqualFold(cleanS1, cleanS2)
-}
-
 func (s *Service) CoverArtistCheck(ctx context.Context, str string) string {
 	str = strings.ToLower(str)
 	parenthesisReg := regexp.MustCompile(`\([^\(\)]*\)|\[[^\[\]]*\]`)
@@ -1,11 +1,36 @@
 package meta
 
 import (
+	"strconv"
+	"strings"
+
+	"github.com/gcottom/echodaemon/services/classifier"
+	"github.com/gcottom/echodaemon/services/coverart"
+
+	"github.com/zmb3/spotify/v2"
 	"golang.org/x/oauth2/clientcredentials"
 )
 
 type Service struct {
 	SpotifyConfig *clientcredentials.Config
+	// MusicBrainz is the client used by the musicbrainz provider; nil leaves the provider unavailable
+	MusicBrainz *MusicBrainzClient
+	// Providers are asked for metadata candidates; earlier providers win when several supply the same field
+	Providers []MetadataProvider
+	// MinScore is the match score from 0 to 1 a candidate needs to be used; 0 means DefaultMinScore
+	MinScore float64
+	// CoverArt fetches and processes cover images; nil saves tracks without cover art
+	CoverArt *coverart.Service
+	// GenrePolicy is one of the config.GenrePolicy constants, deciding whether the genre comes from the matched
+	// Spotify track's artists, the classifier or both; empty means config.GenrePolicyPreferML
+	GenrePolicy string
+	// Classifier detects genres from the audio for the classifier provider; nil leaves the provider unavailable
+	Classifier classifier.GenreClassifier
+	// Taxonomy maps the classifier's tags to genres, moods and instruments, keeping those scoring at least
+	// TagThreshold and at most MaxGenres genres (0 for no limit); a nil Taxonomy uses classifier.DefaultTaxonomy
+	Taxonomy     *classifier.Taxonomy
+	TagThreshold float64
+	MaxGenres    int
 }
 
 type TrackMeta struct {
@@ -15,8 +40,104 @@ type TrackMeta struct {
 	Title       string `json:"title"`
 	Artist      string `json:"artist"`
 	Album       string `json:"album,omitempty"`
+	AlbumArtist string `json:"album_artist,omitempty"`
+	Composer    string `json:"composer,omitempty"`
 	CoverArtURL string `json:"cover_art_url,omitempty"`
 	Genre       string `json:"genre,omitempty"`
+	// Genres lists every genre detected in the audio, best first; Genre joins them into the one genre tag
+	Genres      []string `json:"genres,omitempty"`
+	Moods       []string `json:"moods,omitempty"`
+	Instruments []string `json:"instruments,omitempty"`
+	Year        int      `json:"year,omitempty"`
+	// ReleaseDate is the release date as precise as it's known: YYYY, YYYY-MM or YYYY-MM-DD
+	ReleaseDate string `json:"release_date,omitempty"`
+	TrackNumber int    `json:"track_number,omitempty"`
+	TrackTotal  int    `json:"track_total,omitempty"`
+	DiscNumber  int    `json:"disc_number,omitempty"`
+	ISRC        string `json:"isrc,omitempty"`
+	// Duration is the track length in seconds, when known
+	Duration float64 `json:"duration,omitempty"`
+
+	MusicBrainzRecordingID    string `json:"musicbrainz_recording_id,omitempty"`
+	MusicBrainzReleaseID      string `json:"musicbrainz_release_id,omitempty"`
+	MusicBrainzReleaseGroupID string `json:"musicbrainz_release_group_id,omitempty"`
+
+	// CoverArtSources lists every provider's cover art in priority order, ending with the video thumbnail, so a
+	// cover that can't be fetched falls back to the next; CoverArt is the cover that was embedded
+	CoverArtSources []coverart.Source `json:"-"`
+	CoverArt        *coverart.Cover   `json:"-"`
+
+	// Sources records which provider each merged field came from
+	Sources map[string]string `json:"sources,omitempty"`
+	// MatchScore is how well the candidate the title and artist came from matched the track
+	MatchScore float64 `json:"match_score,omitempty"`
+
+	// spotifyArtistIDs are the artists of a Spotify result, main artist first, whose genres the track takes
+	spotifyArtistIDs []spotify.ID
+}
+
+// customFields returns the metadata that is written through customtags rather than audiometa
+func (m *TrackMeta) customFields() map[string]string {
+	fields := make(map[string]string)
+	date := m.ReleaseDate
+	if date == "" && m.Year != 0 {
+		date = strconv.Itoa(m.Year)
+	}
+	for name, value := range map[string]string{
+		"DATE":                       date,
+		"ISRC":                       m.ISRC,
+		"MOOD":                       strings.Join(m.Moods, "; "),
+		"INSTRUMENTS":                strings.Join(m.Instruments, "; "),
+		"MUSICBRAINZ_TRACKID":        m.MusicBrainzRecordingID,
+		"MUSICBRAINZ_ALBUMID":        m.MusicBrainzReleaseID,
+		"MUSICBRAINZ_RELEASEGROUPID": m.MusicBrainzReleaseGroupID,
+	} {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+// MusicBrainzRecording is a MusicBrainz recording together with the release chosen to represent it
+type MusicBrainzRecording struct {
+	RecordingID    string  `json:"recording_id"`
+	Title          string  `json:"title"`
+	Artist         string  `json:"artist"`
+	ReleaseID      string  `json:"release_id,omitempty"`
+	Album          string  `json:"album,omitempty"`
+	AlbumArtist    string  `json:"album_artist,omitempty"`
+	Composer       string  `json:"composer,omitempty"`
+	ReleaseGroupID string  `json:"release_group_id,omitempty"`
+	TrackNumber    int     `json:"track_number,omitempty"`
+	TrackTotal     int     `json:"track_total,omitempty"`
+	DiscNumber     int     `json:"disc_number,omitempty"`
+	Year           int     `json:"year,omitempty"`
+	ReleaseDate    string  `json:"release_date,omitempty"`
+	ISRC           string  `json:"isrc,omitempty"`
+	Duration       float64 `json:"duration,omitempty"`
+	Score          float64 `json:"score"`
+}
+
+// trackMeta returns the recording as a metadata candidate
+func (r *MusicBrainzRecording) trackMeta() TrackMeta {
+	return TrackMeta{
+		Title:                     r.Title,
+		Artist:                    r.Artist,
+		Album:                     r.Album,
+		AlbumArtist:               r.AlbumArtist,
+		Composer:                  r.Composer,
+		Year:                      r.Year,
+		ReleaseDate:               r.ReleaseDate,
+		TrackNumber:               r.TrackNumber,
+		TrackTotal:                r.TrackTotal,
+		DiscNumber:                r.DiscNumber,
+		ISRC:                      r.ISRC,
+		Duration:                  r.Duration,
+		MusicBrainzRecordingID:    r.RecordingID,
+		MusicBrainzReleaseID:      r.ReleaseID,
+		MusicBrainzReleaseGroupID: r.ReleaseGroupID,
+	}
 }
 
 type YTMMetaResponse struct {